@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// secretRefreshInterval is how often secret files are re-read to pick up
+// rotated secrets
+const secretRefreshInterval = time.Minute
+
+// requestAuth sets the credentials of requests to the target. A nil
+// requestAuth sets no credentials.
+type requestAuth struct {
+	bearerToken string
+	// bearerTokenFile takes precedence over bearerToken if set
+	bearerTokenFile *secretFile
+
+	basicAuthUsername string
+	basicAuthPassword string
+	// basicAuthPasswordFile takes precedence over basicAuthPassword if set
+	basicAuthPasswordFile *secretFile
+}
+
+// apply sets the credentials on req
+func (a *requestAuth) apply(req *http.Request) error {
+	if a == nil {
+		return nil
+	}
+
+	token := a.bearerToken
+	if a.bearerTokenFile != nil {
+		var err error
+		if token, err = a.bearerTokenFile.get(time.Now()); err != nil {
+			return fmt.Errorf("error reading bearer token file %w", err)
+		}
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	if a.basicAuthUsername != "" {
+		password := a.basicAuthPassword
+		if a.basicAuthPasswordFile != nil {
+			var err error
+			if password, err = a.basicAuthPasswordFile.get(time.Now()); err != nil {
+				return fmt.Errorf("error reading basic auth password file %w", err)
+			}
+		}
+		req.SetBasicAuth(a.basicAuthUsername, password)
+	}
+	return nil
+}
+
+// secretFile is a secret read from a file, which is re-read once refresh has
+// passed since it was last read
+type secretFile struct {
+	path    string
+	refresh time.Duration
+
+	mu     sync.Mutex
+	value  string
+	readAt time.Time
+}
+
+// get returns the secret, surrounding whitespace is trimmed
+func (s *secretFile) get(now time.Time) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.readAt.IsZero() && now.Sub(s.readAt) < s.refresh {
+		return s.value, nil
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return "", err
+	}
+	s.value = strings.TrimSpace(string(data))
+	s.readAt = now
+	return s.value, nil
+}
+
+// basicAuthHandler returns a handler serving next to requests with the basic
+// auth username and the password in passwordFile. The credentials are
+// compared in constant time.
+func basicAuthHandler(username string, passwordFile *secretFile, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		password, err := passwordFile.get(time.Now())
+		if err != nil {
+			log.Error("error reading web auth password file", "err", err)
+			http.Error(w, "error reading password file", http.StatusInternalServerError)
+			return
+		}
+
+		user, pass, ok := r.BasicAuth()
+		// comparing hashes keeps the comparison constant time when the
+		// lengths differ
+		userHash, wantUserHash := sha256.Sum256([]byte(user)), sha256.Sum256([]byte(username))
+		passHash, wantPassHash := sha256.Sum256([]byte(pass)), sha256.Sum256([]byte(password))
+		valid := subtle.ConstantTimeCompare(userHash[:], wantUserHash[:]) & subtle.ConstantTimeCompare(passHash[:], wantPassHash[:])
+		if !ok || valid != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="metrics-aggregator"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestRequestAuthBearerToken(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("file-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		auth *requestAuth
+		want string
+	}{
+		{"none", nil, ""},
+		{"token", &requestAuth{bearerToken: "token"}, "Bearer token"},
+		{"file-wins", &requestAuth{bearerToken: "token", bearerTokenFile: &secretFile{path: tokenFile}}, "Bearer file-token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if err := tt.auth.apply(req); err != nil {
+				t.Fatalf("apply() error = %v", err)
+			}
+			if got := req.Header.Get("Authorization"); got != tt.want {
+				t.Errorf("Authorization = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	missing := &requestAuth{bearerTokenFile: &secretFile{path: filepath.Join(t.TempDir(), "missing")}}
+	if err := missing.apply(httptest.NewRequest(http.MethodGet, "/metrics", nil)); err == nil {
+		t.Errorf("apply() with missing token file expected error")
+	}
+}
+
+func TestRequestAuthBasicAuth(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(passwordFile, []byte("file-password\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		auth         *requestAuth
+		wantPassword string
+	}{
+		{"password", &requestAuth{basicAuthUsername: "user", basicAuthPassword: "password"}, "password"},
+		{"file-wins", &requestAuth{basicAuthUsername: "user", basicAuthPassword: "password", basicAuthPasswordFile: &secretFile{path: passwordFile}}, "file-password"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if err := tt.auth.apply(req); err != nil {
+				t.Fatalf("apply() error = %v", err)
+			}
+			username, password, ok := req.BasicAuth()
+			if !ok || username != "user" || password != tt.wantPassword {
+				t.Errorf("BasicAuth() = %q, %q, %v, want user, %q, true", username, password, ok, tt.wantPassword)
+			}
+		})
+	}
+}
+
+func TestSecretFileRefresh(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret")
+	write := func(value string) {
+		if err := os.WriteFile(path, []byte(value), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	secret := &secretFile{path: path, refresh: time.Minute}
+	now := time.Now()
+
+	write("v1")
+	if got, err := secret.get(now); err != nil || got != "v1" {
+		t.Fatalf("get() = %q, %v, want v1", got, err)
+	}
+
+	// rotated secrets are picked up only once refresh passed
+	write("v2")
+	if got, _ := secret.get(now.Add(30 * time.Second)); got != "v1" {
+		t.Errorf("get() before refresh = %q, want v1", got)
+	}
+	if got, _ := secret.get(now.Add(time.Minute)); got != "v2" {
+		t.Errorf("get() after refresh = %q, want v2", got)
+	}
+}
+
+func Test_CollectorBearerToken(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `# TYPE component_received_events_total counter
+component_received_events_total{l1="v1"} 10
+`)
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name    string
+		token   string
+		wantLen int
+	}{
+		{"valid-token", "secret", 1},
+		{"invalid-token", "other", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collector := &RemoteAggregator{
+				url:  ts.URL,
+				auth: &requestAuth{bearerToken: tt.token},
+			}
+
+			reg := prometheus.NewPedanticRegistry()
+			reg.MustRegister(collector)
+
+			gathering, err := reg.Gather()
+			if err != nil {
+				t.Fatalf("reg.Gather() error = %v", err)
+			}
+			if len(gathering) != tt.wantLen {
+				t.Errorf("got %d metric families, want %d", len(gathering), tt.wantLen)
+			}
+		})
+	}
+}
+
+func TestBasicAuthHandler(t *testing.T) {
+	log = slog.Default()
+
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(passwordFile, []byte("secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := basicAuthHandler("user", &secretFile{path: passwordFile, refresh: time.Minute}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name     string
+		setAuth  bool
+		username string
+		password string
+		want     int
+	}{
+		{"valid", true, "user", "secret", http.StatusOK},
+		{"wrong-password", true, "user", "other", http.StatusUnauthorized},
+		{"wrong-user", true, "other", "secret", http.StatusUnauthorized},
+		{"no-auth", false, "", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if tt.setAuth {
+				req.SetBasicAuth(tt.username, tt.password)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if tt.want == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("missing WWW-Authenticate header")
+			}
+		})
+	}
+}
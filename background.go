@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var cacheAgeDesc = prometheus.NewDesc(
+	"metrics_aggregation_cache_age_seconds",
+	"Time since the cached metrics of the remote were scraped",
+	[]string{"remote"}, nil,
+)
+
+// metricsCache holds the aggregated metrics of the latest background scrape
+type metricsCache struct {
+	mu      sync.Mutex
+	metrics []prometheus.Metric
+	updated time.Time
+}
+
+// set replaces the cached metrics
+func (c *metricsCache) set(metrics []prometheus.Metric, updated time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.metrics = metrics
+	c.updated = updated
+}
+
+// get returns the cached metrics and when they were scraped
+func (c *metricsCache) get() ([]prometheus.Metric, time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.metrics, c.updated
+}
+
+// startBackgroundScrape scrapes the target into the cache once before
+// returning, unless skipInitial is set, and then every interval, randomly
+// varied by up to the jitter fraction of it, until ctx is done. It returns
+// the error of the initial scrape, the cache stays empty until the next scrape
+// then. With skipInitial the first scrape starts in the background right away.
+func (ra *RemoteAggregator) startBackgroundScrape(ctx context.Context, interval time.Duration, jitter float64, skipInitial bool) error {
+	ra.cache = &metricsCache{}
+	var err error
+	first := time.Duration(0)
+	if !skipInitial {
+		err = ra.refreshCache(ctx)
+		first = jitteredInterval(interval, jitter, rand.Float64())
+	}
+
+	go func() {
+		timer := time.NewTimer(first)
+		defer timer.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+				ra.refreshCache(ctx)
+				timer.Reset(jitteredInterval(interval, jitter, rand.Float64()))
+			}
+		}
+	}()
+	return err
+}
+
+// jitteredInterval returns interval varied by up to the jitter fraction of it
+// in either direction, r in [0, 1) selects the variation. Replicas scraping
+// the same target thereby spread their scrapes over time.
+func jitteredInterval(interval time.Duration, jitter, r float64) time.Duration {
+	return interval + time.Duration((2*r-1)*jitter*float64(interval))
+}
+
+// refreshCache scrapes the target and replaces the cached metrics with the
+// result, even if the scrape failed. The result is never merged into the
+// cached metrics, so series which disappeared from the target aren't served.
+// The metrics of a scrape timing out are discarded, as scrape doesn't buffer
+// them again. It returns the error of the scrape.
+func (ra *RemoteAggregator) refreshCache(ctx context.Context) error {
+	var err error
+	metrics := bufferMetrics(func(ch chan<- prometheus.Metric) { err = ra.collect(ctx, ch, true) })
+	if errors.Is(err, context.DeadlineExceeded) {
+		metrics = nil
+	}
+	ra.cache.set(metrics, time.Now())
+	return err
+}
+
+// bufferMetrics returns the metrics collect sends to its channel once it
+// returned
+func bufferMetrics(collect func(ch chan<- prometheus.Metric)) []prometheus.Metric {
+	ch := make(chan prometheus.Metric)
+	done := make(chan struct{})
+
+	var metrics []prometheus.Metric
+	go func() {
+		defer close(done)
+		for metric := range ch {
+			metrics = append(metrics, metric)
+		}
+	}()
+
+	collect(ch)
+	close(ch)
+	<-done
+	return metrics
+}
+
+// collectCache sends the cached metrics and their age to ch
+func (ra *RemoteAggregator) collectCache(ch chan<- prometheus.Metric) {
+	metrics, updated := ra.cache.get()
+	for _, metric := range metrics {
+		ch <- metric
+	}
+	// the cache has no age until the first background scrape filled it
+	if updated.IsZero() {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(cacheAgeDesc, prometheus.GaugeValue, time.Since(updated).Seconds(), ra.url)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/proto"
+)
+
+func Test_CollectorBackgroundScrape(t *testing.T) {
+	log = slog.Default()
+
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		fmt.Fprint(w, `# TYPE component_received_events_total counter
+component_received_events_total{l1="v1",l2="v2"} 10
+component_received_events_total{l1="v1",l2="v3"} 20
+`)
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{
+		url:                    ts.URL,
+		aggregateWithOutLabels: []string{"l2"},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := collector.startBackgroundScrape(ctx, time.Hour, 0.1, false); err != nil {
+		t.Fatalf("startBackgroundScrape() error = %v", err)
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	// the cache is filled before starting returns and served on every gather
+	for range 2 {
+		gathering, err := reg.Gather()
+		if err != nil {
+			t.Fatalf("reg.Gather() error = %v", err)
+		}
+
+		if len(gathering) != 2 {
+			t.Fatalf("got %d metric families, want aggregated and cache age", len(gathering))
+		}
+		if name := gathering[0].GetName(); name != "component_received_events_total" || gathering[0].Metric[0].GetCounter().GetValue() != 30 {
+			t.Errorf("unexpected aggregated family: %v", gathering[0])
+		}
+		if name := gathering[1].GetName(); name != "metrics_aggregation_cache_age_seconds" {
+			t.Errorf("family name = %s, want metrics_aggregation_cache_age_seconds", name)
+		}
+	}
+
+	if got := requests.Load(); got != 1 {
+		t.Errorf("target requests = %d, want 1", got)
+	}
+}
+
+func Test_CollectorBackgroundScrapeInitialError(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{url: ts.URL, aggregateWithOutLabels: []string{"l2"}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := collector.startBackgroundScrape(ctx, time.Hour, 0.1, false); err == nil {
+		t.Fatalf("startBackgroundScrape() error = nil, want the error of the initial scrape")
+	}
+	if metrics, _ := collector.cache.get(); len(metrics) != 0 {
+		t.Errorf("got %d cached metrics, want 0", len(metrics))
+	}
+}
+
+func Test_CollectorBackgroundScrapeSkipInitial(t *testing.T) {
+	log = slog.Default()
+
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		fmt.Fprint(w, `# TYPE component_received_events_total counter
+component_received_events_total{l1="v1",l2="v2"} 10
+`)
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	collector := &RemoteAggregator{url: ts.URL, aggregateWithOutLabels: []string{"l2"}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// the target doesn't respond until released, starting must not wait for it
+	if err := collector.startBackgroundScrape(ctx, time.Hour, 0.1, true); err != nil {
+		t.Fatalf("startBackgroundScrape() error = %v", err)
+	}
+	if metrics, _ := collector.cache.get(); len(metrics) != 0 {
+		t.Fatalf("got %d cached metrics before the first scrape, want 0", len(metrics))
+	}
+	// the cache age isn't exported before the first scrape
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+	if len(gathering) != 0 {
+		t.Errorf("got %d metric families before the first scrape, want 0", len(gathering))
+	}
+
+	release <- struct{}{}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if metrics, _ := collector.cache.get(); len(metrics) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("cache not filled by the first background scrape")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRefreshCache(t *testing.T) {
+	log = slog.Default()
+
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) > 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, `# TYPE component_received_events_total counter
+component_received_events_total{l1="v1"} 10
+`)
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{url: ts.URL, cache: &metricsCache{}}
+
+	collector.refreshCache(context.Background())
+	if metrics, _ := collector.cache.get(); len(metrics) != 1 {
+		t.Fatalf("got %d cached metrics, want 1", len(metrics))
+	}
+
+	// a failed scrape replaces the cache as well
+	collector.refreshCache(context.Background())
+	metrics, updated := collector.cache.get()
+	if len(metrics) != 0 {
+		t.Errorf("got %d cached metrics after failed scrape, want 0", len(metrics))
+	}
+	if time.Since(updated) > time.Minute {
+		t.Errorf("cache updated at %s, expected to be refreshed", updated)
+	}
+}
+
+func TestRefreshCacheRemovedSeries(t *testing.T) {
+	log = slog.Default()
+
+	var removed atomic.Bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "# TYPE component_received_events_total counter\n")
+		fmt.Fprint(w, "component_received_events_total{l1=\"v1\",l2=\"v2\"} 10\n")
+		if !removed.Load() {
+			fmt.Fprint(w, "component_received_events_total{l1=\"v2\",l2=\"v2\"} 20\n")
+		}
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{
+		url:                    ts.URL,
+		aggregateWithOutLabels: []string{"l2"},
+		cache:                  &metricsCache{},
+	}
+
+	collector.refreshCache(context.Background())
+	if metrics, _ := collector.cache.get(); len(metrics) != 2 {
+		t.Fatalf("got %d cached metrics, want 2", len(metrics))
+	}
+
+	// the series aggregated into l1="v2" disappeared from the target
+	removed.Store(true)
+	collector.refreshCache(context.Background())
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+	for _, mf := range gathering {
+		if mf.GetName() != "component_received_events_total" {
+			continue
+		}
+		if len(mf.Metric) != 1 || mf.Metric[0].Label[0].GetValue() != "v1" {
+			t.Errorf("got series %v, want only l1=\"v1\"", mf.Metric)
+		}
+	}
+}
+
+func TestJitteredInterval(t *testing.T) {
+	tests := []struct {
+		name   string
+		jitter float64
+		r      float64
+		want   time.Duration
+	}{
+		{"no-jitter", 0, 0.9, 10 * time.Second},
+		{"shortest", 0.1, 0, 9 * time.Second},
+		{"middle", 0.1, 0.5, 10 * time.Second},
+		{"longest", 0.1, 1, 11 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := jitteredInterval(10*time.Second, tt.jitter, tt.r); got != tt.want {
+				t.Errorf("jitteredInterval() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRefreshCacheTimeoutWhileDecoding(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		format := expfmt.NewFormat(expfmt.TypeProtoDelim)
+		w.Header().Set("Content-Type", string(format))
+		family := &dto.MetricFamily{
+			Name:   pointer("component_received_events_total"),
+			Type:   dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{{Counter: &dto.Counter{Value: proto.Float64(10)}}},
+		}
+		if err := expfmt.NewEncoder(w, format).Encode(family); err != nil {
+			t.Error(err)
+		}
+		w.(http.Flusher).Flush()
+		// the remaining families are never sent
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{
+		url:           ts.URL,
+		scrapeTimeout: 100 * time.Millisecond,
+		cache:         &metricsCache{},
+	}
+
+	// the family decoded before the deadline isn't cached
+	if err := collector.refreshCache(context.Background()); err == nil {
+		t.Fatalf("refreshCache() error = nil, want timeout")
+	}
+	if metrics, _ := collector.cache.get(); len(metrics) != 0 {
+		t.Errorf("got %d cached metrics, want 0", len(metrics))
+	}
+}
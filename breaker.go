@@ -0,0 +1,64 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// circuitBreaker pauses scraping of a target for cooldown after threshold
+// consecutive failed scrapes. Once the cooldown passed a single probe scrape
+// is allowed, which closes the breaker on success or opens it again for
+// another cooldown on failure. A nil circuitBreaker always allows scraping.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// allow reports whether the target can be scraped now
+func (cb *circuitBreaker) allow(now time.Time) bool {
+	if cb == nil {
+		return true
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.failures < cb.threshold {
+		return true
+	}
+	if cb.probing || now.Before(cb.openUntil) {
+		return false
+	}
+	cb.probing = true
+	return true
+}
+
+// record records the result of an allowed scrape
+func (cb *circuitBreaker) record(success bool, now time.Time) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.probing = false
+	if success {
+		cb.failures = 0
+		return
+	}
+
+	cb.failures++
+	if cb.failures >= cb.threshold {
+		cb.openUntil = now.Add(cb.cooldown)
+	}
+}
+
+// isOpen reports whether scrapes are currently paused or waiting for a probe
+func (cb *circuitBreaker) isOpen() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	return cb.failures >= cb.threshold
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func Test_CollectorCircuitBreaker(t *testing.T) {
+	log = slog.Default()
+
+	var hits atomic.Int32
+	var healthy atomic.Bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, `# TYPE component_received_events_total counter
+component_received_events_total{l1="v1"} 10
+`)
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{
+		url:     ts.URL,
+		breaker: &circuitBreaker{threshold: 2, cooldown: 100 * time.Millisecond},
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	for range 4 {
+		if _, err := reg.Gather(); err != nil {
+			t.Fatalf("reg.Gather() error = %v", err)
+		}
+	}
+
+	if got := hits.Load(); got != 2 {
+		t.Errorf("target hits with open breaker = %d, want 2", got)
+	}
+	if got := testutil.ToFloat64(breakerOpen.WithLabelValues(ts.URL)); got != 1 {
+		t.Errorf("breaker open = %v, want 1", got)
+	}
+
+	// after the cooldown a single probe is allowed which closes the breaker
+	time.Sleep(150 * time.Millisecond)
+	healthy.Store(true)
+
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+	if got := hits.Load(); got != 3 {
+		t.Errorf("target hits after cooldown = %d, want 3", got)
+	}
+	if len(gathering) != 1 {
+		t.Errorf("got %d metric families after breaker closed, want 1", len(gathering))
+	}
+	if got := testutil.ToFloat64(breakerOpen.WithLabelValues(ts.URL)); got != 0 {
+		t.Errorf("breaker open = %v, want 0", got)
+	}
+}
+
+func TestCircuitBreakerProbe(t *testing.T) {
+	cb := &circuitBreaker{threshold: 1, cooldown: time.Minute}
+	now := time.Now()
+
+	if !cb.allow(now) {
+		t.Fatalf("allow() = false on closed breaker")
+	}
+	cb.record(false, now)
+
+	if cb.allow(now.Add(30 * time.Second)) {
+		t.Errorf("allow() = true during cooldown")
+	}
+
+	probeTime := now.Add(2 * time.Minute)
+	if !cb.allow(probeTime) {
+		t.Errorf("allow() = false after cooldown")
+	}
+	if cb.allow(probeTime) {
+		t.Errorf("allow() = true while a probe is in flight")
+	}
+
+	cb.record(false, probeTime)
+	if cb.allow(probeTime.Add(30 * time.Second)) {
+		t.Errorf("allow() = true after failed probe")
+	}
+	if !cb.isOpen() {
+		t.Errorf("isOpen() = false after failed probe")
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// clientConfig configures the http client used to scrape the target
+type clientConfig struct {
+	// timeout bounds the whole request including reading the body, 0
+	// disables it
+	timeout time.Duration
+	// resolver resolves the target's host name, net.DefaultResolver is used
+	// if not set
+	resolver *net.Resolver
+	// dnsTimeout bounds the host name resolution separately from the rest
+	// of the scrape, 0 disables it
+	dnsTimeout time.Duration
+	tlsConfig  *tls.Config
+	// proxyURL is the proxy all requests are sent through, the proxy
+	// environment variables are used if not set
+	proxyURL *url.URL
+	// maxIdleConns is the number of idle connections kept open to the
+	// target between scrapes, the transport's default is used if 0
+	maxIdleConns int
+	// idleConnTimeout is how long an idle connection is kept open, the
+	// transport's default is used if 0
+	idleConnTimeout time.Duration
+}
+
+// newHTTPClient returns a http client configured according to cfg. The client
+// is created once and shared by all scrapes, so connections to the target are
+// reused across scrapes.
+func newHTTPClient(cfg clientConfig) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = cfg.tlsConfig
+	if cfg.maxIdleConns > 0 {
+		// all connections go to the target, so the per host limit, which
+		// defaults to 2, is the one that matters for concurrent scrapes
+		transport.MaxIdleConns = cfg.maxIdleConns
+		transport.MaxIdleConnsPerHost = cfg.maxIdleConns
+	}
+	if cfg.idleConnTimeout > 0 {
+		transport.IdleConnTimeout = cfg.idleConnTimeout
+	}
+	transport.Proxy = http.ProxyFromEnvironment
+	if cfg.proxyURL != nil {
+		transport.Proxy = http.ProxyURL(cfg.proxyURL)
+	}
+
+	if cfg.resolver != nil || cfg.dnsTimeout > 0 {
+		resolver := cfg.resolver
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+		dialer := &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}
+		transport.DialContext = resolvingDialContext(dialer, resolver, cfg.dnsTimeout)
+	}
+
+	return &http.Client{Transport: transport, Timeout: cfg.timeout}
+}
+
+// parseProxyURL parses the http, https or socks5 proxy url
+func parseProxyURL(raw string) (*url.URL, error) {
+	proxyURL, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q, must be http, https or socks5", proxyURL.Scheme)
+	}
+	if proxyURL.Host == "" {
+		return nil, fmt.Errorf("missing host")
+	}
+	return proxyURL, nil
+}
+
+// newResolver returns a resolver which sends all DNS queries to the given
+// host:port address
+func newResolver(address string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, address)
+		},
+	}
+}
+
+// resolvingDialContext returns a dial function which resolves the host name
+// with resolver within dnsTimeout before dialing the resolved addresses in
+// order. Resolution failures are returned as *net.DNSError.
+func resolvingDialContext(dialer *net.Dialer, resolver *net.Resolver, dnsTimeout time.Duration) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		if net.ParseIP(host) != nil {
+			return dialer.DialContext(ctx, network, address)
+		}
+
+		lookupCtx := ctx
+		if dnsTimeout > 0 {
+			var cancel context.CancelFunc
+			lookupCtx, cancel = context.WithTimeout(ctx, dnsTimeout)
+			defer cancel()
+		}
+
+		addrs, err := resolver.LookupHost(lookupCtx, host)
+		if err != nil {
+			return nil, err
+		}
+
+		var dialErr error
+		for _, addr := range addrs {
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(addr, port))
+			if err == nil {
+				return conn, nil
+			}
+			if dialErr == nil {
+				dialErr = err
+			}
+		}
+		return nil, dialErr
+	}
+}
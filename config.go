@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"sync/atomic"
+
+	"go.yaml.in/yaml/v2"
+)
+
+// config is the content of the file given by --config-file, unknown keys are
+// rejected:
+//
+//	rules:
+//	  # the metric family name, or a regular expression matching the whole
+//	  # name, exactly one of them must be set
+//	  - metric: http_requests_total
+//	    metric_regex: http_.*
+//	    # the labels to aggregate over, or the only labels to keep, at most
+//	    # one of them can be set
+//	    aggregate_without_labels: [pod, instance]
+//	    aggregate_by_labels: [service]
+//	    # sum, avg, min, max, count or present, --aggregation if not set
+//	    aggregation: sum
+//	# Prometheus relabel_config style rules applied in order to the labels of
+//	# the aggregated series, __name__ is the exported metric name
+//	relabel:
+//	  - source_labels: [__name__, service]
+//	    # defaults
+//	    separator: ;
+//	    regex: (.*)
+//	    # keep, drop or replace
+//	    action: replace
+//	    # required by replace, an empty replacement removes the label
+//	    target_label: service
+//	    replacement: $1
+type config struct {
+	Rules   []aggregationRule `yaml:"rules"`
+	Relabel []relabelConfig   `yaml:"relabel"`
+}
+
+// aggregationRule replaces the aggregation flags for the metric families it
+// matches
+type aggregationRule struct {
+	Metric                 string   `yaml:"metric"`
+	MetricRegex            string   `yaml:"metric_regex"`
+	AggregateWithOutLabels []string `yaml:"aggregate_without_labels"`
+	AggregateByLabels      []string `yaml:"aggregate_by_labels"`
+	Aggregation            string   `yaml:"aggregation"`
+
+	metricRegex *regexp.Regexp
+}
+
+// matches reports whether the rule applies to the named metric family
+func (r *aggregationRule) matches(name string) bool {
+	if r.metricRegex != nil {
+		return r.metricRegex.MatchString(name)
+	}
+	return r.Metric == name
+}
+
+// readConfig reads and validates the config file
+func readConfig(file string) (*config, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg config
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return nil, fmt.Errorf("error parsing config %w", err)
+	}
+
+	for i := range cfg.Rules {
+		if err := cfg.Rules[i].validate(); err != nil {
+			return nil, fmt.Errorf("invalid rule %d %w", i, err)
+		}
+	}
+	for i := range cfg.Relabel {
+		if err := cfg.Relabel[i].validate(); err != nil {
+			return nil, fmt.Errorf("invalid relabel rule %d %w", i, err)
+		}
+	}
+	return &cfg, nil
+}
+
+// validate checks the rule and compiles its regular expression
+func (r *aggregationRule) validate() error {
+	if (r.Metric == "") == (r.MetricRegex == "") {
+		return errors.New("exactly one of metric and metric_regex must be set")
+	}
+	if len(r.AggregateWithOutLabels) > 0 && len(r.AggregateByLabels) > 0 {
+		return errors.New("aggregate_without_labels and aggregate_by_labels can't be used together")
+	}
+	if r.Aggregation != "" && !slices.Contains(aggregationFunctions, r.Aggregation) {
+		return fmt.Errorf("invalid aggregation %q", r.Aggregation)
+	}
+
+	if r.MetricRegex != "" {
+		regex, err := regexp.Compile("^(?:" + r.MetricRegex + ")$")
+		if err != nil {
+			return fmt.Errorf("invalid metric_regex %w", err)
+		}
+		r.metricRegex = regex
+	}
+	return nil
+}
+
+// newSharedConfig returns a config pointer holding cfg, to be shared by the
+// collectors of all targets so a reload applies to all of them at once
+func newSharedConfig(cfg *config) *atomic.Pointer[config] {
+	shared := &atomic.Pointer[config]{}
+	shared.Store(cfg)
+	return shared
+}
+
+// loadConfig returns the current config file of the collector, an empty config
+// if it has none
+func (ra *RemoteAggregator) loadConfig() *config {
+	if ra.fileConfig != nil {
+		if cfg := ra.fileConfig.Load(); cfg != nil {
+			return cfg
+		}
+	}
+	return &config{}
+}
+
+// reloadHandler calls reload, returning 500 with its error if it fails. The
+// previous config is kept on errors.
+func reloadHandler(reload func() error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if err := reload(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestReadConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr bool
+	}{
+		{
+			"valid",
+			`rules:
+  - metric: http_requests_total
+    aggregate_without_labels: [pod]
+  - metric_regex: http_.*
+    aggregate_by_labels: [service]
+    aggregation: avg
+`,
+			false,
+		},
+		{"unknown-key", "rules:\n  - metric: m\n    labels: [pod]\n", true},
+		{"metric-and-regex", "rules:\n  - metric: m\n    metric_regex: m.*\n", true},
+		{"no-metric", "rules:\n  - aggregation: sum\n", true},
+		{"without-and-by", "rules:\n  - metric: m\n    aggregate_without_labels: [a]\n    aggregate_by_labels: [b]\n", true},
+		{"invalid-regex", "rules:\n  - metric_regex: '('\n", true},
+		{"invalid-aggregation", "rules:\n  - metric: m\n    aggregation: median\n", true},
+		{"relabel", "relabel:\n  - source_labels: [service]\n    action: drop\n  - target_label: env\n    replacement: prod\n", false},
+		{"relabel-invalid-action", "relabel:\n  - source_labels: [service]\n    action: labelmap\n", true},
+		{"relabel-keep-without-source", "relabel:\n  - action: keep\n", true},
+		{"relabel-replace-without-target", "relabel:\n  - source_labels: [service]\n", true},
+		{"relabel-replace-name", "relabel:\n  - target_label: __name__\n", true},
+		{"relabel-invalid-target", "relabel:\n  - target_label: service-name\n", true},
+		{"relabel-invalid-regex", "relabel:\n  - source_labels: [service]\n    regex: '('\n    action: keep\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(file, []byte(tt.config), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := readConfig(file)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("readConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAggregationRuleMatches(t *testing.T) {
+	rules := []aggregationRule{{Metric: "http_requests_total"}, {MetricRegex: "http_.*"}}
+	for i := range rules {
+		if err := rules[i].validate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		rule int
+		name string
+		want bool
+	}{
+		{0, "http_requests_total", true},
+		{0, "http_requests", false},
+		{1, "http_requests", true},
+		// the regex must match the whole name
+		{1, "grpc_http_requests", false},
+	}
+	for _, tt := range tests {
+		if got := rules[tt.rule].matches(tt.name); got != tt.want {
+			t.Errorf("rule %d matches(%q) = %v, want %v", tt.rule, tt.name, got, tt.want)
+		}
+	}
+}
+
+func Test_CollectorRules(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP component_cpu_usage component_cpu_usage
+# TYPE component_cpu_usage gauge
+component_cpu_usage{l1="v1",l2="v2"} 1 1735054883000
+component_cpu_usage{l1="v1",l2="v3"} 3 1735054883000
+component_cpu_usage{l1="v4",l2="v2"} 5 1735054883000
+# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{l1="v1",l2="v2"} 10 1735054883000
+component_received_events_total{l1="v1",l2="v3"} 20 1735054883000
+`)
+	}))
+	defer ts.Close()
+
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(file, []byte(`rules:
+  - metric_regex: component_cpu_.*
+    aggregate_by_labels: [l2]
+    aggregation: max
+`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := readConfig(file)
+	if err != nil {
+		t.Fatalf("readConfig() error = %v", err)
+	}
+
+	collector := &RemoteAggregator{
+		url:                    ts.URL,
+		aggregateWithOutLabels: []string{"l2"},
+		fileConfig:             newSharedConfig(cfg),
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	// families matching no rule fall back to the flags
+	want := `# HELP component_cpu_usage component_cpu_usage
+# TYPE component_cpu_usage gauge
+component_cpu_usage{l2="v2"} 5 1735054883000
+component_cpu_usage{l2="v3"} 3 1735054883000
+# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{l1="v1"} 30 1735054883000
+`
+	if diff := cmp.Diff(metricsToText(gathering), want); diff != "" {
+		t.Errorf("collector output mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_CollectorRulesInfoMetric(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP kube_pod_info kube_pod_info
+# TYPE kube_pod_info gauge
+kube_pod_info{namespace="ns1",pod="p1"} 1 1735054883000
+kube_pod_info{namespace="ns1",pod="p2"} 1 1735054883000
+kube_pod_info{namespace="ns2",pod="p3"} 1 1735054883000
+# HELP kube_pod_restarts kube_pod_restarts
+# TYPE kube_pod_restarts gauge
+kube_pod_restarts{namespace="ns1",pod="p1"} 2 1735054883000
+kube_pod_restarts{namespace="ns1",pod="p2"} 3 1735054883000
+`)
+	}))
+	defer ts.Close()
+
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(file, []byte(`rules:
+  - metric_regex: .*_info
+    aggregate_without_labels: [pod]
+    aggregation: present
+`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := readConfig(file)
+	if err != nil {
+		t.Fatalf("readConfig() error = %v", err)
+	}
+
+	collector := &RemoteAggregator{
+		url:                    ts.URL,
+		aggregateWithOutLabels: []string{"pod"},
+		fileConfig:             newSharedConfig(cfg),
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	// info metrics are 1 instead of the number of series
+	want := `# HELP kube_pod_info kube_pod_info
+# TYPE kube_pod_info gauge
+kube_pod_info{namespace="ns1"} 1 1735054883000
+kube_pod_info{namespace="ns2"} 1 1735054883000
+# HELP kube_pod_restarts kube_pod_restarts
+# TYPE kube_pod_restarts gauge
+kube_pod_restarts{namespace="ns1"} 5 1735054883000
+`
+	if diff := cmp.Diff(metricsToText(gathering), want); diff != "" {
+		t.Errorf("collector output mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestReloadHandler(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP component_cpu_usage component_cpu_usage
+# TYPE component_cpu_usage gauge
+component_cpu_usage{l1="v1",l2="v2"} 1 1735054883000
+component_cpu_usage{l1="v2",l2="v2"} 2 1735054883000
+`)
+	}))
+	defer ts.Close()
+
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig := func(content string) {
+		if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig("rules:\n  - metric: component_cpu_usage\n    aggregate_by_labels: [l2]\n")
+	cfg, err := readConfig(file)
+	if err != nil {
+		t.Fatalf("readConfig() error = %v", err)
+	}
+
+	fileConfig := newSharedConfig(cfg)
+	collector := &RemoteAggregator{
+		url:                    ts.URL,
+		aggregateWithOutLabels: []string{"l1"},
+		fileConfig:             fileConfig,
+	}
+	reload := reloadHandler(func() error {
+		cfg, err := readConfig(file)
+		if err != nil {
+			return err
+		}
+		fileConfig.Store(cfg)
+		return nil
+	})
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	tests := []struct {
+		name     string
+		config   string
+		wantCode int
+		want     string
+	}{
+		{
+			"reloaded",
+			"rules:\n  - metric: component_cpu_usage\n    aggregate_by_labels: [l2]\n    aggregation: max\n",
+			http.StatusOK,
+			`# HELP component_cpu_usage component_cpu_usage
+# TYPE component_cpu_usage gauge
+component_cpu_usage{l2="v2"} 2 1735054883000
+`,
+		},
+		{
+			// the previous config is kept
+			"invalid",
+			"rules:\n  - metric: component_cpu_usage\n    aggregation: median\n",
+			http.StatusInternalServerError,
+			`# HELP component_cpu_usage component_cpu_usage
+# TYPE component_cpu_usage gauge
+component_cpu_usage{l2="v2"} 2 1735054883000
+`,
+		},
+		{
+			"removed-rule",
+			"rules: []\n",
+			http.StatusOK,
+			`# HELP component_cpu_usage component_cpu_usage
+# TYPE component_cpu_usage gauge
+component_cpu_usage{l2="v2"} 3 1735054883000
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeConfig(tt.config)
+
+			rec := httptest.NewRecorder()
+			reload.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/-/reload", nil))
+			if rec.Code != tt.wantCode {
+				t.Errorf("status code = %d, want %d", rec.Code, tt.wantCode)
+			}
+
+			gathering, err := reg.Gather()
+			if err != nil {
+				t.Fatalf("reg.Gather() error = %v", err)
+			}
+			if diff := cmp.Diff(metricsToText(gathering), tt.want); diff != "" {
+				t.Errorf("collector output mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// counterResets keeps the last value of every counter series of the target
+// across scrapes and offsets the values of reset counters by their value
+// before the reset, so the aggregates of counters never decrease because one
+// of the aggregated series restarted. Scrapes are told apart by their scrape
+// time, so overlapping scrapes neither forget the series of each other nor
+// take the older values of each other for resets.
+type counterResets struct {
+	// scrapes serializes the scrapes of the target, so the values of
+	// overlapping scrapes are adjusted in the order they were fetched
+	scrapes sync.Mutex
+
+	mu     sync.Mutex
+	series map[string]*counterSeries
+}
+
+// counterSeries is the state of a counter series
+type counterSeries struct {
+	// last is the last scraped value
+	last float64
+	// offset is the sum of the values before all resets of the series
+	offset float64
+	// seen is the time of the latest scrape which saw the series
+	seen time.Time
+}
+
+func newCounterResets() *counterResets {
+	return &counterResets{series: make(map[string]*counterSeries)}
+}
+
+// adjust offsets the values of the counter series of the named family scraped
+// at scrapeTime by the values before their resets, in place. It returns the
+// number of series which were reset since the previous scrape. Series already
+// seen by the same or a later scrape, like duplicate series and the series of
+// an overlapping scrape which completed first, are only offset.
+func (c *counterResets) adjust(name string, metrics []*dto.Metric, scrapeTime time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var resets int
+	for _, metric := range metrics {
+		if metric.GetCounter() == nil {
+			continue
+		}
+		key, _ := aggregationKey(metric, nil)
+		key = name + "\xff" + key
+		value := metric.GetCounter().GetValue()
+
+		series, ok := c.series[key]
+		switch {
+		case !ok:
+			series = &counterSeries{}
+			c.series[key] = series
+		case !scrapeTime.After(series.seen):
+			metric.Counter.Value = proto.Float64(value + series.offset)
+			continue
+		case value < series.last:
+			series.offset += series.last
+			resets++
+		}
+		series.last = value
+		series.seen = scrapeTime
+		metric.Counter.Value = proto.Float64(value + series.offset)
+	}
+	return resets
+}
+
+// prune forgets the series seen by neither the scrape at scrapeTime nor a
+// later one. It must only be called after a complete scrape, as a partial
+// scrape would forget the series it didn't decode.
+func (c *counterResets) prune(scrapeTime time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, series := range c.series {
+		if series.seen.Before(scrapeTime) {
+			delete(c.series, key)
+		}
+	}
+}
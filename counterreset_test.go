@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestCounterResets(t *testing.T) {
+	counter := func(pod string, value float64) *dto.Metric {
+		return &dto.Metric{
+			Label:   []*dto.LabelPair{{Name: pointer("pod"), Value: pointer(pod)}},
+			Counter: &dto.Counter{Value: proto.Float64(value)},
+		}
+	}
+	values := func(metrics []*dto.Metric) []float64 {
+		var result []float64
+		for _, metric := range metrics {
+			result = append(result, metric.GetCounter().GetValue())
+		}
+		return result
+	}
+
+	c := newCounterResets()
+	scrapes := []struct {
+		metrics    []*dto.Metric
+		want       []float64
+		wantResets int
+	}{
+		{[]*dto.Metric{counter("p1", 10), counter("p2", 20)}, []float64{10, 20}, 0},
+		// p1 restarted
+		{[]*dto.Metric{counter("p1", 2), counter("p2", 25)}, []float64{12, 25}, 1},
+		// p1 restarted again, p2 is gone
+		{[]*dto.Metric{counter("p1", 1)}, []float64{13}, 1},
+		// p2 is back and starts over after being forgotten
+		{[]*dto.Metric{counter("p1", 3), counter("p2", 5)}, []float64{15, 5}, 0},
+	}
+	scrapeTime := time.Now()
+	for i, scrape := range scrapes {
+		scrapeTime = scrapeTime.Add(time.Second)
+		resets := c.adjust("component_received_events_total", scrape.metrics, scrapeTime)
+		c.prune(scrapeTime)
+		if diff := cmp.Diff(values(scrape.metrics), scrape.want); diff != "" {
+			t.Errorf("scrape %d values mismatch (-want +got):\n%s", i, diff)
+		}
+		if resets != scrape.wantResets {
+			t.Errorf("scrape %d resets = %d, want %d", i, resets, scrape.wantResets)
+		}
+	}
+}
+
+func TestCounterResetsDuplicates(t *testing.T) {
+	counter := func(value float64) *dto.Metric {
+		return &dto.Metric{
+			Label:   []*dto.LabelPair{{Name: pointer("pod"), Value: pointer("p1")}},
+			Counter: &dto.Counter{Value: proto.Float64(value)},
+		}
+	}
+
+	c := newCounterResets()
+	scrapeTime := time.Now()
+	c.adjust("component_received_events_total", []*dto.Metric{counter(10)}, scrapeTime)
+	c.prune(scrapeTime)
+
+	// a duplicate series with a lower value isn't a reset, nor is it on every
+	// further scrape
+	for range 2 {
+		scrapeTime = scrapeTime.Add(time.Second)
+		if resets := c.adjust("component_received_events_total", []*dto.Metric{counter(12), counter(11)}, scrapeTime); resets != 0 {
+			t.Errorf("resets = %d, want 0", resets)
+		}
+		c.prune(scrapeTime)
+	}
+}
+
+func TestCounterResetsOverlappingScrapes(t *testing.T) {
+	counter := func(pod string, value float64) *dto.Metric {
+		return &dto.Metric{
+			Label:   []*dto.LabelPair{{Name: pointer("pod"), Value: pointer(pod)}},
+			Counter: &dto.Counter{Value: proto.Float64(value)},
+		}
+	}
+
+	c := newCounterResets()
+	start := time.Now()
+	c.adjust("component_received_events_total", []*dto.Metric{counter("p1", 10), counter("p2", 20)}, start)
+	c.prune(start)
+
+	// the later scrape completes first, p1 restarted
+	earlier, later := start.Add(time.Second), start.Add(2*time.Second)
+	c.adjust("component_received_events_total", []*dto.Metric{counter("p1", 2), counter("p2", 22)}, later)
+	c.prune(later)
+
+	// the earlier scrape neither forgets the series of the later one nor
+	// counts its older values as resets
+	metrics := []*dto.Metric{counter("p1", 1), counter("p2", 21)}
+	if resets := c.adjust("component_received_events_total", metrics, earlier); resets != 0 {
+		t.Errorf("resets = %d, want 0", resets)
+	}
+	c.prune(earlier)
+	if got := len(c.series); got != 2 {
+		t.Errorf("series = %d, want 2", got)
+	}
+	if got := metrics[0].GetCounter().GetValue(); got != 11 {
+		t.Errorf("p1 value = %v, want 11", got)
+	}
+}
+
+func Test_CollectorHandleCounterResetsConcurrent(t *testing.T) {
+	log = slog.Default()
+
+	// every request returns a higher value
+	var value atomic.Int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{l1="v1",pod="p1"} %d 1735054883000
+`, value.Add(1))
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{
+		url:                    ts.URL,
+		aggregateWithOutLabels: []string{"pod"},
+		counterResets:          newCounterResets(),
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	before := testutil.ToFloat64(counterResetsTotal.WithLabelValues(ts.URL))
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 10 {
+				if _, err := reg.Gather(); err != nil {
+					t.Errorf("reg.Gather() error = %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := testutil.ToFloat64(counterResetsTotal.WithLabelValues(ts.URL)) - before; got != 0 {
+		t.Errorf("counter resets = %v, want 0", got)
+	}
+	if got := len(collector.counterResets.series); got != 1 {
+		t.Errorf("series = %d, want 1", got)
+	}
+}
+
+func Test_CollectorHandleCounterResets(t *testing.T) {
+	log = slog.Default()
+
+	var restarted atomic.Bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := 10
+		if restarted.Load() {
+			value = 1
+		}
+		fmt.Fprintf(w, `# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{l1="v1",pod="p1"} %d 1735054883000
+component_received_events_total{l1="v1",pod="p2"} 20 1735054883000
+`, value)
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{
+		url:                    ts.URL,
+		aggregateWithOutLabels: []string{"pod"},
+		counterResets:          newCounterResets(),
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	if _, err := reg.Gather(); err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+	restarted.Store(true)
+	before := testutil.ToFloat64(counterResetsTotal.WithLabelValues(ts.URL))
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	// p1 continues from its value before the restart
+	want := `# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{l1="v1"} 31 1735054883000
+`
+	if diff := cmp.Diff(metricsToText(gathering), want); diff != "" {
+		t.Errorf("collector output mismatch (-want +got):\n%s", diff)
+	}
+	if got := testutil.ToFloat64(counterResetsTotal.WithLabelValues(ts.URL)) - before; got != 1 {
+		t.Errorf("counter resets = %v, want 1", got)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// exemplar selections, which exemplar of the aggregated series is kept
+const (
+	exemplarFirst   = "first"
+	exemplarLast    = "last"
+	exemplarHighest = "highest-value"
+)
+
+var exemplarSelections = []string{exemplarFirst, exemplarLast, exemplarHighest}
+
+// counterExemplarBound is the key of counter exemplars in aggregate.exemplars
+var counterExemplarBound = math.Inf(+1)
+
+// addExemplar adds the exemplar of a counter, or of the histogram bucket with
+// the upper bound, to the aggregate. It is a no-op for nil exemplars.
+func (a *aggregate) addExemplar(upperBound float64, exemplar *dto.Exemplar) {
+	if exemplar == nil {
+		return
+	}
+	if a.exemplars == nil {
+		a.exemplars = make(map[float64][]*dto.Exemplar)
+	}
+	a.exemplars[upperBound] = append(a.exemplars[upperBound], exemplar)
+}
+
+// selectExemplars returns one exemplar of the aggregated series per bucket,
+// or a single one for counters, selected according to selection
+func (a *aggregate) selectExemplars(selection string) []prometheus.Exemplar {
+	var result []prometheus.Exemplar
+	for _, upperBound := range slices.Sorted(maps.Keys(a.exemplars)) {
+		exemplars := a.exemplars[upperBound]
+
+		selected := exemplars[0]
+		switch selection {
+		case exemplarLast:
+			selected = exemplars[len(exemplars)-1]
+		case exemplarHighest:
+			for _, exemplar := range exemplars[1:] {
+				if exemplar.GetValue() > selected.GetValue() {
+					selected = exemplar
+				}
+			}
+		}
+
+		exemplar := prometheus.Exemplar{
+			Value:  selected.GetValue(),
+			Labels: make(prometheus.Labels, len(selected.Label)),
+		}
+		for _, label := range selected.Label {
+			exemplar.Labels[label.GetName()] = label.GetValue()
+		}
+		if selected.Timestamp != nil {
+			exemplar.Timestamp = selected.Timestamp.AsTime()
+		}
+		result = append(result, exemplar)
+	}
+	return result
+}
+
+// withExemplars attaches the selected exemplars of a to the counter or
+// histogram metric, or returns metric if a has none
+func withExemplars(metric prometheus.Metric, a *aggregate, selection string) (prometheus.Metric, error) {
+	if selection == "" || len(a.exemplars) == 0 {
+		return metric, nil
+	}
+	result, err := prometheus.NewMetricWithExemplars(metric, a.selectExemplars(selection)...)
+	if err != nil {
+		return nil, fmt.Errorf("error adding exemplars %w", err)
+	}
+	return result, nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func exemplar(traceID string, value float64) *dto.Exemplar {
+	return &dto.Exemplar{
+		Label:     []*dto.LabelPair{{Name: pointer("trace_id"), Value: pointer(traceID)}},
+		Value:     proto.Float64(value),
+		Timestamp: timestamppb.New(time.Unix(100, 0)),
+	}
+}
+
+func TestSelectExemplars(t *testing.T) {
+	a := &aggregate{}
+	a.addExemplar(counterExemplarBound, exemplar("t1", 1))
+	a.addExemplar(counterExemplarBound, nil)
+	a.addExemplar(counterExemplarBound, exemplar("t2", 3))
+	a.addExemplar(counterExemplarBound, exemplar("t3", 2))
+
+	tests := []struct {
+		selection string
+		want      string
+	}{
+		{exemplarFirst, "t1"},
+		{exemplarLast, "t3"},
+		{exemplarHighest, "t2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.selection, func(t *testing.T) {
+			got := a.selectExemplars(tt.selection)
+			if len(got) != 1 {
+				t.Fatalf("selectExemplars() = %v, want a single exemplar", got)
+			}
+			if got[0].Labels["trace_id"] != tt.want {
+				t.Errorf("selectExemplars() trace_id = %q, want %q", got[0].Labels["trace_id"], tt.want)
+			}
+			if !got[0].Timestamp.Equal(time.Unix(100, 0)) {
+				t.Errorf("selectExemplars() timestamp = %v, want %v", got[0].Timestamp, time.Unix(100, 0))
+			}
+		})
+	}
+}
+
+func TestAggregateMetricsExemplars(t *testing.T) {
+	metrics := []*dto.Metric{
+		{Counter: &dto.Counter{Value: proto.Float64(1), Exemplar: exemplar("t1", 1)}},
+		{Histogram: &dto.Histogram{
+			SampleCount: proto.Uint64(1),
+			SampleSum:   proto.Float64(1),
+			Bucket:      []*dto.Bucket{{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(1), Exemplar: exemplar("t2", 1)}},
+		}},
+	}
+
+	// the exemplars are only accumulated if they're exported
+	for _, exemplars := range []bool{false, true} {
+		_, aggregated := aggregateMetrics(metrics, nil, exemplars)
+		if got := len(aggregated[""].exemplars) > 0; got != exemplars {
+			t.Errorf("aggregateMetrics(exemplars=%v) kept exemplars = %v", exemplars, got)
+		}
+	}
+}
+
+func Test_CollectorExemplars(t *testing.T) {
+	log = slog.Default()
+
+	families := []*dto.MetricFamily{
+		{
+			Name: proto.String("component_received_events_total"),
+			Help: proto.String("component_received_events_total"),
+			Type: dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Label:   []*dto.LabelPair{{Name: pointer("l1"), Value: pointer("v1")}, {Name: pointer("l2"), Value: pointer("v2")}},
+					Counter: &dto.Counter{Value: proto.Float64(10), Exemplar: exemplar("t1", 1)},
+				},
+				{
+					Label:   []*dto.LabelPair{{Name: pointer("l1"), Value: pointer("v1")}, {Name: pointer("l2"), Value: pointer("v3")}},
+					Counter: &dto.Counter{Value: proto.Float64(20), Exemplar: exemplar("t2", 1)},
+				},
+			},
+		},
+		{
+			Name: proto.String("component_request_duration_seconds"),
+			Help: proto.String("component_request_duration_seconds"),
+			Type: dto.MetricType_HISTOGRAM.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Label: []*dto.LabelPair{{Name: pointer("l1"), Value: pointer("v1")}, {Name: pointer("l2"), Value: pointer("v2")}},
+					Histogram: &dto.Histogram{SampleCount: proto.Uint64(2), SampleSum: proto.Float64(2), Bucket: []*dto.Bucket{
+						{UpperBound: proto.Float64(0.5), CumulativeCount: proto.Uint64(1), Exemplar: exemplar("t3", 0.2)},
+						{UpperBound: proto.Float64(math.Inf(+1)), CumulativeCount: proto.Uint64(2), Exemplar: exemplar("t4", 1.8)},
+					}},
+				},
+				{
+					Label: []*dto.LabelPair{{Name: pointer("l1"), Value: pointer("v1")}, {Name: pointer("l2"), Value: pointer("v3")}},
+					Histogram: &dto.Histogram{SampleCount: proto.Uint64(1), SampleSum: proto.Float64(0.4), Bucket: []*dto.Bucket{
+						{UpperBound: proto.Float64(0.5), CumulativeCount: proto.Uint64(1), Exemplar: exemplar("t5", 0.4)},
+						{UpperBound: proto.Float64(math.Inf(+1)), CumulativeCount: proto.Uint64(1)},
+					}},
+				},
+			},
+		},
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		format := expfmt.NewFormat(expfmt.TypeProtoDelim)
+		w.Header().Set("Content-Type", string(format))
+		encoder := expfmt.NewEncoder(w, format)
+		for _, family := range families {
+			if err := encoder.Encode(family); err != nil {
+				t.Error(err)
+			}
+		}
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		selection string
+		want      map[string][]string
+	}{
+		{"", map[string][]string{}},
+		{exemplarFirst, map[string][]string{
+			"component_received_events_total":    {"t1"},
+			"component_request_duration_seconds": {"t3", "t4"},
+		}},
+		{exemplarHighest, map[string][]string{
+			"component_received_events_total":    {"t1"},
+			"component_request_duration_seconds": {"t5", "t4"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.selection, func(t *testing.T) {
+			collector := &RemoteAggregator{
+				url:                    ts.URL,
+				aggregateWithOutLabels: []string{"l2"},
+				exemplarSelection:      tt.selection,
+			}
+
+			reg := prometheus.NewPedanticRegistry()
+			reg.MustRegister(collector)
+
+			gathering, err := reg.Gather()
+			if err != nil {
+				t.Fatalf("reg.Gather() error = %v", err)
+			}
+
+			// the trace ids of the exemplars by family
+			got := make(map[string][]string)
+			for _, mf := range gathering {
+				for _, metric := range mf.Metric {
+					exemplars := []*dto.Exemplar{metric.GetCounter().GetExemplar()}
+					for _, bucket := range metric.GetHistogram().GetBucket() {
+						exemplars = append(exemplars, bucket.GetExemplar())
+					}
+					for _, exemplar := range exemplars {
+						if exemplar != nil {
+							got[mf.GetName()] = append(got[mf.GetName()], exemplar.Label[0].GetValue())
+						}
+					}
+				}
+			}
+			if diff := cmp.Diff(got, tt.want); diff != "" {
+				t.Errorf("exemplars mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
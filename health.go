@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// readiness tracks whether any target has been scraped successfully, it is
+// shared by all collectors
+type readiness struct {
+	ready atomic.Bool
+}
+
+// scraped marks a successful scrape, safe to call on a nil readiness
+func (r *readiness) scraped() {
+	if r != nil {
+		r.ready.Store(true)
+	}
+}
+
+// handler returns 200 once a target has been scraped successfully and 503
+// until then
+func (r *readiness) handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if !r.ready.Load() {
+			http.Error(w, "no successful scrape yet", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+}
+
+// healthHandler always returns 200 while the server is running
+func healthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("ok"))
+	})
+}
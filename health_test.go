@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestReadiness(t *testing.T) {
+	log = slog.Default()
+
+	var fail atomic.Bool
+	fail.Store(true)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, `# TYPE component_received_events_total counter
+component_received_events_total{l1="v1"} 10
+`)
+	}))
+	defer ts.Close()
+
+	ready := &readiness{}
+	collector := &RemoteAggregator{url: ts.URL, readiness: ready}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	for _, tt := range []struct {
+		fail bool
+		want int
+	}{
+		{true, http.StatusServiceUnavailable},
+		{false, http.StatusOK},
+		// once ready a failing scrape does not make it unready again
+		{true, http.StatusOK},
+	} {
+		fail.Store(tt.fail)
+		if _, err := reg.Gather(); err != nil {
+			t.Fatalf("reg.Gather() error = %v", err)
+		}
+
+		rec := httptest.NewRecorder()
+		ready.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		if rec.Code != tt.want {
+			t.Errorf("readiness with failing target %v = %d, want %d", tt.fail, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestReadinessRequireIncludeMatch(t *testing.T) {
+	log = slog.Default()
+
+	var name atomic.Value
+	name.Store("component_sent_events_total")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `# TYPE %[1]s counter
+%[1]s{l1="v1"} 10
+`, name.Load())
+	}))
+	defer ts.Close()
+
+	ready := &readiness{}
+	collector := &RemoteAggregator{
+		url:                 ts.URL,
+		includeMetrics:      []string{"component_received_events_total"},
+		requireIncludeMatch: true,
+		readiness:           ready,
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	for _, tt := range []struct {
+		name string
+		want int
+	}{
+		{"component_sent_events_total", http.StatusServiceUnavailable},
+		{"component_received_events_total", http.StatusOK},
+	} {
+		name.Store(tt.name)
+		if _, err := reg.Gather(); err != nil {
+			t.Fatalf("reg.Gather() error = %v", err)
+		}
+
+		rec := httptest.NewRecorder()
+		ready.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		if rec.Code != tt.want {
+			t.Errorf("readiness scraping %s = %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+}
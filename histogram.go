@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// observation is a histogram of the series values observed into one key
+type observation struct {
+	count   uint64
+	sum     float64
+	buckets map[float64]uint64
+}
+
+// observedHistograms returns, under the given name, one histogram per
+// aggregation key into which the values of all series of the key are observed.
+// The sums are rounded with roundScale.
+func observedHistograms(metricFamily *dto.MetricFamily, name string, aggregateWithOutLabels []string, buckets []float64, roundScale float64) []prometheus.Metric {
+	aggregatedLabels, observations := observeMetrics(metricFamily.Metric, aggregateWithOutLabels, buckets)
+
+	var result []prometheus.Metric
+	for _, key := range slices.Sorted(maps.Keys(observations)) {
+		o := observations[key]
+
+		desc := prometheus.NewDesc(name, metricFamily.GetHelp(), nil, aggregatedLabels[key])
+		promMetric, err := prometheus.NewConstHistogram(desc, o.count, roundValue(o.sum, roundScale), o.buckets)
+		if err != nil {
+			log.Error("error creating Prometheus metric", "err", err)
+			continue
+		}
+
+		result = append(result, promMetric)
+	}
+	return result
+}
+
+// observeMetrics returns label pairs and observations map on same key, the
+// bucket counts of the observations are cumulative
+func observeMetrics(metrics []*dto.Metric, aggregateWithOutLabels []string, buckets []float64) (map[string]map[string]string, map[string]*observation) {
+	observations := make(map[string]*observation)
+	aggregatedLabels := make(map[string]map[string]string)
+
+	for _, metric := range metrics {
+		value, ok := sampleValue(metric)
+		if !ok {
+			continue
+		}
+
+		key, filteredLabels := aggregationKey(metric, aggregateWithOutLabels)
+
+		o, ok := observations[key]
+		if !ok {
+			o = &observation{buckets: make(map[float64]uint64, len(buckets))}
+			for _, bucket := range buckets {
+				o.buckets[bucket] = 0
+			}
+			observations[key] = o
+			aggregatedLabels[key] = filteredLabels
+		}
+
+		o.count++
+		o.sum += value
+		for _, bucket := range buckets {
+			if value <= bucket {
+				o.buckets[bucket]++
+			}
+		}
+	}
+	return aggregatedLabels, observations
+}
+
+// sampleValue returns the value of a gauge, counter or untyped metric
+func sampleValue(metric *dto.Metric) (float64, bool) {
+	switch {
+	case metric.GetGauge() != nil:
+		return metric.GetGauge().GetValue(), true
+	case metric.GetCounter() != nil:
+		return metric.GetCounter().GetValue(), true
+	case metric.GetUntyped() != nil:
+		return metric.GetUntyped().GetValue(), true
+	}
+	return 0, false
+}
+
+// parseHistogramBuckets parses metric=bucket entries into the sorted bucket
+// upper bounds per metric. Entries without a metric add buckets to the
+// previous entry's metric, so a comma separated metric=bucket,bucket,... list
+// split into single entries is parsed as a whole.
+func parseHistogramBuckets(entries []string) (map[string][]float64, error) {
+	histogramBuckets := make(map[string][]float64)
+
+	var metric string
+	for _, entry := range entries {
+		bound := entry
+		if name, value, ok := strings.Cut(entry, "="); ok {
+			metric, bound = name, value
+		}
+		if metric == "" {
+			return nil, fmt.Errorf("missing metric name for bucket %q", entry)
+		}
+
+		value, err := strconv.ParseFloat(strings.TrimSpace(bound), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket %q of metric %q", bound, metric)
+		}
+		histogramBuckets[metric] = append(histogramBuckets[metric], value)
+	}
+
+	for metric, buckets := range histogramBuckets {
+		slices.Sort(buckets)
+		histogramBuckets[metric] = slices.Compact(buckets)
+	}
+	return histogramBuckets, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func Test_CollectorObserveIntoHistogram(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP queue_depth queue_depth
+# TYPE queue_depth gauge
+queue_depth{env="prod",queue="a"} 0 1735054883000
+queue_depth{env="prod",queue="b"} 3 1735054883000
+queue_depth{env="prod",queue="c"} 7 1735054883000
+queue_depth{env="prod",queue="d"} 12 1735054883000
+queue_depth{env="prod",queue="e"} 250 1735054883000
+queue_depth{env="dev",queue="a"} 4 1735054883000
+# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{env="prod",queue="a"} 10 1735054883000
+component_received_events_total{env="prod",queue="b"} 20 1735054883000
+`)
+	}))
+	defer ts.Close()
+
+	// comma separated flag values are split into single entries
+	observeIntoHistogram, err := parseHistogramBuckets([]string{"queue_depth=10", "1", "5", "100"})
+	if err != nil {
+		t.Fatalf("parseHistogramBuckets() error = %v", err)
+	}
+
+	collector := &RemoteAggregator{
+		url:                    ts.URL,
+		aggregateWithOutLabels: []string{"queue"},
+		observeIntoHistogram:   observeIntoHistogram,
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	want := `# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{env="prod"} 30 1735054883000
+# HELP queue_depth queue_depth
+# TYPE queue_depth histogram
+queue_depth_bucket{env="dev",le="1"} 0 1735054883000
+queue_depth_bucket{env="dev",le="5"} 1 1735054883000
+queue_depth_bucket{env="dev",le="10"} 1 1735054883000
+queue_depth_bucket{env="dev",le="100"} 1 1735054883000
+queue_depth_bucket{env="dev",le="+Inf"} 1 1735054883000
+queue_depth_sum{env="dev"} 4 1735054883000
+queue_depth_count{env="dev"} 1 1735054883000
+queue_depth_bucket{env="prod",le="1"} 1 1735054883000
+queue_depth_bucket{env="prod",le="5"} 2 1735054883000
+queue_depth_bucket{env="prod",le="10"} 3 1735054883000
+queue_depth_bucket{env="prod",le="100"} 4 1735054883000
+queue_depth_bucket{env="prod",le="+Inf"} 5 1735054883000
+queue_depth_sum{env="prod"} 272 1735054883000
+queue_depth_count{env="prod"} 5 1735054883000
+`
+	if diff := cmp.Diff(metricsToText(gathering), want); diff != "" {
+		t.Errorf("collector output mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseHistogramBuckets(t *testing.T) {
+	got, err := parseHistogramBuckets([]string{"m1=5", "1", "m2=0.5", "m1=5", "2.5"})
+	if err != nil {
+		t.Fatalf("parseHistogramBuckets() error = %v", err)
+	}
+	want := map[string][]float64{
+		"m1": {1, 2.5, 5},
+		"m2": {0.5},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("parseHistogramBuckets() mismatch (-want +got):\n%s", diff)
+	}
+
+	for _, entries := range [][]string{{"1"}, {"m1=a"}} {
+		if _, err := parseHistogramBuckets(entries); err == nil {
+			t.Errorf("parseHistogramBuckets(%v) expected error", entries)
+		}
+	}
+}
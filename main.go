@@ -1,22 +1,46 @@
 package main
 
 import (
+	"cmp"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"maps"
+	"math"
+	"net"
 	"net/http"
 	"os"
+	"runtime"
 	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
 	"github.com/urfave/cli/v3"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// set at build time with -ldflags "-X main.version=..."
+var (
+	version = "dev"
+	commit  = "unknown"
+	date    = "unknown"
 )
 
 var (
@@ -34,161 +58,2896 @@ var (
 		[]string{"remote"},
 	)
 
+	phaseDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "metrics_aggregation_phase_duration_seconds",
+		Help: "Duration of the phases of a collection: fetch until the response headers, decode including reading the response body and aggregate summed over all workers",
+	},
+		[]string{"remote", "phase"},
+	)
+
+	selfValidationErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "metrics_aggregation_self_validation_errors_total",
+		Help: "Number of problems found by validating the aggregated output",
+	},
+		[]string{"remote"},
+	)
+
+	dedupSeriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "metrics_aggregation_deduplicated_series_total",
+		Help: "Number of identical input series which were counted only once",
+	},
+		[]string{"remote"},
+	)
+
+	breakerOpen = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "metrics_aggregation_circuit_breaker_open",
+		Help: "Whether the circuit breaker of the remote is open and scrapes are paused",
+	},
+		[]string{"remote"},
+	)
+
+	scrapeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "aggregator_scrape_errors_total",
+		Help: "Number of failed scrapes of the remote by reason: request, dns, connection, timeout, status, size or decode",
+	},
+		[]string{"remote", "reason"},
+	)
+
+	partialScrapes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "aggregator_partial_scrapes_total",
+		Help: "Number of scrapes of the remote which failed decoding after some metric families were decoded, or failed on some of its paths, the decoded families are still exported",
+	},
+		[]string{"remote"},
+	)
+
+	decodeResults = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "aggregator_decode_results_total",
+		Help: "Number of decoded responses of the remote by result: eof if the response was decoded until its end, error if decoding failed",
+	},
+		[]string{"remote", "result"},
+	)
+
+	decodedFamilies = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "aggregator_decoded_families",
+		Help:    "Number of metric families decoded from a response of the remote, including those decoded before a decoding error",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+	},
+		[]string{"remote"},
+	)
+
+	duplicateSeries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "aggregator_duplicate_series_total",
+		Help: "Number of series of the remote skipped because another target already exported them with the same name and labels",
+	},
+		[]string{"remote"},
+	)
+
+	nameCollisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "aggregator_name_collisions_total",
+		Help: "Number of metric families skipped because their exported name collides with another exported family",
+	},
+		[]string{"remote"},
+	)
+
+	outputSeriesLimitExceeded = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aggregator_output_series_limit_exceeded",
+		Help: "Whether the last scrape of the remote exceeded the output series limit and only exported part of its series",
+	},
+		[]string{"remote"},
+	)
+
+	counterResetsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "aggregator_counter_resets_total",
+		Help: "Number of resets of scraped counter series detected by handling counter resets",
+	},
+		[]string{"remote"},
+	)
+
+	truncatedLabelValues = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "aggregator_truncated_label_values_total",
+		Help: "Number of label values truncated to the maximum label value length",
+	},
+		[]string{"remote"},
+	)
+
+	inputSeriesGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aggregator_input_series_total",
+		Help: "Number of series scraped from the remote by the last successful scrape",
+	},
+		[]string{"remote"},
+	)
+
+	outputSeriesGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aggregator_output_series_total",
+		Help: "Number of aggregated series exported for the remote by the last successful scrape",
+	},
+		[]string{"remote"},
+	)
+
+	targetUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aggregator_target_up",
+		Help: "Whether the last scrape of the remote succeeded",
+	},
+		[]string{"remote"},
+	)
+
+	lastScrapeSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aggregator_last_scrape_success_timestamp_seconds",
+		Help: "Unix time of the last successful scrape of the remote",
+	},
+		[]string{"remote"},
+	)
+
+	configHashGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "metrics_aggregator_config_hash",
+		Help: "Hash of the effective aggregation config, value is always 1",
+	},
+		[]string{"hash"},
+	)
+
+	buildInfo = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "metrics_aggregator_build_info",
+		Help: "Build information of the aggregator, value is always 1",
+		ConstLabels: prometheus.Labels{
+			"version":   version,
+			"commit":    commit,
+			"date":      date,
+			"goversion": runtime.Version(),
+		},
+	})
+
 	flags = []cli.Flag{
+		&cli.StringFlag{
+			Name:  "log-level",
+			Value: "info",
+			Usage: "The log level, one of debug, info, warn or error.",
+		},
+		&cli.StringFlag{
+			Name:  "log-format",
+			Value: "text",
+			Usage: "The log format, either text or json.",
+		},
 		&cli.StringFlag{
 			Name:  "metrics-bind-address",
 			Value: ":9090",
 			Usage: "The address the metric endpoint binds to.",
 		},
+		&cli.StringFlag{
+			Name:  "web-tls-cert",
+			Usage: "The file with the PEM encoded certificate the metrics and admin servers serve https with, requires --web-tls-key. If not set they serve plain http.",
+		},
+		&cli.StringFlag{
+			Name:  "web-tls-key",
+			Usage: "The file with the PEM encoded key of the metrics server certificate.",
+		},
+		&cli.StringFlag{
+			Name:  "web-auth-user",
+			Usage: "The basic auth username required by all endpoints, including the proxy, metadata, reload and pprof endpoints, requires --web-auth-password-file. The health and readiness probes are not protected. If not set no endpoint is protected.",
+		},
+		&cli.StringFlag{
+			Name:  "web-auth-password-file",
+			Usage: "The file with the basic auth password required by the endpoints, requires --web-auth-user. Surrounding whitespace is trimmed and the file is re-read every minute.",
+		},
+		&cli.StringFlag{
+			Name:  "web-client-ca",
+			Usage: "The file with the PEM encoded CA certificates which must have signed the client certificates of scrapers, requires --web-tls-cert. If not set client certificates are not required.",
+		},
 		&cli.StringFlag{
 			Name:  "metrics-path",
 			Value: "/metrics",
 			Usage: "The path under which to expose metrics.",
 		},
+		&cli.BoolFlag{
+			Name:  "enable-openmetrics",
+			Usage: "Serve the OpenMetrics format to scrapers asking for it, including the _created lines of counters, histograms and summaries with the earliest created timestamp of their aggregated series. OpenMetrics appends _total to counter names without it.",
+		},
+		&cli.BoolFlag{
+			Name:  "enable-response-compression",
+			Usage: "Compress the served metrics for scrapers accepting gzip or zstd encoded responses. Disable with --enable-response-compression=false.",
+			Value: true,
+		},
+		&cli.StringFlag{
+			Name:  "health-path",
+			Value: "/healthz",
+			Usage: "The path of the liveness endpoint, which always returns 200.",
+		},
+		&cli.StringFlag{
+			Name:  "ready-path",
+			Value: "/readyz",
+			Usage: "The path of the readiness endpoint, which returns 200 once a target has been scraped successfully.",
+		},
+		&cli.StringFlag{
+			Name:  "admin-bind-address",
+			Usage: "The address the admin endpoints (pprof, proxy) bind to, the health and readiness probes are served on it as well. If not set they are served on the metrics bind address.",
+		},
+		&cli.BoolFlag{
+			Name:  "enable-runtime-metrics",
+			Usage: "Expose the Go runtime (go_*) and process (process_*) metrics of the aggregator itself, prefixed with metrics_aggregator_ so they never collide with the families of the targets.",
+			Value: true,
+		},
+		&cli.BoolFlag{
+			Name:  "enable-pprof",
+			Usage: "Expose the net/http/pprof profiling endpoints under /debug/pprof/.",
+		},
+		&cli.StringFlag{
+			Name:  "proxy-path",
+			Usage: "The path under which to expose the unchanged metrics of the target. With multiple targets the target url is selected with the target query parameter. If not set the target's metrics are not proxied.",
+		},
+		&cli.StringFlag{
+			Name:  "metadata-path",
+			Usage: "The path under which to list the type and help of the metric families exported by the last collection as JSON, in the format of the Prometheus /api/v1/metadata endpoint. If not set the metadata is not exposed.",
+		},
+		&cli.StringFlag{
+			Name:  "remote-write-url",
+			Usage: "The Prometheus remote write endpoint the exported metrics are pushed to every --remote-write-interval, in addition to being served. Native histograms are only pushed with their classic buckets. If not set metrics are not pushed.",
+		},
+		&cli.DurationFlag{
+			Name:  "remote-write-interval",
+			Usage: "The interval at which the exported metrics are pushed to --remote-write-url.",
+			Value: time.Minute,
+		},
+		&cli.DurationFlag{
+			Name:  "remote-write-timeout",
+			Usage: "The maximum duration of a remote write request.",
+			Value: 30 * time.Second,
+		},
+		&cli.IntFlag{
+			Name:  "remote-write-retries",
+			Usage: "The number of times a remote write request failing with a connection error or a 5xx or 429 response is retried, waiting --scrape-retry-backoff before the first retry and twice as long before every further one.",
+			Value: 3,
+		},
+		&cli.StringFlag{
+			Name:  "otlp-endpoint",
+			Usage: "The OTLP/HTTP metrics endpoint url, e.g. http://collector:4318/v1/metrics, the exported metrics are pushed to every --otlp-interval, in addition to being served. Counters are pushed as cumulative sums, gauges and untyped metrics as gauges and native histograms as exponential histograms. If not set metrics are not pushed.",
+		},
+		&cli.DurationFlag{
+			Name:  "otlp-interval",
+			Usage: "The interval at which the exported metrics are pushed to --otlp-endpoint.",
+			Value: time.Minute,
+		},
+		&cli.DurationFlag{
+			Name:  "otlp-timeout",
+			Usage: "The maximum duration of an OTLP export, including its retries.",
+			Value: 30 * time.Second,
+		},
+		&cli.StringSliceFlag{
+			Name:  "target-url",
+			Usage: "The remote target metrics url to scrap metrics. Repeat the flag to scrape multiple targets, each target is aggregated separately so they must not export the same series after aggregation. Either this, --target or --targets-file is required.",
+		},
+		&cli.StringSliceFlag{
+			Name:  "target",
+			Usage: "A remote target as host:port, scraped on --target-metrics-path with --target-scheme, or as host:port/path to scrape it on its own path. Repeat the flag to scrape multiple targets, like --target-url.",
+		},
+		&cli.StringFlag{
+			Name:  "target-scheme",
+			Usage: "The scheme the targets of --target are scraped with, http or https.",
+			Value: "http",
+		},
+		&cli.StringFlag{
+			Name:  "target-metrics-path",
+			Usage: "The path the targets of --target without a path are scraped on.",
+			Value: "/metrics",
+		},
+		&cli.StringSliceFlag{
+			Name:  "target-extra-path",
+			Usage: "A further path scraped on every target, e.g. /metrics/extra, whose metric families are merged with the families of the target url before aggregation, like with --merge-duplicate-families. Repeat the flag to scrape multiple paths. A path failing to be scraped is skipped, the scrape only fails if all paths fail.",
+		},
+		&cli.StringFlag{
+			Name:  "target-label",
+			Usage: "The label set to the target url on every exported series, telling apart the series of several targets. It overrides a label of the same name like --add-labelValue. If not set the series of several targets must differ, series already exported by another target are skipped. Families exported by several targets with another help or type are only exported by the target collected first.",
+		},
+		&cli.StringFlag{
+			Name:  "targets-file",
+			Usage: "The file listing further target urls, one per line. Empty lines and lines starting with '#' are ignored. Targets are added and removed when the file is modified.",
+		},
+		&cli.DurationFlag{
+			Name:  "targets-file-refresh",
+			Usage: "The interval at which the targets file is checked for modifications.",
+			Value: 30 * time.Second,
+		},
+		&cli.StringSliceFlag{
+			Name:  "aggregate-without-label",
+			Usage: "The metrics will be aggregated over all label except listed labels. Labels will be removed from the result vector, while all other labels are preserved in the output. Either this or --aggregate-by-label is required.",
+		},
 		&cli.StringFlag{
-			Name:     "target-url",
-			Usage:    "The remote target metrics url to scrap metrics.",
-			Required: true,
+			Name:  "config-file",
+			Usage: "The YAML file with per metric aggregation rules, see the README for its format. Metric families matching no rule are aggregated according to the aggregation flags.",
+		},
+		&cli.BoolFlag{
+			Name:  "enable-reload",
+			Usage: "Re-read the config file on POST /-/reload, served on the admin address if set. Scrapes in progress finish with the previous config.",
+		},
+		&cli.StringSliceFlag{
+			Name:  "exempt-label-value",
+			Usage: "The list of label=value pairs of aggregated labels which are kept for series with the value, so those series aren't aggregated with the series of other values. Dropped labels are always removed.",
+		},
+		&cli.StringFlag{
+			Name:  "aggregation",
+			Usage: "The function aggregating the values of gauges and counters with the same labels: sum, avg, min, max, count or present, which is 1 for info metrics. Histograms and summaries are always summed.",
+			Value: aggregationSum,
+		},
+		&cli.StringSliceFlag{
+			Name:  "aggregate-by-label",
+			Usage: "The metrics will be aggregated over all labels except the listed labels and the labels set by --add-labelValue, which are the only labels preserved in the output. Can't be used together with --aggregate-without-label.",
+		},
+		&cli.StringSliceFlag{
+			Name:  "drop-label",
+			Usage: "The labels to remove from all exported metrics. Series are aggregated over dropped labels exactly like over --aggregate-without-label, but the labels are dropped in every aggregation output and config file rule and take precedence over --aggregate-by-label.",
+		},
+		&cli.StringSliceFlag{
+			Name:  "output-label-allowlist",
+			Usage: "The only labels exported besides the constant labels of --add-labelValue, any other label is aggregated over, so labels newly added by the target don't increase the cardinality of the output. All labels are exported if not set.",
+		},
+		&cli.StringFlag{
+			Name:  "bearer-token",
+			Usage: "The bearer token sent in the Authorization header of requests to the target.",
+		},
+		&cli.StringFlag{
+			Name:  "bearer-token-file",
+			Usage: "The file to read the bearer token from, it is re-read every minute to pick up rotated tokens. Takes precedence over --bearer-token.",
+		},
+		&cli.StringFlag{
+			Name:  "basic-auth-username",
+			Usage: "The username for HTTP basic auth of requests to the target. Basic auth sends the password in clear text, only use it with https targets.",
+		},
+		&cli.StringFlag{
+			Name:  "basic-auth-password",
+			Usage: "The password for HTTP basic auth of requests to the target.",
+		},
+		&cli.StringFlag{
+			Name:  "basic-auth-password-file",
+			Usage: "The file to read the basic auth password from, it is re-read every minute to pick up rotated passwords. Takes precedence over --basic-auth-password.",
+		},
+		&cli.StringFlag{
+			Name:  "user-agent",
+			Usage: "The User-Agent header of the requests to the target, metrics-aggregator/<version> if not set. A User-Agent set with --header takes precedence.",
+		},
+		&cli.StringFlag{
+			Name:  "scrape-format",
+			Usage: "Pin the format the target is scraped in, text or protobuf, requesting only that format and decoding the response in it whatever its content type. If not set the format is negotiated, preferring protobuf, and OpenMetrics responses are decoded without their exemplars and created timestamps.",
+		},
+		&cli.StringSliceFlag{
+			Name:  "header",
+			Usage: "A 'Name: value' header added to the requests to the target, e.g. 'X-Scope-OrgID: tenant'. Can be repeated, repeated names send all values. Values can't contain commas, repeat the header instead. The auth flags take precedence over an Authorization header.",
+		},
+		&cli.StringFlag{
+			Name:  "tls-ca-file",
+			Usage: "The file with the PEM encoded CA certificates to verify https targets with. If not set the system roots are used.",
+		},
+		&cli.StringFlag{
+			Name:  "tls-cert-file",
+			Usage: "The file with the PEM encoded client certificate presented to https targets, requires --tls-key-file.",
+		},
+		&cli.StringFlag{
+			Name:  "tls-key-file",
+			Usage: "The file with the PEM encoded key of the client certificate.",
+		},
+		&cli.BoolFlag{
+			Name:  "tls-insecure-skip-verify",
+			Usage: "Disables verification of the certificates of https targets.",
+		},
+		&cli.DurationFlag{
+			Name:  "dns-timeout",
+			Usage: "The maximum time to resolve the target's host name, separate from the rest of the scrape. 0 disables the timeout.",
+		},
+		&cli.StringFlag{
+			Name:  "dns-resolver",
+			Usage: "The host:port address of the DNS server used to resolve the target's host name. If not set the system resolver is used.",
+		},
+		&cli.StringFlag{
+			Name:  "proxy-url",
+			Usage: "The http, https or socks5 proxy url the target is scraped through. If not set the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables are used. https targets are tunneled through the proxy and verified with the TLS flags, which also verify an https proxy.",
+		},
+		&cli.IntFlag{
+			Name:  "max-idle-conns",
+			Usage: "The maximum number of idle connections kept open to the target between scrapes.",
+			Value: 10,
+		},
+		&cli.DurationFlag{
+			Name:  "idle-conn-timeout",
+			Usage: "How long an idle connection to the target is kept open before it is closed.",
+			Value: 90 * time.Second,
+		},
+		&cli.StringFlag{
+			Name:  "spiffe-socket",
+			Usage: "The address of the SPIFFE Workload API socket (e.g. unix:///run/spire/agent.sock). When set the target is scraped over mTLS using the X.509 SVID fetched and rotated from the Workload API.",
+		},
+		&cli.DurationFlag{
+			Name:  "scrape-interval",
+			Usage: "Scrape the target in the background at this interval and serve the metrics of the latest scrape, the first scrape completes before serving unless --skip-initial-scrape is set. 0 scrapes the target on every collection.",
+		},
+		&cli.BoolFlag{
+			Name:  "skip-initial-scrape",
+			Usage: "Serve without waiting for the first background scrape of the targets, which export no metrics until it completed. Requires --scrape-interval.",
+		},
+		&cli.BoolFlag{
+			Name:  "fail-on-initial-scrape-error",
+			Usage: "Exit at startup if the first background scrape of a target fails. By default the failure is logged and the target exports no metrics until its next scrape. Requires --scrape-interval.",
+		},
+		&cli.FloatFlag{
+			Name:  "scrape-jitter",
+			Usage: "The fraction of --scrape-interval each background scrape is randomly delayed or advanced by, so replicas don't scrape the target at the same time. Must be in [0, 1).",
+			Value: 0.1,
+		},
+		&cli.IntFlag{
+			Name:  "workers",
+			Usage: "The number of metric families of a scrape processed concurrently.",
+			Value: 1,
+		},
+		&cli.IntFlag{
+			Name:  "scrape-retries",
+			Usage: "The number of times a scrape failing with a connection error or a 5xx response is retried within the scrape timeout. 0 disables retries.",
+		},
+		&cli.DurationFlag{
+			Name:  "scrape-retry-backoff",
+			Usage: "The duration to wait before the first retry of a failed scrape, doubled on every further retry.",
+			Value: 500 * time.Millisecond,
+		},
+		&cli.DurationFlag{
+			Name:  "scrape-timeout",
+			Usage: "The maximum duration of a scrape of the target, including reading the response body. The aggregated metrics are buffered until the response is decoded, so a scrape timing out while decoding exports no metrics. 0 disables the timeout and streams the metrics as they're aggregated, lowering the peak memory of large scrapes.",
+			Value: 10 * time.Second,
+		},
+		&cli.DurationFlag{
+			Name:  "body-read-timeout",
+			Usage: "The maximum time to wait for more data while reading the target's response body, the scrape is aborted if no progress is made within it. 0 disables the timeout.",
+		},
+		&cli.IntFlag{
+			Name:  "max-scrape-size",
+			Usage: "The maximum number of bytes of the target's decompressed response body, decoding a larger body is aborted and counted as a scrape error with reason size. The families decoded before are still exported. 0 disables the limit.",
+		},
+		&cli.StringSliceFlag{
+			Name:  "aggregation-output",
+			Usage: "The list of suffix=label pairs. Every metric will additionally be aggregated over all labels listed for a suffix and exported with the suffix appended to its name. Repeat the pair to list multiple labels for a suffix.",
+		},
+		&cli.BoolFlag{
+			Name:  "native-histograms-as-classic",
+			Usage: "Export aggregated native histograms as classic histograms with a bucket for every native bucket, for storage not supporting native histograms. Native histograms are always merged at the lowest resolution of the aggregated histograms.",
+		},
+		&cli.BoolFlag{
+			Name:  "merge-duplicate-families",
+			Usage: "Merge the series of metric families scraped more than once under the same name, keeping the help of the first one, instead of skipping the later families. Families of another type are still skipped. Works with text responses repeating the help and type lines of a family too.",
+		},
+		&cli.BoolFlag{
+			Name:  "series-count",
+			Usage: "Additionally export the number of series aggregated into every series of a metric as the <metric>_aggregated_series_count gauge, with the labels of the aggregated series.",
+		},
+		&cli.IntFlag{
+			Name:  "breaker-threshold",
+			Usage: "The number of consecutive failed scrapes after which the target is not scraped for the breaker cooldown. 0 disables the circuit breaker.",
+		},
+		&cli.DurationFlag{
+			Name:  "breaker-cooldown",
+			Value: time.Minute,
+			Usage: "The time scrapes are paused once the circuit breaker opened, after it a single probe scrape decides if scraping resumes.",
 		},
 		&cli.StringSliceFlag{
-			Name:     "aggregate-without-label",
-			Usage:    "The metrics will be aggregated over all label except listed labels. Labels will be removed from the result vector, while all other labels are preserved in the output.",
-			Required: true,
+			Name:  "observe-into-histogram",
+			Usage: "The list of metric=bucket,bucket,... entries. Instead of summing, the value of every series of the metric is observed into a histogram with the listed bucket upper bounds, which is exported under the metric name.",
+		},
+		&cli.StringSliceFlag{
+			Name:  "weight-by",
+			Usage: "The list of metric=weight pairs. The gauge metric is aggregated into the average of its series weighted by the value of the series of the weight metric, e.g. a request counter, with the same scraped labels. Series without a weight series are skipped. Both metrics are referred to by their name after --rename-metric.",
 		},
 		&cli.StringSliceFlag{
 			Name:  "include-metric",
 			Usage: "The name of the scrapped metrics which will be aggregated and exported. if its not set all metrics will be exported from target.",
 		},
+		&cli.BoolFlag{
+			Name:  "require-include-metric-match",
+			Usage: "Keep the readiness endpoint failing while the scrapes match none of the --include-metric names, instead of exporting nothing once ready. Included names missing from the first scrape are always logged.",
+		},
+		&cli.StringSliceFlag{
+			Name:  "exclude-metric",
+			Usage: "The name of the scrapped metrics which will not be aggregated and exported. Applied after --include-metric, so a metric listed in both is not exported.",
+		},
+		&cli.StringSliceFlag{
+			Name:  "passthrough-metric",
+			Usage: "The name of the scrapped metrics exported unchanged, without filtering, relabeling, aggregating or prefixing their series, e.g. up or scrape_duration_seconds. Only the labels of --add-labelValue and --target-label are set. Takes precedence over all other flags.",
+		},
+		&cli.BoolFlag{
+			Name:  "keep-original",
+			Usage: "Also export the series of the aggregated metrics unaggregated, as filtered by name, type, label value and value, but before any other stage of the aggregation except setting the labels of --add-labelValue and --target-label. Requires --original-prefix or --add-prefix so their names differ from the aggregated metrics, colliding metrics are skipped.",
+		},
 		&cli.StringFlag{
+			Name:  "original-prefix",
+			Usage: "The prefix of the names of the unaggregated metrics exported by --keep-original.",
+		},
+		&cli.StringSliceFlag{
+			Name:  "include-type",
+			Usage: "The type of the scrapped metrics (counter, gauge, summary, histogram or untyped) which will be aggregated and exported. if its not set metrics of all types will be exported from target.",
+		},
+		&cli.StringSliceFlag{
+			Name:  "force-type",
+			Usage: "The list of metric=type pairs of gauge, counter or untyped metrics to export as the given type: counter, gauge or untyped. Metrics are filtered by their scraped type.",
+		},
+		&cli.StringSliceFlag{
+			Name:  "keep-if",
+			Usage: "The list of label=value pairs, only series matching all of them are aggregated. A missing label matches an empty value.",
+		},
+		&cli.StringSliceFlag{
+			Name:  "drop-if",
+			Usage: "The list of label=value pairs, series matching all of them are not aggregated. A missing label matches an empty value.",
+		},
+		&cli.BoolFlag{
+			Name:  "skip-nan",
+			Usage: "Skip gauge, counter and untyped series whose value is NaN instead of aggregating them, which makes the whole aggregate NaN.",
+		},
+		&cli.BoolFlag{
+			Name:  "skip-inf",
+			Usage: "Skip gauge, counter and untyped series whose value is +Inf or -Inf instead of aggregating them.",
+		},
+		&cli.BoolFlag{
+			Name:  "dedup-input",
+			Usage: "Count series of a scrapped metric which are identical in labels and value only once.",
+		},
+		&cli.StringSliceFlag{
+			Name:  "rename-label",
+			Usage: "The list of old=new pairs of labels to rename before aggregation, all other label flags refer to the new name. A renamed label replaces an existing label of the new name.",
+		},
+		&cli.StringSliceFlag{
+			Name:  "label-value-map",
+			Usage: "The list of label=file pairs. The file lists raw=canonical value pairs, one per line, and the label's values will be replaced with their canonical value before aggregation. A '*=canonical' line sets the value for unmapped values, otherwise they are kept as is.",
+		},
+		&cli.BoolFlag{
+			Name:  "handle-counter-resets",
+			Usage: "Keep the last value of every scraped counter series and add it to the series' values after it resets, so aggregated counters don't decrease when one of the aggregated series restarts. Series are forgotten once a scrape doesn't return them, and duplicate series are only counted once. Overlapping collections of a target scrape it one after another.",
+		},
+		&cli.IntFlag{
+			Name:  "max-output-series",
+			Usage: "The maximum number of series exported by a scrape of the target, further series are not exported and aggregator_output_series_limit_exceeded is set. Which series are exported depends on the scrape order, or is random with several workers. 0 disables the limit.",
+		},
+		&cli.StringSliceFlag{
+			Name:  "normalize-label-values",
+			Usage: "The labels whose values are compared case-insensitively before aggregation, so series whose values only differ in case are aggregated together. The value first seen in the scrape is exported.",
+		},
+		&cli.IntFlag{
+			Name:  "round-decimals",
+			Usage: "The number of decimal places the aggregated values, and sums of histograms and summaries, are rounded to, hiding floating point errors of the aggregation. Must be at most 15, a negative value disables rounding.",
+			Value: -1,
+		},
+		&cli.BoolFlag{
+			Name:  "drop-zero",
+			Usage: "Drop aggregated gauge series whose value is exactly 0 instead of exporting them, after rounding. Counters are only dropped with --drop-zero-counters.",
+		},
+		&cli.BoolFlag{
+			Name:  "drop-zero-counters",
+			Usage: "Also drop aggregated counter series whose value is exactly 0, requires --drop-zero.",
+		},
+		&cli.IntFlag{
+			Name:  "max-label-value-length",
+			Usage: "The maximum number of characters of label values, longer values are truncated and end with an ellipsis before aggregation. 0 disables truncation.",
+		},
+		&cli.StringSliceFlag{
+			Name:  "rename-metric",
+			Usage: "The list of old=new pairs of metric families to rename before filtering, all other flags and the config file refer to the new name. Families renamed to the same name, or to the name of a scraped family, are merged. The family scraped under the new name, or else the one whose name sorts first, sets the help and type, families of another type are skipped.",
+		},
+		&cli.StringSliceFlag{
 			Name:  "add-prefix",
-			Usage: "The prefix which will be added to all exported metrics name.",
+			Usage: "The prefix which will be added to all exported metrics name. Repeat the flag with metric=prefix entries to set the prefix of single metrics, the plain prefix applies to all other metrics.",
 		},
 		&cli.StringSliceFlag{
 			Name:  "add-labelValue",
 			Usage: "The list of key=value pairs which will be added to all exported metrics.",
 		},
+		&cli.BoolFlag{
+			Name:  "self-validate",
+			Usage: "Validate the aggregated output of every collection by rendering and decoding it again, problems are logged and counted.",
+		},
+		&cli.BoolFlag{
+			Name:  "stamp-scrape-time",
+			Usage: "Use the aggregator's own scrape time as the timestamp of all exported samples instead of the timestamps exposed by the target.",
+		},
+		&cli.BoolFlag{
+			Name:  "honor-timestamps",
+			Usage: "Export every aggregated sample with the timestamp of the series aggregated into it, selected by --honor-timestamps-aggregation. By default all samples of a family get the timestamp of its first series. Can't be used together with --stamp-scrape-time.",
+		},
+		&cli.StringFlag{
+			Name:  "honor-timestamps-aggregation",
+			Usage: "The timestamp of the series used with --honor-timestamps: min or max.",
+			Value: aggregationMax,
+		},
+		&cli.StringFlag{
+			Name:  "exemplar",
+			Usage: "Keep an exemplar of the series aggregated into each counter and histogram bucket: first, last or highest-value. Exemplars are dropped if not set. They are only served in the OpenMetrics and protobuf formats.",
+		},
 	}
 )
 
+// scrapeAcceptHeader prefers the protobuf format, which is the only one
+// carrying native histograms, over the text format. OpenMetrics isn't
+// requested since its exemplars and created timestamps are dropped when
+// decoding it.
+const scrapeAcceptHeader = "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.7,text/plain;version=0.0.4;q=0.3"
+
+// scrapeFormats are the formats scrapes can be pinned to by their name,
+// overriding content negotiation
+var scrapeFormats = map[string]expfmt.Format{
+	"text":     expfmt.NewFormat(expfmt.TypeTextPlain),
+	"protobuf": expfmt.NewFormat(expfmt.TypeProtoDelim),
+}
+
+var (
+	errBodyReadTimeout = errors.New("no progress reading response body within body read timeout")
+	errUnauthorized    = errors.New("target rejected the credentials")
+	errScrapeTooLarge  = errors.New("response body exceeds the max scrape size")
+	errBreakerOpen     = errors.New("circuit breaker open")
+	errTargetStopped   = errors.New("target removed")
+)
+
+// aggregation functions applied to the values of gauges and counters,
+// histograms and summaries are always summed
+const (
+	aggregationSum   = "sum"
+	aggregationAvg   = "avg"
+	aggregationMin   = "min"
+	aggregationMax   = "max"
+	aggregationCount = "count"
+	// aggregationPresent is 1 for every key with at least one series, for
+	// info metrics whose value is always 1 and only carries labels
+	aggregationPresent = "present"
+)
+
+var aggregationFunctions = []string{aggregationSum, aggregationAvg, aggregationMin, aggregationMax, aggregationCount, aggregationPresent}
+
+// aggregationOutput is an additional aggregation of every metric family
+// exported under the family name with the suffix appended
+type aggregationOutput struct {
+	suffix                 string
+	aggregateWithOutLabels []string
+}
+
 type RemoteAggregator struct {
-	url                    string
-	includeMetrics         []string
+	url     string
+	client  *http.Client
+	auth    *requestAuth
+	headers http.Header
+	// extraPaths are the further paths scraped on the host of url, merged
+	// with the families of url
+	extraPaths []string
+	// userAgent is sent with the requests, metrics-aggregator/<version> if
+	// not set
+	userAgent string
+	// scrapeFormat is the format requested and decoded regardless of the
+	// response content type, negotiated if not set
+	scrapeFormat       expfmt.Format
+	scrapeTimeout      time.Duration
+	scrapeRetries      int
+	scrapeRetryBackoff time.Duration
+	workers            int
+	bodyReadTimeout    time.Duration
+	maxScrapeSize      int64
+	breaker            *circuitBreaker
+	includeMetrics     []string
+	excludeMetrics     []string
+	// passthroughMetrics are the names of the families exported unchanged
+	passthroughMetrics []string
+	// keepOriginal exports the filtered series unaggregated alongside the
+	// aggregated series, under their name prefixed with originalPrefix
+	keepOriginal           bool
+	originalPrefix         string
+	includeTypes           []dto.MetricType
+	keepIf                 []labelMatcher
+	dropIf                 []labelMatcher
+	skipNaN                bool
+	skipInf                bool
 	aggregateWithOutLabels []string
+	aggregateByLabels      []string
+	dropLabels             []string
+	// outputLabelAllowlist are the only labels exported besides the constant
+	// labels, all other labels are aggregated over. All labels are exported
+	// if empty.
+	outputLabelAllowlist []string
+	exemptLabelValues    []labelMatcher
+	aggregation          string
+	renameLabels         map[string]string
+	// forceTypes are the types families are exported as by their name
+	forceTypes map[string]dto.MetricType
+	// renameMetrics are the new names of families by their scraped name
+	renameMetrics  map[string]string
+	labelValueMaps map[string]map[string]string
+	// normalizeLabels are the labels whose values are aggregated
+	// case-insensitively
+	normalizeLabels      []string
+	aggregationOutputs   []aggregationOutput
+	observeIntoHistogram map[string][]float64
+	// weightBy are the names of the families weighting the average of gauge
+	// families by their name
+	weightBy map[string]string
+	// roundScale is 10 to the power of the decimal places aggregated values
+	// are rounded to, 0 disables rounding
+	roundScale float64
+	// dropZero drops aggregated gauges with a value of 0, and counters too
+	// with dropZeroCounters
+	dropZero         bool
+	dropZeroCounters bool
+	// maxLabelValueLength is the number of characters label values are
+	// truncated to, 0 disables truncation
+	maxLabelValueLength int
+	// maxOutputSeries is the number of series exported by a scrape, 0 for
+	// no limit
+	maxOutputSeries int
+	// counterResets offsets the values of reset counters, nil if counter
+	// resets aren't handled
+	counterResets *counterResets
+	// fileConfig holds the rules of the config file, shared by the
+	// collectors of all targets and replaced on reload
+	fileConfig *atomic.Pointer[config]
 
 	addPrefix string
-	addLabels map[string]string
+	// metricPrefixes are the prefixes of single metrics by their scraped name,
+	// replacing addPrefix
+	metricPrefixes map[string]string
+	addLabels      map[string]string
+
+	stampScrapeTime bool
+	honorTimestamps string
+	// exemplarSelection selects the exemplar kept by aggregated counters and
+	// histograms, exemplars are dropped if not set
+	exemplarSelection string
+	selfValidate      bool
+	dedupInput        bool
+	// resultSeries keeps the series of the exported families in the scrape
+	// result, which otherwise only has their metadata
+	resultSeries bool
+	// seriesCount exports the number of series aggregated into every series
+	// as an additional gauge family
+	seriesCount bool
+	// mergeDuplicates merges families scraped more than once under the same
+	// name instead of skipping the later ones
+	mergeDuplicates bool
+	// nativeAsClassic exports aggregated native histograms as classic
+	// histograms
+	nativeAsClassic bool
+
+	// cache holds the metrics of the latest background scrape, nil if the
+	// target is scraped on every collection
+	cache *metricsCache
+	// readiness is marked on every successful scrape
+	readiness *readiness
+
+	// requireIncludeMatch only marks the readiness on scrapes matching any of
+	// includeMetrics
+	requireIncludeMatch bool
+	// includeMatched is whether the latest scrape matched any of
+	// includeMetrics, and includeMetricsChecked is set once the included
+	// metrics were checked against the families of the first scrape
+	includeMatched        atomic.Bool
+	includeMetricsChecked atomic.Bool
+
+	// aggregateLabelsChecked is set once the configured aggregation labels
+	// were checked against the labels of the first successful scrape
+	aggregateLabelsChecked atomic.Bool
+
+	mu         sync.Mutex
+	lastResult []*dto.MetricFamily
+
+	// ctx is done once the target is removed, canceling its scrapes, and is
+	// the background context if nil
+	ctx context.Context
+	// stopped is set once the target is removed, the collections in progress
+	// are tracked by collections so its metrics are deleted after them
+	stopMu      sync.Mutex
+	stopped     bool
+	collections sync.WaitGroup
 }
 
 func (ra *RemoteAggregator) Describe(ch chan<- *prometheus.Desc) {
 	// No static descriptions, metrics are dynamic.
 }
 
+// Collect sends the metrics of the latest background scrape if background
+// scraping is enabled, or scrapes the target otherwise
 func (ra *RemoteAggregator) Collect(ch chan<- prometheus.Metric) {
-	defer updateRunTime(ra.url, time.Now())
-
-	resp, err := http.Get(ra.url)
-	if err != nil {
-		log.Error("error fetching metrics", "err", err)
+	if ra.cache != nil {
+		ra.collectCache(ch)
 		return
 	}
-	defer resp.Body.Close()
+	ra.collect(ra.context(), ch, false)
+}
 
-	if resp.StatusCode != http.StatusOK {
-		log.Error("unexpected status code", "code", resp.StatusCode)
-		return
+// context returns the context of the target
+func (ra *RemoteAggregator) context() context.Context {
+	if ra.ctx == nil {
+		return context.Background()
 	}
+	return ra.ctx
+}
 
-	ra.decodeAndSend(resp.Body, ch)
+// stop stops the collections of a removed target, returning once the
+// collections in progress completed
+func (ra *RemoteAggregator) stop() {
+	ra.stopMu.Lock()
+	ra.stopped = true
+	ra.stopMu.Unlock()
+	ra.collections.Wait()
 }
 
-func (ra *RemoteAggregator) decodeAndSend(reader io.Reader, ch chan<- prometheus.Metric) {
-	decoder := expfmt.NewDecoder(reader, expfmt.NewFormat(expfmt.TypeTextPlain))
-	var metricFamily dto.MetricFamily
+// collect scrapes the target and sends the aggregated metrics to ch, unless
+// the target was stopped. The scrape is canceled once ctx is done. It returns
+// the error of the scrape, which is already logged. buffered is passed to
+// scrape.
+func (ra *RemoteAggregator) collect(ctx context.Context, ch chan<- prometheus.Metric, buffered bool) error {
+	ra.stopMu.Lock()
+	if ra.stopped {
+		ra.stopMu.Unlock()
+		return errTargetStopped
+	}
+	ra.collections.Add(1)
+	ra.stopMu.Unlock()
+	defer ra.collections.Done()
 
-	for {
-		err := decoder.Decode(&metricFamily)
+	scrapeTime := time.Now()
+	defer updateRunTime(ra.url, scrapeTime)
+
+	var result []*dto.MetricFamily
+	defer func() { ra.setLastResult(result) }()
+
+	if !ra.breaker.allow(scrapeTime) {
+		log.Debug("circuit breaker open, skipping scrape", "remote", ra.url)
+		targetUp.WithLabelValues(ra.url).Set(0)
+		return errBreakerOpen
+	}
+
+	if ra.counterResets != nil {
+		ra.counterResets.scrapes.Lock()
+		defer ra.counterResets.scrapes.Unlock()
+	}
+	result, err := ra.scrape(ctx, scrapeTime, ch, buffered)
+	targetUp.WithLabelValues(ra.url).Set(boolToFloat(err == nil))
+	if err != nil {
+		scrapeErrors.WithLabelValues(ra.url, scrapeErrorReason(err)).Inc()
+	} else {
+		lastScrapeSuccess.WithLabelValues(ra.url).SetToCurrentTime()
+		if !ra.requireIncludeMatch || ra.includeMatched.Load() {
+			ra.readiness.scraped()
+		}
+	}
+	if ra.breaker != nil {
+		ra.breaker.record(err == nil, time.Now())
+		breakerOpen.WithLabelValues(ra.url).Set(boolToFloat(ra.breaker.isOpen()))
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		log.Error("scrape timed out", "remote", ra.url, "timeout", ra.scrapeTimeout, "err", err)
+	} else if errors.Is(err, errUnauthorized) {
+		log.Error("unauthorized to scrape target, check the credentials", "remote", ra.url)
+	} else if err != nil {
+		log.Error("error collecting metrics", "remote", ra.url, "err", err)
+	}
+
+	if ra.selfValidate {
+		for _, err := range validateExposition(result) {
+			log.Error("self validation failed", "remote", ra.url, "err", err)
+			selfValidationErrors.WithLabelValues(ra.url).Inc()
+		}
+	}
+	return err
+}
+
+// scrape fetches the metrics from the target and sends the aggregated metrics
+// to ch. It returns the exported metric families, which might be partial if
+// an error occurred while decoding. No metrics are sent if the scrape timeout
+// passes while decoding, unless buffered is set as the caller buffers the
+// metrics sent to ch and discards them then, so they aren't buffered twice.
+func (ra *RemoteAggregator) scrape(ctx context.Context, scrapeTime time.Time, ch chan<- prometheus.Metric, buffered bool) ([]*dto.MetricFamily, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if ra.scrapeTimeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, ra.scrapeTimeout)
+		defer cancelTimeout()
+	}
+
+	var decoder expfmt.Decoder
+	var paths *pathsDecoder
+	fetchStart := time.Now()
+	if len(ra.extraPaths) == 0 {
+		body, format, closeBody, err := ra.open(ctx, ra.url)
+		phaseDuration.WithLabelValues(ra.url, "fetch").Observe(time.Since(fetchStart).Seconds())
+		if err != nil {
+			return nil, err
+		}
+		defer closeBody()
+		decoder = ra.newDecoder(body, format)
+	} else {
+		paths = ra.openPaths(ctx)
+		phaseDuration.WithLabelValues(ra.url, "fetch").Observe(time.Since(fetchStart).Seconds())
+		defer paths.close()
+		decoder = paths
+	}
+
+	if ra.scrapeTimeout == 0 || buffered {
+		result, err := ra.decodeAndSend(ctx, decoder, scrapeTime, ch)
+		if err != nil {
+			return result, &scrapeError{"decode", err}
+		}
+		return result, paths.err()
+	}
+
+	// the metrics are buffered until decoding completed, so a scrape whose
+	// deadline passes while decoding sends no metrics
+	var result []*dto.MetricFamily
+	var err error
+	metrics := bufferMetrics(func(buffer chan<- prometheus.Metric) {
+		result, err = ra.decodeAndSend(ctx, decoder, scrapeTime, buffer)
+	})
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil, &scrapeError{"decode", err}
+	}
+	for _, metric := range metrics {
+		ch <- metric
+	}
+	if err != nil {
+		return result, &scrapeError{"decode", err}
+	}
+	return result, paths.err()
+}
+
+// open fetches url and returns its decompressed response body in its format,
+// and the function closing it. Reading the body stalling for longer than the
+// body read timeout aborts the request.
+func (ra *RemoteAggregator) open(ctx context.Context, url string) (io.Reader, expfmt.Format, func(), error) {
+	ctx, cancel := context.WithCancel(ctx)
+	closers := []func(){cancel}
+	closeAll := func() {
+		for _, close := range slices.Backward(closers) {
+			close()
+		}
+	}
+
+	resp, err := ra.fetch(ctx, url)
+	if err != nil {
+		closeAll()
+		return nil, "", nil, err
+	}
+	closers = append(closers, func() { resp.Body.Close() })
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		closeAll()
+		return nil, "", nil, &scrapeError{"status", errUnauthorized}
+	}
+	if resp.StatusCode != http.StatusOK {
+		closeAll()
+		return nil, "", nil, &scrapeError{"status", fmt.Errorf("unexpected status code %d", resp.StatusCode)}
+	}
+
+	var body io.Reader = resp.Body
+	if ra.bodyReadTimeout > 0 {
+		reader := newProgressReader(resp.Body, ra.bodyReadTimeout, cancel)
+		closers = append(closers, reader.stop)
+		body = reader
+	}
+
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		reader, err := gzip.NewReader(body)
+		if err != nil {
+			closeAll()
+			return nil, "", nil, &scrapeError{"decode", fmt.Errorf("error decompressing response %w", err)}
+		}
+		closers = append(closers, func() { reader.Close() })
+		body = reader
+	}
+	// the decompressed size is limited, which is what the decoding holds
+	if ra.maxScrapeSize > 0 {
+		body = &sizeLimitReader{reader: body, limit: ra.maxScrapeSize}
+	}
+
+	format := responseFormat(resp.Header)
+	if ra.scrapeFormat != "" {
+		format = ra.scrapeFormat
+	}
+	return body, format, closeAll, nil
+}
+
+// fetch requests the metrics of url, retrying connection errors and 5xx
+// responses up to scrapeRetries times with exponential backoff as long as ctx
+// is not done
+func (ra *RemoteAggregator) fetch(ctx context.Context, url string) (*http.Response, error) {
+	backoff := ra.scrapeRetryBackoff
+	for attempt := 1; ; attempt++ {
+		resp, err := ra.fetchOnce(ctx, url)
+
+		var se *scrapeError
+		retry := errors.As(err, &se) && se.reason == "connection" && ctx.Err() == nil ||
+			err == nil && resp.StatusCode >= http.StatusInternalServerError
+		if !retry || attempt > ra.scrapeRetries {
+			return resp, err
+		}
+		if err == nil {
+			resp.Body.Close()
+			err = fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		}
+
+		log.Debug("retrying scrape", "remote", ra.url, "url", url, "attempt", attempt, "backoff", backoff, "err", err)
+		select {
+		case <-ctx.Done():
+			return nil, &scrapeError{"connection", fmt.Errorf("error fetching metrics %w", ctx.Err())}
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// fetchOnce requests the metrics of url once
+func (ra *RemoteAggregator) fetchOnce(ctx context.Context, url string) (*http.Response, error) {
+	req, err := ra.newRequest(ctx, url)
+	if err != nil {
+		return nil, &scrapeError{"request", fmt.Errorf("error creating request %w", err)}
+	}
+	accept := scrapeAcceptHeader
+	if ra.scrapeFormat != "" {
+		accept = string(ra.scrapeFormat)
+	}
+	req.Header.Set("Accept", accept)
+	// setting the header disables the transparent decompression of the
+	// transport, so responses are decompressed by scrape
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	resp, err := ra.httpClient().Do(req)
+	if err != nil {
+		return nil, &scrapeError{"connection", fmt.Errorf("error fetching metrics %w", err)}
+	}
+	return resp, nil
+}
+
+// scrapeError is an error of a scrape with the reason it failed
+type scrapeError struct {
+	reason string
+	err    error
+}
+
+func (e *scrapeError) Error() string { return e.err.Error() }
+
+func (e *scrapeError) Unwrap() error { return e.err }
+
+// scrapeErrorReason returns the reason a scrape failed with err, timeouts
+// and host name resolution failures have their own reason wherever they
+// occurred
+func scrapeErrorReason(err error) string {
+	var dnsErr *net.DNSError
+	var se *scrapeError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, errBodyReadTimeout):
+		return "timeout"
+	case errors.Is(err, errScrapeTooLarge):
+		return "size"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.As(err, &se):
+		return se.reason
+	}
+	return "unknown"
+}
+
+// progressReader aborts reading by calling cancel when no data has been read
+// within timeout
+type progressReader struct {
+	reader  io.Reader
+	timeout time.Duration
+	timer   *time.Timer
+	expired atomic.Bool
+}
+
+func newProgressReader(reader io.Reader, timeout time.Duration, cancel context.CancelFunc) *progressReader {
+	pr := &progressReader{reader: reader, timeout: timeout}
+	pr.timer = time.AfterFunc(timeout, func() {
+		pr.expired.Store(true)
+		cancel()
+	})
+	return pr
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.reader.Read(p)
+	if pr.expired.Load() {
+		return n, errBodyReadTimeout
+	}
+	if n > 0 {
+		pr.timer.Reset(pr.timeout)
+	}
+	return n, err
+}
+
+func (pr *progressReader) stop() {
+	pr.timer.Stop()
+}
+
+// sizeLimitReader fails with errScrapeTooLarge once more than limit bytes are
+// read, unlike io.LimitReader which would silently truncate the body
+type sizeLimitReader struct {
+	reader io.Reader
+	limit  int64
+	read   int64
+}
+
+func (r *sizeLimitReader) Read(p []byte) (int, error) {
+	if r.read > r.limit {
+		return 0, fmt.Errorf("%w of %d bytes", errScrapeTooLarge, r.limit)
+	}
+	// reading a byte more than the limit tells a body of exactly limit bytes
+	// from a larger one
+	if remaining := r.limit - r.read + 1; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := r.reader.Read(p)
+	r.read += int64(n)
+	if r.read > r.limit {
+		return n - 1, fmt.Errorf("%w of %d bytes", errScrapeTooLarge, r.limit)
+	}
+	return n, err
+}
+
+// newRequest returns a new request to scrape url of the target
+func (ra *RemoteAggregator) newRequest(ctx context.Context, url string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range ra.headers {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	// a User-Agent header takes precedence
+	if req.Header.Get("User-Agent") == "" {
+		userAgent := ra.userAgent
+		if userAgent == "" {
+			userAgent = "metrics-aggregator/" + version
+		}
+		req.Header.Set("User-Agent", userAgent)
+	}
+	if err := ra.auth.apply(req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// httpClient returns the client used to scrape the target
+func (ra *RemoteAggregator) httpClient() *http.Client {
+	if ra.client != nil {
+		return ra.client
+	}
+	return http.DefaultClient
+}
+
+// LastResult returns a copy of the metric families exported by the most
+// recent collection.
+func (ra *RemoteAggregator) LastResult() []*dto.MetricFamily {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	result := make([]*dto.MetricFamily, 0, len(ra.lastResult))
+	for _, mf := range ra.lastResult {
+		result = append(result, proto.Clone(mf).(*dto.MetricFamily))
+	}
+	return result
+}
+
+func (ra *RemoteAggregator) setLastResult(result []*dto.MetricFamily) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	ra.lastResult = result
+}
+
+// decodeAndSend decodes all metric families from decoder and sends the
+// aggregated metrics to ch. It returns the exported metric families,
+// families decoded before a decoding error are still exported unless the
+// deadline of ctx passed.
+func (ra *RemoteAggregator) decodeAndSend(ctx context.Context, decoder expfmt.Decoder, scrapeTime time.Time, ch chan<- prometheus.Metric) ([]*dto.MetricFamily, error) {
+	// the config is loaded once so a reload never applies to part of a scrape
+	state := &scrapeState{
+		config:          ra.loadConfig(),
+		exported:        make(map[string]bool),
+		labels:          make(map[string]bool),
+		weights:         make(map[string]map[string]float64),
+		maxOutputSeries: ra.maxOutputSeries,
+	}
+	weightFamilies := make(map[string]bool, len(ra.weightBy))
+	for _, name := range ra.weightBy {
+		weightFamilies[name] = true
+	}
+
+	// families are processed by up to workers goroutines, each into its own
+	// slot so the result keeps the order of the scraped families
+	var wg sync.WaitGroup
+	workers := make(chan struct{}, max(ra.workers, 1))
+	var slots []*[]*dto.MetricFamily
+	var inputSeries int
+	// the time spent decoding and aggregating, which are interleaved
+	var decodeDuration time.Duration
+	var aggregateDuration atomic.Int64
+	process := func(metricFamily *dto.MetricFamily) {
+		slot := new([]*dto.MetricFamily)
+		slots = append(slots, slot)
+		workers <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			*slot = ra.processAndSend(metricFamily, scrapeTime, state, ch)
+			aggregateDuration.Add(int64(time.Since(start)))
+			<-workers
+		}()
+	}
+	results := func() []*dto.MetricFamily {
+		wg.Wait()
+		phaseDuration.WithLabelValues(ra.url, "decode").Observe(decodeDuration.Seconds())
+		phaseDuration.WithLabelValues(ra.url, "aggregate").Observe(time.Duration(aggregateDuration.Load()).Seconds())
+		var result []*dto.MetricFamily
+		for _, slot := range slots {
+			result = append(result, *slot...)
+		}
+		return result
+	}
+
+	// renamed families are merged by their new name and processed once all
+	// families are decoded, as are all families if duplicates are merged and
+	// weighted families, which need the weight families
+	var renamed, decoded, weighted []*dto.MetricFamily
+	var families int
+	// the names of the scraped families after renaming
+	scrapedNames := make(map[string]bool)
+	for {
+		metricFamily := &dto.MetricFamily{}
+		start := time.Now()
+		err := decoder.Decode(metricFamily)
+		decodeDuration += time.Since(start)
 		if err == io.EOF {
+			decodeResults.WithLabelValues(ra.url, "eof").Inc()
+			decodedFamilies.WithLabelValues(ra.url).Observe(float64(families))
 			break
 		}
-		if err != nil {
-			log.Error("error decoding metric family", "err", err)
-			break
+		if err != nil {
+			decodeResults.WithLabelValues(ra.url, "error").Inc()
+			decodedFamilies.WithLabelValues(ra.url).Observe(float64(families))
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				// the scrape is aborted, the families sent so far are
+				// discarded by scrape
+				results()
+				return nil, fmt.Errorf("scrape deadline exceeded while decoding %w", ctx.Err())
+			}
+			// the families decoded before the error are still exported, but
+			// the scrape is flagged as partial
+			for _, metricFamily := range ra.mergeDuplicateFamilies(decoded) {
+				process(metricFamily)
+			}
+			for _, metricFamily := range ra.mergeRenamed(renamed) {
+				process(metricFamily)
+			}
+			for _, metricFamily := range weighted {
+				process(metricFamily)
+			}
+			result := results()
+			if families > 0 {
+				partialScrapes.WithLabelValues(ra.url).Inc()
+				log.Warn("decoding failed midway, exporting the partial scrape", "remote", ra.url, "families", families, "err", err)
+			}
+			return result, fmt.Errorf("error decoding metric family %w", err)
+		}
+
+		families++
+		inputSeries += len(metricFamily.Metric)
+		// the weighted and weight families are referred to by their new name
+		// like in processAndSend
+		name := metricFamily.GetName()
+		newName, isRenamed := ra.renamedName(name)
+		if isRenamed {
+			name = newName
+		}
+		scrapedNames[name] = true
+		if weightFamilies[name] {
+			// the weights of the families renamed to the same name are merged
+			if weights, ok := state.weights[name]; ok {
+				maps.Copy(weights, familyWeights(metricFamily))
+			} else {
+				state.weights[name] = familyWeights(metricFamily)
+			}
+		}
+		if isRenamed {
+			renamed = append(renamed, metricFamily)
+			continue
+		}
+		// families scraped on several paths are merged
+		if ra.mergeDuplicates || len(ra.extraPaths) > 0 {
+			decoded = append(decoded, metricFamily)
+			continue
+		}
+		if _, ok := ra.weightBy[name]; ok {
+			weighted = append(weighted, metricFamily)
+			continue
+		}
+		process(metricFamily)
+	}
+	for _, metricFamily := range ra.mergeDuplicateFamilies(decoded) {
+		process(metricFamily)
+	}
+	for _, metricFamily := range ra.mergeRenamed(renamed) {
+		process(metricFamily)
+	}
+	for _, metricFamily := range weighted {
+		process(metricFamily)
+	}
+	result := results()
+	if ra.counterResets != nil {
+		ra.counterResets.prune(scrapeTime)
+	}
+
+	inputSeriesGauge.WithLabelValues(ra.url).Set(float64(inputSeries))
+	outputSeriesGauge.WithLabelValues(ra.url).Set(float64(state.sentSeries()))
+	outputSeriesLimitExceeded.WithLabelValues(ra.url).Set(boolToFloat(state.limitExceeded()))
+	if state.limitExceeded() {
+		log.Error("output series limit exceeded, the remaining series were not exported", "remote", ra.url, "limit", ra.maxOutputSeries, "series", state.outputSeries)
+	}
+
+	// an empty scrape would report all included metrics and labels as missing
+	if len(ra.includeMetrics) > 0 && families > 0 {
+		ra.checkIncludeMetrics(scrapedNames)
+	}
+	if len(state.labels) > 0 && ra.aggregateLabelsChecked.CompareAndSwap(false, true) {
+		ra.checkAggregateLabels(state.config, state.labels)
+	}
+	return result, nil
+}
+
+// renamedName returns the new name of the named family and whether it may be
+// merged with renamed families, which are the renamed families and the ones
+// named like the new name of another family
+func (ra *RemoteAggregator) renamedName(name string) (string, bool) {
+	if newName, ok := ra.renameMetrics[name]; ok {
+		return newName, true
+	}
+	for _, newName := range ra.renameMetrics {
+		if newName == name {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// mergeRenamed renames the families and merges the series of the families
+// with the same new name. As the decoding order isn't stable, the merged
+// family takes the help and type of the family scraped under the new name, or
+// else of the family whose scraped name sorts first. Families of another type
+// are skipped.
+func (ra *RemoteAggregator) mergeRenamed(families []*dto.MetricFamily) []*dto.MetricFamily {
+	type renamedFamily struct {
+		*dto.MetricFamily
+		name string
+	}
+	var sorted []renamedFamily
+	for _, mf := range families {
+		name, _ := ra.renamedName(mf.GetName())
+		sorted = append(sorted, renamedFamily{mf, name})
+	}
+	slices.SortFunc(sorted, func(a, b renamedFamily) int {
+		return cmp.Or(
+			strings.Compare(a.name, b.name),
+			// false sorts first
+			cmp.Compare(boolToFloat(a.GetName() != a.name), boolToFloat(b.GetName() != b.name)),
+			strings.Compare(a.GetName(), b.GetName()),
+		)
+	})
+
+	var merged []*dto.MetricFamily
+	for _, mf := range sorted {
+		if len(merged) == 0 || merged[len(merged)-1].GetName() != mf.name {
+			mf.Name = proto.String(mf.name)
+			merged = append(merged, mf.MetricFamily)
+			continue
+		}
+
+		if last := merged[len(merged)-1]; last.GetType() != mf.GetType() {
+			log.Error("skipping metric renamed to a metric of another type", "remote", ra.url, "metric", mf.GetName(), "name", mf.name, "type", mf.GetType(), "renamed_type", last.GetType())
+			nameCollisions.WithLabelValues(ra.url).Inc()
+		} else {
+			last.Metric = append(last.Metric, mf.Metric...)
+		}
+	}
+	return merged
+}
+
+// mergeDuplicateFamilies merges the series of families with the same name into
+// the first of them, keeping its help. Families of another type than the first
+// one are skipped.
+func (ra *RemoteAggregator) mergeDuplicateFamilies(families []*dto.MetricFamily) []*dto.MetricFamily {
+	var merged []*dto.MetricFamily
+	byName := make(map[string]*dto.MetricFamily)
+	for _, mf := range families {
+		first, ok := byName[mf.GetName()]
+		if !ok {
+			byName[mf.GetName()] = mf
+			merged = append(merged, mf)
+			continue
+		}
+
+		if first.GetType() != mf.GetType() {
+			log.Error("skipping duplicate metric of another type", "remote", ra.url, "metric", mf.GetName(), "type", mf.GetType(), "first_type", first.GetType())
+			nameCollisions.WithLabelValues(ra.url).Inc()
+			continue
+		}
+		if len(ra.extraPaths) == 0 {
+			log.Warn("merging duplicate metric", "remote", ra.url, "metric", mf.GetName(), "help", mf.GetHelp(), "first_help", first.GetHelp())
+		}
+		first.Metric = append(first.Metric, mf.Metric...)
+	}
+	return merged
+}
+
+// scrapeState is the state shared by the families of a scrape, safe for
+// concurrent use
+type scrapeState struct {
+	// config is the config file of the scrape
+	config *config
+	// weights are the values of the series of the weight families by the
+	// scraped family name and the series labels, complete once all families
+	// are decoded
+	weights map[string]map[string]float64
+
+	mu sync.Mutex
+	// exported are the names of the exported families, to skip families
+	// colliding with one
+	exported map[string]bool
+	// labels are the names of all labels of the aggregated series
+	labels map[string]bool
+	// maxOutputSeries is the number of series sent by the scrape, 0 for no
+	// limit
+	maxOutputSeries int
+	outputSeries    int
+}
+
+// export marks name as exported, it returns false if name is already exported
+func (s *scrapeState) export(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.exported[name] {
+		return false
+	}
+	s.exported[name] = true
+	return true
+}
+
+// send counts a series to be sent, it returns false if the series exceeds the
+// output series limit and must not be sent
+func (s *scrapeState) send() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.outputSeries++
+	return s.maxOutputSeries == 0 || s.outputSeries <= s.maxOutputSeries
+}
+
+// sentSeries returns the number of series sent, up to the output series limit
+func (s *scrapeState) sentSeries() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.maxOutputSeries > 0 {
+		return min(s.outputSeries, s.maxOutputSeries)
+	}
+	return s.outputSeries
+}
+
+// limitExceeded returns whether more series than the output series limit were
+// to be sent
+func (s *scrapeState) limitExceeded() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.maxOutputSeries > 0 && s.outputSeries > s.maxOutputSeries
+}
+
+// seeLabels records the label names of the metrics
+func (s *scrapeState) seeLabels(metrics []*dto.Metric) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, metric := range metrics {
+		for _, label := range metric.Label {
+			s.labels[label.GetName()] = true
+		}
+	}
+}
+
+// checkIncludeMetrics records whether any included metric is in scraped, the
+// names of the scraped families, and warns about the included metrics missing
+// from the first scrape
+func (ra *RemoteAggregator) checkIncludeMetrics(scraped map[string]bool) {
+	var missing []string
+	for _, name := range ra.includeMetrics {
+		if !scraped[name] {
+			missing = append(missing, name)
+		}
+	}
+	ra.includeMatched.Store(len(missing) < len(ra.includeMetrics))
+
+	if ra.includeMetricsChecked.CompareAndSwap(false, true) && len(missing) > 0 {
+		log.Warn("included metrics not found in the scrape, check the configured metric names", "remote", ra.url, "metrics", missing)
+	}
+}
+
+// checkAggregateLabels warns about every configured aggregation label which
+// isn't in seen, as it is most likely a typo and has no effect
+func (ra *RemoteAggregator) checkAggregateLabels(cfg *config, seen map[string]bool) {
+	configured := slices.Concat(ra.aggregateWithOutLabels, ra.aggregateByLabels, ra.dropLabels)
+	for _, output := range ra.aggregationOutputs {
+		configured = append(configured, output.aggregateWithOutLabels...)
+	}
+	for _, rule := range cfg.Rules {
+		configured = append(configured, rule.AggregateWithOutLabels...)
+		configured = append(configured, rule.AggregateByLabels...)
+	}
+
+	slices.Sort(configured)
+	for _, label := range slices.Compact(configured) {
+		if !seen[label] {
+			log.Warn("aggregation label not found in any scraped metric, check the configured label names", "remote", ra.url, "label", label)
+		}
+	}
+}
+
+// processAndSend runs a single metric family through the aggregation pipeline
+// and sends the resulting metrics to ch. The stages always run in this order:
+//
+//  1. filter families by name and type, filter series by label values and
+//     deduplicate identical series, a family both included and excluded by
+//     name is filtered out, then override the family type and offset the
+//     values of reset counters. Families are already renamed and merged by
+//     decodeAndSend.
+//  2. rename labels, replace label values with their canonical value and
+//     truncate long label values
+//  3. set constant labels
+//  4. build the aggregation key from all labels except the aggregated and the
+//     dropped ones, or only the kept ones with aggregate-by-label. Aggregated
+//     labels with an exempted value are kept.
+//  5. aggregate the values of series with the same key, dropping gauges and
+//     optionally counters aggregated to 0
+//  6. prefix the metric name and append the aggregation output suffix
+//  7. relabel the aggregated series
+//
+// Names already exported by the scrape are skipped, as the family would
+// collide with the exported one and fail the whole collection, so of two
+// colliding families the one processed last is skipped. It returns the
+// exported metric families, one for the default aggregation and one for each
+// configured aggregation output, or nil if the family was filtered out.
+func (ra *RemoteAggregator) processAndSend(metricFamily *dto.MetricFamily, scrapeTime time.Time, state *scrapeState, ch chan<- prometheus.Metric) []*dto.MetricFamily {
+	name := metricFamily.GetName()
+	if slices.Contains(ra.passthroughMetrics, name) {
+		if !state.export(name) {
+			log.Error("skipping metric colliding with an exported metric", "remote", ra.url, "metric", name)
+			nameCollisions.WithLabelValues(ra.url).Inc()
+			return nil
+		}
+		return []*dto.MetricFamily{ra.passThroughAndSend(metricFamily, name, state, ch)}
+	}
+
+	// 1. filter
+	// if includeMetrics is set filter metrics based on name
+	if len(ra.includeMetrics) > 0 && !slices.Contains(ra.includeMetrics, name) {
+		log.Debug("dropping metric not included", "remote", ra.url, "metric", name)
+		return nil
+	}
+	// excluding takes precedence over including
+	if slices.Contains(ra.excludeMetrics, name) {
+		log.Debug("dropping excluded metric", "remote", ra.url, "metric", name)
+		return nil
+	}
+	// if includeTypes is set filter metrics based on type
+	if len(ra.includeTypes) > 0 && !slices.Contains(ra.includeTypes, metricFamily.GetType()) {
+		log.Debug("dropping metric of type not included", "remote", ra.url, "metric", name, "type", metricFamily.GetType())
+		return nil
+	}
+	if len(ra.keepIf) > 0 || len(ra.dropIf) > 0 {
+		metricFamily.Metric = ra.filterSeries(metricFamily.Metric)
+	}
+	if ra.skipNaN || ra.skipInf {
+		metricFamily.Metric = ra.skipNonFinite(name, metricFamily.Metric)
+	}
+	if ra.dedupInput {
+		metricFamily.Metric = ra.dedupSeries(name, metricFamily.Metric)
+	}
+
+	var result []*dto.MetricFamily
+	if ra.keepOriginal {
+		// the later stages modify the series in place
+		original := proto.Clone(metricFamily).(*dto.MetricFamily)
+		originalName := ra.originalPrefix + name
+		if state.export(originalName) {
+			result = append(result, ra.passThroughAndSend(original, originalName, state, ch))
+		} else {
+			log.Error("skipping original metric colliding with an exported metric", "remote", ra.url, "metric", name, "name", originalName)
+			nameCollisions.WithLabelValues(ra.url).Inc()
+		}
+	}
+
+	if metricType, ok := ra.forceTypes[name]; ok && metricType != metricFamily.GetType() {
+		if isValueType(metricFamily.GetType()) {
+			forceType(metricFamily, metricType)
+		} else {
+			log.Warn("can't force the type of a histogram or summary", "remote", ra.url, "metric", name, "type", metricFamily.GetType())
+		}
+	}
+	if ra.counterResets != nil && metricFamily.GetType() == dto.MetricType_COUNTER {
+		if resets := ra.counterResets.adjust(name, metricFamily.Metric, scrapeTime); resets > 0 {
+			log.Debug("counter series reset", "remote", ra.url, "metric", name, "series", resets)
+			counterResetsTotal.WithLabelValues(ra.url).Add(float64(resets))
+		}
+	}
+
+	// the series are matched with their weight series by their scraped labels
+	var weights map[*dto.Metric]float64
+	if weightName, ok := ra.weightBy[metricFamily.GetName()]; ok {
+		if metricFamily.GetType() == dto.MetricType_GAUGE {
+			weights = seriesWeights(metricFamily.Metric, state.weights[weightName])
+		} else {
+			log.Warn("can't weight the average of a metric which isn't a gauge", "remote", ra.url, "metric", name, "type", metricFamily.GetType())
+		}
+	}
+
+	// 2. and 3. relabel series
+	ra.relabelSeries(metricFamily.Metric)
+	state.seeLabels(metricFamily.Metric)
+
+	// 6. name, applied by aggregateAndSend after aggregating
+	if prefix, ok := ra.metricPrefixes[name]; ok {
+		name = prefix + name
+	} else if ra.addPrefix != "" {
+		name = ra.addPrefix + name
+	}
+	// assuming all metrics of same family will have same timestamp
+	ct := scrapeTime
+	if !ra.stampScrapeTime && len(metricFamily.Metric) > 0 && metricFamily.Metric[0].TimestampMs != nil {
+		ct = time.UnixMilli(*metricFamily.Metric[0].TimestampMs)
+	}
+
+	rule := ra.rule(state.config, metricFamily.GetName())
+	without := ra.withUnallowedLabels(metricFamily, ra.withoutLabels(metricFamily, rule))
+	log.Debug("aggregating metric", "remote", ra.url, "metric", name, "without", without, "aggregation", rule.Aggregation)
+
+	send := func(metricFamily *dto.MetricFamily, name string, without []string, aggregation string, weights map[*dto.Metric]float64) {
+		if !state.export(name) {
+			log.Error("skipping metric colliding with an exported metric", "remote", ra.url, "metric", metricFamily.GetName(), "name", name)
+			nameCollisions.WithLabelValues(ra.url).Inc()
+			return
+		}
+		result = append(result, ra.aggregateAndSend(metricFamily, name, without, aggregation, weights, state, ct, ch))
+	}
+	send(metricFamily, name, without, rule.Aggregation, weights)
+	for _, output := range ra.aggregationOutputs {
+		send(metricFamily, name+output.suffix, ra.withUnallowedLabels(metricFamily, ra.withDropLabels(output.aggregateWithOutLabels)), rule.Aggregation, weights)
+	}
+	if ra.seriesCount {
+		send(seriesCountFamily(metricFamily), name+seriesCountSuffix, without, aggregationCount, nil)
+	}
+	return result
+}
+
+// seriesCountSuffix is appended to the name of the family with the number of
+// series aggregated into every series
+const seriesCountSuffix = "_aggregated_series_count"
+
+// seriesCountFamily returns a gauge family with the series of metricFamily,
+// which aggregated with the count aggregation is the number of series
+// aggregated into every series of any family type
+func seriesCountFamily(metricFamily *dto.MetricFamily) *dto.MetricFamily {
+	return &dto.MetricFamily{
+		Name:   proto.String(metricFamily.GetName() + seriesCountSuffix),
+		Help:   proto.String("Number of series of " + metricFamily.GetName() + " aggregated into each series"),
+		Type:   dto.MetricType_GAUGE.Enum(),
+		Metric: metricFamily.Metric,
+	}
+}
+
+// rule returns the first rule of cfg matching the named metric family, or the
+// rule given by the aggregation flags if none matches. The aggregation of the
+// returned rule is always set.
+func (ra *RemoteAggregator) rule(cfg *config, name string) aggregationRule {
+	rule := aggregationRule{
+		AggregateWithOutLabels: ra.aggregateWithOutLabels,
+		AggregateByLabels:      ra.aggregateByLabels,
+	}
+	for _, r := range cfg.Rules {
+		if r.matches(name) {
+			rule = r
+			break
+		}
+	}
+
+	if rule.Aggregation == "" {
+		rule.Aggregation = ra.aggregation
+	}
+	return rule
+}
+
+// withoutLabels returns the labels the metrics of metricFamily are aggregated
+// over according to rule, which always include the dropped labels. With
+// aggregate by labels these are all labels of the family except the listed and
+// the constant ones.
+func (ra *RemoteAggregator) withoutLabels(metricFamily *dto.MetricFamily, rule aggregationRule) []string {
+	if len(rule.AggregateByLabels) == 0 {
+		return ra.withDropLabels(rule.AggregateWithOutLabels)
+	}
+
+	var without []string
+	for _, metric := range metricFamily.Metric {
+		for _, label := range metric.Label {
+			name := label.GetName()
+			if _, ok := ra.addLabels[name]; ok || slices.Contains(rule.AggregateByLabels, name) || slices.Contains(without, name) {
+				continue
+			}
+			without = append(without, name)
+		}
+	}
+	return ra.withDropLabels(without)
+}
+
+// withUnallowedLabels returns labels with the labels of the metrics of
+// metricFamily which are not in the output label allowlist, if set, so the
+// series are aggregated over them. Constant labels are always allowed.
+func (ra *RemoteAggregator) withUnallowedLabels(metricFamily *dto.MetricFamily, labels []string) []string {
+	if len(ra.outputLabelAllowlist) == 0 {
+		return labels
+	}
+
+	without := slices.Clip(labels)
+	for _, metric := range metricFamily.Metric {
+		for _, label := range metric.Label {
+			name := label.GetName()
+			if _, ok := ra.addLabels[name]; ok || slices.Contains(ra.outputLabelAllowlist, name) || slices.Contains(without, name) {
+				continue
+			}
+			without = append(without, name)
+		}
+	}
+	return without
+}
+
+// withDropLabels returns the labels with the dropped labels appended
+func (ra *RemoteAggregator) withDropLabels(labels []string) []string {
+	if len(ra.dropLabels) == 0 {
+		return labels
+	}
+	return append(slices.Clip(labels), ra.dropLabels...)
+}
+
+// filterSeries returns the metrics matching all keep conditions, without the
+// metrics matching all drop conditions
+func (ra *RemoteAggregator) filterSeries(metrics []*dto.Metric) []*dto.Metric {
+	return slices.DeleteFunc(metrics, func(metric *dto.Metric) bool {
+		if len(ra.keepIf) > 0 && !matchesAll(metric, ra.keepIf) {
+			return true
+		}
+		return len(ra.dropIf) > 0 && matchesAll(metric, ra.dropIf)
+	})
+}
+
+// skipNonFinite returns the metrics without the gauge, counter and untyped
+// series whose value is NaN or infinite, as configured
+func (ra *RemoteAggregator) skipNonFinite(name string, metrics []*dto.Metric) []*dto.Metric {
+	return slices.DeleteFunc(metrics, func(metric *dto.Metric) bool {
+		value, ok := sampleValue(metric)
+		if !ok || !(ra.skipNaN && math.IsNaN(value) || ra.skipInf && math.IsInf(value, 0)) {
+			return false
+		}
+		log.Debug("skipping non-finite sample", "remote", ra.url, "metric", name, "value", value)
+		return true
+	})
+}
+
+// labelMatcher matches series with the label value, a missing label matches
+// the empty value
+type labelMatcher struct {
+	name  string
+	value string
+}
+
+// matchesAll returns whether the metric matches all matchers
+func matchesAll(metric *dto.Metric, matchers []labelMatcher) bool {
+	for _, m := range matchers {
+		var value string
+		for _, label := range metric.Label {
+			if label.GetName() == m.name {
+				value = label.GetValue()
+				break
+			}
+		}
+		if value != m.value {
+			return false
+		}
+	}
+	return true
+}
+
+// isValueType reports whether series of metricType have a single value, which
+// are gauges, counters and untyped series
+func isValueType(metricType dto.MetricType) bool {
+	return metricType == dto.MetricType_GAUGE || metricType == dto.MetricType_COUNTER || metricType == dto.MetricType_UNTYPED
+}
+
+// forceType sets the type of metricFamily and its series to metricType, both
+// types must be value types
+func forceType(metricFamily *dto.MetricFamily, metricType dto.MetricType) {
+	for _, metric := range metricFamily.Metric {
+		var value float64
+		switch {
+		case metric.Gauge != nil:
+			value = metric.GetGauge().GetValue()
+		case metric.Counter != nil:
+			value = metric.GetCounter().GetValue()
+		case metric.Untyped != nil:
+			value = metric.GetUntyped().GetValue()
+		default:
+			continue
+		}
+
+		metric.Gauge, metric.Counter, metric.Untyped = nil, nil, nil
+		switch metricType {
+		case dto.MetricType_GAUGE:
+			metric.Gauge = &dto.Gauge{Value: proto.Float64(value)}
+		case dto.MetricType_COUNTER:
+			metric.Counter = &dto.Counter{Value: proto.Float64(value)}
+		default:
+			metric.Untyped = &dto.Untyped{Value: proto.Float64(value)}
+		}
+	}
+	metricFamily.Type = metricType.Enum()
+}
+
+// dedupSeries returns metrics without the series which are identical to a
+// previous series, in labels as well as value
+func (ra *RemoteAggregator) dedupSeries(name string, metrics []*dto.Metric) []*dto.Metric {
+	seen := make(map[string]bool, len(metrics))
+	result := metrics[:0]
+
+	for _, metric := range metrics {
+		identity := seriesIdentity(metric)
+		if seen[identity] {
+			continue
+		}
+		seen[identity] = true
+		result = append(result, metric)
+	}
+
+	if duplicates := len(metrics) - len(result); duplicates > 0 {
+		log.Debug("dropped duplicate series", "remote", ra.url, "metric", name, "count", duplicates)
+		dedupSeriesTotal.WithLabelValues(ra.url).Add(float64(duplicates))
+	}
+	return result
+}
+
+// seriesIdentity returns a string which is equal for series with the same
+// labels, regardless of their order, and the same value
+func seriesIdentity(metric *dto.Metric) string {
+	labels := make([]string, 0, len(metric.Label))
+	for _, label := range metric.Label {
+		labels = append(labels, label.GetName()+"\xff"+label.GetValue())
+	}
+	slices.Sort(labels)
+
+	value, err := proto.MarshalOptions{Deterministic: true}.Marshal(&dto.Metric{
+		Gauge:       metric.Gauge,
+		Counter:     metric.Counter,
+		Summary:     metric.Summary,
+		Untyped:     metric.Untyped,
+		Histogram:   metric.Histogram,
+		TimestampMs: metric.TimestampMs,
+	})
+	if err != nil {
+		// a decoded metric always marshals, this can't happen
+		panic(err)
+	}
+
+	return strings.Join(labels, "\xfe") + "\xfd" + string(value)
+}
+
+// relabelSeries renames the labels of all series, replaces the label values of all series with their canonical
+// value, truncates long label values and sets the constant labels, the metrics are modified in place
+func (ra *RemoteAggregator) relabelSeries(metrics []*dto.Metric) {
+	constantLabels := slices.Sorted(maps.Keys(ra.addLabels))
+	// the first seen value of the normalized labels by their lowercase value
+	firstSeen := make(map[string]map[string]string)
+
+	for _, metric := range metrics {
+		if len(ra.renameLabels) > 0 {
+			metric.Label = renameLabels(metric.Label, ra.renameLabels)
+		}
+		for _, label := range metric.Label {
+			if valueMap, ok := ra.labelValueMaps[label.GetName()]; ok {
+				label.Value = proto.String(mapLabelValue(valueMap, label.GetValue()))
+			}
+			if slices.Contains(ra.normalizeLabels, label.GetName()) {
+				label.Value = proto.String(normalizeLabelValue(firstSeen, label.GetName(), label.GetValue()))
+			}
+			if value, ok := truncateLabelValue(label.GetValue(), ra.maxLabelValueLength); ok {
+				label.Value = proto.String(value)
+				truncatedLabelValues.WithLabelValues(ra.url).Inc()
+			}
+		}
+		for _, name := range constantLabels {
+			metric.Label = setLabel(metric.Label, name, ra.addLabels[name])
+		}
+	}
+}
+
+// labelValueEllipsis marks truncated label values
+const labelValueEllipsis = "…"
+
+// normalizeLabelValue returns the value of the label first seen with the same
+// lowercase value, recording value if it is the first
+func normalizeLabelValue(firstSeen map[string]map[string]string, name, value string) string {
+	values := firstSeen[name]
+	if values == nil {
+		values = make(map[string]string)
+		firstSeen[name] = values
+	}
+	lower := strings.ToLower(value)
+	if first, ok := values[lower]; ok {
+		return first
+	}
+	values[lower] = value
+	return value
+}
+
+// truncateLabelValue returns value truncated to length characters, the last of
+// which is the ellipsis, and whether it was truncated. Values are never
+// truncated if length is 0.
+func truncateLabelValue(value string, length int) (string, bool) {
+	if length <= 0 || utf8.RuneCountInString(value) <= length {
+		return value, false
+	}
+	runes := []rune(value)
+	return string(runes[:length-1]) + labelValueEllipsis, true
+}
+
+// renameLabels renames the labels by their old name in renames, in place. A
+// renamed label replaces an existing label of the new name, so the value of
+// the renamed label is kept.
+func renameLabels(labels []*dto.LabelPair, renames map[string]string) []*dto.LabelPair {
+	renamed := make(map[string]bool)
+	for _, label := range labels {
+		if name, ok := renames[label.GetName()]; ok {
+			renamed[name] = true
+		}
+	}
+	if len(renamed) == 0 {
+		return labels
+	}
+
+	result := make([]*dto.LabelPair, 0, len(labels))
+	for _, label := range labels {
+		if name, ok := renames[label.GetName()]; ok {
+			result = append(result, &dto.LabelPair{Name: proto.String(name), Value: label.Value})
+		} else if !renamed[label.GetName()] {
+			result = append(result, label)
+		}
+	}
+	return result
+}
+
+// setLabel sets the value of the named label, adding the label if missing
+func setLabel(labels []*dto.LabelPair, name, value string) []*dto.LabelPair {
+	for _, label := range labels {
+		if label.GetName() == name {
+			label.Value = proto.String(value)
+			return labels
+		}
+	}
+	return append(labels, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+}
+
+// exemptGroups splits the series of metricFamily into families of the series
+// with the same exempted labels, which are the labels of aggregateWithOutLabels
+// with an exempted value except the dropped labels, and returns them with the
+// labels to aggregate each family over. Exempted labels are kept, so series
+// with an exempted value aren't aggregated with the other series.
+func (ra *RemoteAggregator) exemptGroups(metricFamily *dto.MetricFamily, aggregateWithOutLabels []string) ([]*dto.MetricFamily, [][]string) {
+	if len(ra.exemptLabelValues) == 0 {
+		return []*dto.MetricFamily{metricFamily}, [][]string{aggregateWithOutLabels}
+	}
+
+	var families []*dto.MetricFamily
+	var withouts [][]string
+	groups := make(map[string]int)
+	for _, metric := range metricFamily.Metric {
+		var exempted []string
+		for _, label := range metric.Label {
+			name := label.GetName()
+			// dropped labels are never kept
+			if slices.Contains(aggregateWithOutLabels, name) && !slices.Contains(ra.dropLabels, name) && slices.Contains(ra.exemptLabelValues, labelMatcher{name, label.GetValue()}) {
+				exempted = append(exempted, name)
+			}
+		}
+		slices.Sort(exempted)
+
+		key := strings.Join(exempted, "\xff")
+		i, ok := groups[key]
+		if !ok {
+			i = len(families)
+			groups[key] = i
+			families = append(families, &dto.MetricFamily{Name: metricFamily.Name, Help: metricFamily.Help, Type: metricFamily.Type})
+			withouts = append(withouts, slices.DeleteFunc(slices.Clone(aggregateWithOutLabels), func(name string) bool {
+				return slices.Contains(exempted, name)
+			}))
+		}
+		families[i].Metric = append(families[i].Metric, metric)
+	}
+	return families, withouts
+}
+
+// aggregateAndSend aggregates the metrics of metricFamily over
+// aggregateWithOutLabels and sends them to ch under the given name, up to the
+// output series limit of the scrape. It returns the exported metric family.
+func (ra *RemoteAggregator) aggregateAndSend(metricFamily *dto.MetricFamily, name string, aggregateWithOutLabels []string, aggregation string, weights map[*dto.Metric]float64, state *scrapeState, ct time.Time, ch chan<- prometheus.Metric) *dto.MetricFamily {
+	result := &dto.MetricFamily{
+		Name: proto.String(name),
+		Help: proto.String(metricFamily.GetHelp()),
+		Type: metricFamily.GetType().Enum(),
+	}
+
+	// 4. and 5. build key and aggregate
+	// whether the metrics carry the timestamps of their series
+	var timestamped bool
+	buckets, observe := ra.observeIntoHistogram[metricFamily.GetName()]
+	if observe {
+		result.Type = dto.MetricType_HISTOGRAM.Enum()
+	} else if weights != nil {
+		result.Type = dto.MetricType_GAUGE.Enum()
+	} else {
+		if (aggregation == aggregationCount || aggregation == aggregationPresent) && metricFamily.GetType() == dto.MetricType_COUNTER {
+			result.Type = dto.MetricType_GAUGE.Enum()
+		}
+		timestamped = ra.honorTimestamps != ""
+	}
+
+	// each metric is relabeled and sent to ch as soon as it's aggregated, so
+	// the aggregates are released while sending
+	relabel := state.config.Relabel
+	seen := make(map[string]bool)
+	send := func(promMetric prometheus.Metric) {
+		metric := promMetric
+		if !timestamped {
+			metric = prometheus.NewMetricWithTimestamp(ct, promMetric)
+		}
+
+		out := &dto.Metric{}
+		if err := metric.Write(out); err != nil {
+			log.Error("error writing Prometheus metric", "err", err)
+			return
+		}
+
+		// 7. relabel the aggregated series
+		if len(relabel) > 0 {
+			var keep bool
+			if metric, keep = ra.relabelMetric(relabel, name, metricFamily.GetHelp(), seen, metric, out); !keep {
+				return
+			}
+		}
+
+		// dropped series don't count against the output series limit
+		if ra.dropZero && zeroValue(out, ra.dropZeroCounters) {
+			return
+		}
+		if !state.send() {
+			return
+		}
+		ch <- metric
+		if ra.resultSeries {
+			result.Metric = append(result.Metric, out)
+		}
+	}
+
+	families, withouts := ra.exemptGroups(metricFamily, aggregateWithOutLabels)
+	for i, family := range families {
+		switch {
+		case observe:
+			for _, promMetric := range observedHistograms(family, name, withouts[i], buckets, ra.roundScale) {
+				send(promMetric)
+			}
+		case weights != nil:
+			for _, promMetric := range weightedAverages(family, name, withouts[i], weights, ra.roundScale) {
+				send(promMetric)
+			}
+		default:
+			aggregatedMetrics(family, name, withouts[i], aggregation, ra.honorTimestamps, ra.exemplarSelection, ra.nativeAsClassic, ra.roundScale, send)
+		}
+	}
+	return result
+}
+
+// aggregatedMetrics passes the metrics of metricFamily aggregated over
+// aggregateWithOutLabels with the aggregation function under the given name to
+// send, in label order, as each is created.
+// If honorTimestamps is min or max the metrics have the minimum or maximum
+// timestamp of their series, if any. Counters, histograms and summaries have
+// the earliest created timestamp of their series, if any. If exemplarSelection
+// is set counters and histograms keep an exemplar of their series. Native
+// histograms are merged into a native histogram, or into a classic histogram
+// if nativeAsClassic is set or any of the merged histograms is classic only.
+func aggregatedMetrics(metricFamily *dto.MetricFamily, name string, aggregateWithOutLabels []string, function, honorTimestamps, exemplarSelection string, nativeAsClassic bool, roundScale float64, send func(prometheus.Metric)) {
+	aggregatedLabels, aggregated := aggregateMetrics(metricFamily.Metric, aggregateWithOutLabels, exemplarSelection != "")
+
+	for _, key := range slices.Sorted(maps.Keys(aggregated)) {
+		a, labels := aggregated[key], aggregatedLabels[key]
+		// the aggregates are released as they're sent
+		delete(aggregated, key)
+		delete(aggregatedLabels, key)
+		value := roundValue(a.result(function), roundScale)
+		a.sum = roundValue(a.sum, roundScale)
+		var promMetric prometheus.Metric
+		var err error
+
+		desc := prometheus.NewDesc(name, metricFamily.GetHelp(), nil, labels)
+
+		switch metricFamily.GetType() {
+		case dto.MetricType_GAUGE:
+			promMetric, err = prometheus.NewConstMetric(desc, prometheus.GaugeValue, value)
+		case dto.MetricType_COUNTER:
+			switch {
+			case function == aggregationCount || function == aggregationPresent:
+				// the number of series isn't monotonic
+				promMetric, err = prometheus.NewConstMetric(desc, prometheus.GaugeValue, value)
+			case !a.created.IsZero():
+				promMetric, err = prometheus.NewConstMetricWithCreatedTimestamp(desc, prometheus.CounterValue, value, a.created)
+			default:
+				promMetric, err = prometheus.NewConstMetric(desc, prometheus.CounterValue, value)
+			}
+		case dto.MetricType_HISTOGRAM:
+			if a.native != nil && a.classicOnly {
+				a.dropNative()
+			}
+			if a.native != nil && nativeAsClassic {
+				// the classic buckets of the native buckets replace the
+				// classic buckets of hybrid histograms
+				a.buckets = a.native.classicBuckets()
+			}
+			switch {
+			case a.native != nil && !nativeAsClassic:
+				promMetric, err = nativeHistogramMetric(desc, a)
+			case !a.created.IsZero():
+				promMetric, err = prometheus.NewConstHistogramWithCreatedTimestamp(desc, a.count, a.sum, a.buckets, a.created)
+			default:
+				promMetric, err = prometheus.NewConstHistogram(desc, a.count, a.sum, a.buckets)
+			}
+		case dto.MetricType_SUMMARY:
+			// quantiles can't be aggregated, only the sample count and sum
+			if !a.created.IsZero() {
+				promMetric, err = prometheus.NewConstSummaryWithCreatedTimestamp(desc, a.count, a.sum, nil, a.created)
+			} else {
+				promMetric, err = prometheus.NewConstSummary(desc, a.count, a.sum, nil)
+			}
+		default:
+			promMetric, err = prometheus.NewConstMetric(desc, prometheus.UntypedValue, value)
+		}
+
+		if err != nil {
+			log.Error("error creating Prometheus metric", "err", err)
+			continue
+		}
+
+		// the number of series has no exemplars, histograms are always summed
+		if metricFamily.GetType() == dto.MetricType_HISTOGRAM || (function != aggregationCount && function != aggregationPresent) {
+			if withExemplars, err := withExemplars(promMetric, a, exemplarSelection); err != nil {
+				log.Error("error adding exemplars, exporting the metric without", "metric", name, "err", err)
+			} else {
+				promMetric = withExemplars
+			}
+		}
+
+		if ts, ok := a.timestamp(honorTimestamps); ok {
+			promMetric = prometheus.NewMetricWithTimestamp(ts, promMetric)
+		}
+
+		send(promMetric)
+	}
+}
+
+// zeroValue returns whether metric is a gauge, or a counter if counters is set,
+// with a value of exactly 0
+func zeroValue(metric *dto.Metric, counters bool) bool {
+	if metric.Gauge != nil {
+		return metric.Gauge.GetValue() == 0
+	}
+	return counters && metric.Counter != nil && metric.Counter.GetValue() == 0
+}
+
+// maxRoundDecimals is the most decimal places values can be rounded to, as
+// float64 values only have about 15 significant decimal digits
+const maxRoundDecimals = 15
+
+// roundDecimalsScale returns the scale rounding values to decimals decimal
+// places, 0 if decimals is negative as rounding is disabled then
+func roundDecimalsScale(decimals int) (float64, error) {
+	if decimals > maxRoundDecimals {
+		return 0, fmt.Errorf("invalid round-decimals %d, must be at most %d or negative to disable rounding", decimals, maxRoundDecimals)
+	}
+	if decimals < 0 {
+		return 0, nil
+	}
+	return math.Pow10(decimals), nil
+}
+
+// roundValue returns value rounded to a multiple of 1/scale, or unchanged if
+// scale is 0
+func roundValue(value, scale float64) float64 {
+	if scale == 0 {
+		return value
+	}
+	return math.Round(value*scale) / scale
+}
+
+// aggregate is the aggregated value of all series with the same key
+type aggregate struct {
+	// sum, minimum and maximum of the gauge and counter values, and the number
+	// of series of any type
+	value  float64
+	series int
+	min    float64
+	max    float64
+
+	// histogram and summary sample count and sum, and the histogram
+	// cumulative bucket counts by upper bound excluding the +Inf bucket
+	count   uint64
+	sum     float64
+	buckets map[float64]uint64
+
+	// minimum and maximum timestamp of the series with a timestamp
+	timestamped    bool
+	minTimestampMs int64
+	maxTimestampMs int64
+
+	// created is the earliest created timestamp of the counters, histograms
+	// and summaries with one, zero if none has one
+	created time.Time
+
+	// exemplars are the exemplars of the counters, or of the histogram buckets
+	// by upper bound, in the order of their series
+	exemplars map[float64][]*dto.Exemplar
+
+	// native is the sum of the native histograms, nil if none is native
+	native *nativeHistogram
+	// nativeOnly is the sum of the native histograms without classic
+	// buckets, and classicOnly is whether any histogram isn't native
+	nativeOnly  *nativeHistogram
+	classicOnly bool
+}
+
+// addCreated adds the created timestamp of a series to the aggregate, nil if
+// the series has none
+func (a *aggregate) addCreated(created *timestamppb.Timestamp) {
+	if created == nil {
+		return
+	}
+	if t := created.AsTime(); a.created.IsZero() || t.Before(a.created) {
+		a.created = t
+	}
+}
+
+// addTimestamp adds the timestamp of a series to the aggregate
+func (a *aggregate) addTimestamp(timestampMs int64) {
+	if !a.timestamped || timestampMs < a.minTimestampMs {
+		a.minTimestampMs = timestampMs
+	}
+	if !a.timestamped || timestampMs > a.maxTimestampMs {
+		a.maxTimestampMs = timestampMs
+	}
+	a.timestamped = true
+}
+
+// timestamp returns the minimum or maximum timestamp of the series according
+// to function, which is min or max
+func (a *aggregate) timestamp(function string) (time.Time, bool) {
+	if !a.timestamped {
+		return time.Time{}, false
+	}
+	switch function {
+	case aggregationMin:
+		return time.UnixMilli(a.minTimestampMs), true
+	case aggregationMax:
+		return time.UnixMilli(a.maxTimestampMs), true
+	}
+	return time.Time{}, false
+}
+
+// addValue adds the value of a gauge or counter to the aggregate
+func (a *aggregate) addValue(value float64) {
+	if a.series == 0 || value < a.min {
+		a.min = value
+	}
+	if a.series == 0 || value > a.max {
+		a.max = value
+	}
+	a.value += value
+	a.series++
+}
+
+// result returns the gauge or counter value of the aggregate according to the
+// aggregation function, the sum if function isn't set
+func (a *aggregate) result(function string) float64 {
+	switch function {
+	case aggregationAvg:
+		return a.value / float64(a.series)
+	case aggregationMin:
+		return a.min
+	case aggregationMax:
+		return a.max
+	case aggregationCount:
+		return float64(a.series)
+	case aggregationPresent:
+		return 1
+	}
+	return a.value
+}
+
+// addBuckets adds the cumulative buckets of a histogram to the aggregate. An
+// upper bound missing from one side takes the count of its next lower bound,
+// so histograms with different buckets add up to the union of their buckets.
+func (a *aggregate) addBuckets(buckets []*dto.Bucket) {
+	series := make(map[float64]uint64, len(buckets))
+	for _, bucket := range buckets {
+		if !math.IsInf(bucket.GetUpperBound(), +1) {
+			series[bucket.GetUpperBound()] = bucket.GetCumulativeCount()
+		}
+	}
+	a.addBucketCounts(series)
+}
+
+// addBucketCounts adds the cumulative counts of buckets by upper bound to the
+// aggregate like addBuckets
+func (a *aggregate) addBucketCounts(series map[float64]uint64) {
+	union := make(map[float64]uint64, len(a.buckets)+len(series))
+	for bound := range a.buckets {
+		union[bound] = cumulativeCount(a.buckets, bound) + cumulativeCount(series, bound)
+	}
+	for bound := range series {
+		union[bound] = cumulativeCount(a.buckets, bound) + cumulativeCount(series, bound)
+	}
+	a.buckets = union
+}
+
+// cumulativeCount returns the count of the highest bucket not above bound
+func cumulativeCount(buckets map[float64]uint64, bound float64) uint64 {
+	var count uint64
+	highest := math.Inf(-1)
+	for upperBound, c := range buckets {
+		if upperBound <= bound && upperBound >= highest {
+			highest, count = upperBound, c
+		}
+	}
+	return count
+}
+
+// aggregateMetrics returns aggregated values and label pairs map on same key,
+// the exemplars of the series are only kept if exemplars is set
+func aggregateMetrics(metrics []*dto.Metric, aggregateWithOutLabels []string, exemplars bool) (map[string]map[string]string, map[string]*aggregate) {
+	aggregated := make(map[string]*aggregate)
+	aggregatedLabels := make(map[string]map[string]string)
+
+	// the key is only copied into a string for keys not seen before
+	var keys keyBuilder
+	for _, metric := range metrics {
+		key := keys.key(metric, aggregateWithOutLabels)
+		if _, ok := aggregatedLabels[string(key)]; !ok {
+			aggregatedLabels[string(key)] = keys.labels()
+		}
+
+		a := aggregated[string(key)]
+		added := a == nil
+		if added {
+			a = &aggregate{}
 		}
 
-		ra.processAndSend(&metricFamily, ch)
+		switch {
+		case metric.GetGauge() != nil:
+			a.addValue(metric.GetGauge().GetValue())
+		case metric.GetUntyped() != nil:
+			a.addValue(metric.GetUntyped().GetValue())
+		case metric.GetCounter() != nil:
+			a.addValue(metric.GetCounter().GetValue())
+			a.addCreated(metric.GetCounter().GetCreatedTimestamp())
+			if exemplars {
+				a.addExemplar(counterExemplarBound, metric.GetCounter().GetExemplar())
+			}
+		case metric.GetHistogram() != nil:
+			a.series++
+			a.count += metric.GetHistogram().GetSampleCount()
+			a.sum += metric.GetHistogram().GetSampleSum()
+			a.addBuckets(metric.GetHistogram().Bucket)
+			if isNativeHistogram(metric.GetHistogram()) {
+				a.addNative(metric.GetHistogram())
+			} else {
+				a.classicOnly = true
+			}
+			a.addCreated(metric.GetHistogram().GetCreatedTimestamp())
+			if exemplars {
+				for _, bucket := range metric.GetHistogram().Bucket {
+					a.addExemplar(bucket.GetUpperBound(), bucket.GetExemplar())
+				}
+			}
+		case metric.GetSummary() != nil:
+			a.series++
+			a.count += metric.GetSummary().GetSampleCount()
+			a.sum += metric.GetSummary().GetSampleSum()
+			a.addCreated(metric.GetSummary().GetCreatedTimestamp())
+		default:
+			continue
+		}
+		if metric.TimestampMs != nil {
+			a.addTimestamp(metric.GetTimestampMs())
+		}
+		if added {
+			aggregated[string(key)] = a
+		}
 	}
+	return aggregatedLabels, aggregated
 }
 
-func (ra *RemoteAggregator) processAndSend(metricFamily *dto.MetricFamily, ch chan<- prometheus.Metric) {
+// aggregationKey returns the key of the series the metric is aggregated into
+// and its labels, which are all labels except aggregateWithOutLabels. The key
+// is built from the labels sorted by name, so it doesn't depend on their
+// order, separated by \xff, which isn't valid UTF-8 and so can't be part of
+// label names or values.
+func aggregationKey(metric *dto.Metric, aggregateWithOutLabels []string) (string, map[string]string) {
+	var keys keyBuilder
+	key := keys.key(metric, aggregateWithOutLabels)
+	return string(key), keys.labels()
+}
 
-	name := metricFamily.GetName()
-	// if includeMetrics is set filter metrics based on name
-	if len(ra.includeMetrics) > 0 && !slices.Contains(ra.includeMetrics, name) {
-		return
+// keyBuilder builds aggregation keys, reusing its buffers for every key
+type keyBuilder struct {
+	pairs []*dto.LabelPair
+	buf   []byte
+}
+
+// key returns the aggregation key of metric, which is only valid until the
+// next call. It consists of the names and values of the labels except
+// aggregateWithOutLabels sorted by name, of labels with the same name only
+// the last.
+func (b *keyBuilder) key(metric *dto.Metric, aggregateWithOutLabels []string) []byte {
+	b.pairs = b.pairs[:0]
+	for _, label := range metric.Label {
+		if !slices.Contains(aggregateWithOutLabels, label.GetName()) {
+			b.pairs = append(b.pairs, label)
+		}
+	}
+	// labels are usually scraped sorted already
+	if !slices.IsSortedFunc(b.pairs, compareLabelNames) {
+		slices.SortStableFunc(b.pairs, compareLabelNames)
 	}
 
-	if ra.addPrefix != "" {
-		name = ra.addPrefix + name
+	b.buf = b.buf[:0]
+	kept := b.pairs[:0]
+	for i, label := range b.pairs {
+		if i+1 < len(b.pairs) && b.pairs[i+1].GetName() == label.GetName() {
+			continue
+		}
+		kept = append(kept, label)
+		b.buf = append(b.buf, label.GetName()...)
+		b.buf = append(b.buf, 0xff)
+		b.buf = append(b.buf, label.GetValue()...)
+		b.buf = append(b.buf, 0xff)
 	}
-	// assuming all metrics of same family will have same timestamp
-	ct := time.Now()
-	if len(metricFamily.Metric) > 0 && metricFamily.Metric[0].TimestampMs != nil {
-		ct = time.UnixMilli(*metricFamily.Metric[0].TimestampMs)
+	b.pairs = kept
+	return b.buf
+}
+
+// labels returns the labels of the last key by name
+func (b *keyBuilder) labels() map[string]string {
+	labels := make(map[string]string, len(b.pairs))
+	for _, label := range b.pairs {
+		labels[label.GetName()] = label.GetValue()
 	}
-	aggregatedLabels, aggregatedValue := aggregateMetrics(metricFamily.Metric, ra.aggregateWithOutLabels)
+	return labels
+}
 
-	for key, value := range aggregatedValue {
-		var promMetric prometheus.Metric
-		var err error
+func compareLabelNames(a, b *dto.LabelPair) int {
+	return strings.Compare(a.GetName(), b.GetName())
+}
 
-		maps.Copy(aggregatedLabels[key], ra.addLabels)
+// configHash returns a stable hash of the effective aggregation config, the
+// order of list values is not significant
+func (ra *RemoteAggregator) configHash() string {
+	sorted := func(s []string) []string { return slices.Sorted(slices.Values(s)) }
 
-		desc := prometheus.NewDesc(name, metricFamily.GetHelp(), nil, aggregatedLabels[key])
+	var includeTypes []string
+	for _, t := range ra.includeTypes {
+		includeTypes = append(includeTypes, t.String())
+	}
+	forceTypes := make(map[string]string, len(ra.forceTypes))
+	for name, t := range ra.forceTypes {
+		forceTypes[name] = t.String()
+	}
 
-		switch metricFamily.GetType() {
-		case dto.MetricType_GAUGE:
-			promMetric, err = prometheus.NewConstMetric(desc, prometheus.GaugeValue, value)
-		case dto.MetricType_COUNTER:
-			promMetric, err = prometheus.NewConstMetric(desc, prometheus.CounterValue, value)
-		default:
-			promMetric, err = prometheus.NewConstMetric(desc, prometheus.UntypedValue, value)
+	aggregationOutputs := make(map[string][]string)
+	for _, output := range ra.aggregationOutputs {
+		aggregationOutputs[output.suffix] = sorted(output.aggregateWithOutLabels)
+	}
+	cfg := ra.loadConfig()
+
+	data, err := json.Marshal(struct {
+		URL                    string
+		ExtraPaths             []string
+		ScrapeTimeout          time.Duration
+		ScrapeFormat           expfmt.Format
+		BodyReadTimeout        time.Duration
+		MaxScrapeSize          int64
+		IncludeMetrics         []string
+		ExcludeMetrics         []string
+		PassthroughMetrics     []string
+		KeepOriginal           bool
+		OriginalPrefix         string
+		IncludeTypes           []string
+		KeepIf                 []string
+		DropIf                 []string
+		SkipNaN                bool
+		SkipInf                bool
+		AggregateWithOutLabels []string
+		AggregateByLabels      []string
+		DropLabels             []string
+		OutputLabelAllowlist   []string
+		ExemptLabelValues      []string
+		ForceTypes             map[string]string
+		Aggregation            string
+		Rules                  []aggregationRule
+		Relabel                []relabelConfig
+		RenameLabels           map[string]string
+		RenameMetrics          map[string]string
+		LabelValueMaps         map[string]map[string]string
+		NormalizeLabels        []string
+		RoundScale             float64
+		DropZero               bool
+		DropZeroCounters       bool
+		MaxLabelValueLength    int
+		MaxOutputSeries        int
+		HandleCounterResets    bool
+		NativeAsClassic        bool
+		AggregationOutputs     map[string][]string
+		ObserveIntoHistogram   map[string][]float64
+		WeightBy               map[string]string
+		AddPrefix              string
+		MetricPrefixes         map[string]string
+		AddLabels              map[string]string
+		StampScrapeTime        bool
+		HonorTimestamps        string
+		ExemplarSelection      string
+		DedupInput             bool
+		SeriesCount            bool
+		MergeDuplicates        bool
+	}{
+		URL:                    ra.url,
+		ExtraPaths:             sorted(ra.extraPaths),
+		ScrapeTimeout:          ra.scrapeTimeout,
+		ScrapeFormat:           ra.scrapeFormat,
+		BodyReadTimeout:        ra.bodyReadTimeout,
+		MaxScrapeSize:          ra.maxScrapeSize,
+		IncludeMetrics:         sorted(ra.includeMetrics),
+		ExcludeMetrics:         sorted(ra.excludeMetrics),
+		PassthroughMetrics:     sorted(ra.passthroughMetrics),
+		KeepOriginal:           ra.keepOriginal,
+		OriginalPrefix:         ra.originalPrefix,
+		IncludeTypes:           sorted(includeTypes),
+		KeepIf:                 sorted(matcherStrings(ra.keepIf)),
+		DropIf:                 sorted(matcherStrings(ra.dropIf)),
+		SkipNaN:                ra.skipNaN,
+		SkipInf:                ra.skipInf,
+		AggregateWithOutLabels: sorted(ra.aggregateWithOutLabels),
+		AggregateByLabels:      sorted(ra.aggregateByLabels),
+		DropLabels:             sorted(ra.dropLabels),
+		OutputLabelAllowlist:   sorted(ra.outputLabelAllowlist),
+		ExemptLabelValues:      sorted(matcherStrings(ra.exemptLabelValues)),
+		ForceTypes:             forceTypes,
+		Aggregation:            ra.aggregation,
+		Rules:                  cfg.Rules,
+		Relabel:                cfg.Relabel,
+		RenameLabels:           ra.renameLabels,
+		RenameMetrics:          ra.renameMetrics,
+		LabelValueMaps:         ra.labelValueMaps,
+		NormalizeLabels:        sorted(ra.normalizeLabels),
+		RoundScale:             ra.roundScale,
+		DropZero:               ra.dropZero,
+		DropZeroCounters:       ra.dropZeroCounters,
+		MaxLabelValueLength:    ra.maxLabelValueLength,
+		MaxOutputSeries:        ra.maxOutputSeries,
+		HandleCounterResets:    ra.counterResets != nil,
+		NativeAsClassic:        ra.nativeAsClassic,
+		AggregationOutputs:     aggregationOutputs,
+		ObserveIntoHistogram:   ra.observeIntoHistogram,
+		WeightBy:               ra.weightBy,
+		AddPrefix:              ra.addPrefix,
+		MetricPrefixes:         ra.metricPrefixes,
+		AddLabels:              ra.addLabels,
+		StampScrapeTime:        ra.stampScrapeTime,
+		HonorTimestamps:        ra.honorTimestamps,
+		ExemplarSelection:      ra.exemplarSelection,
+		DedupInput:             ra.dedupInput,
+		SeriesCount:            ra.seriesCount,
+		MergeDuplicates:        ra.mergeDuplicates,
+	})
+	if err != nil {
+		// all values are plain data so this can't happen
+		panic(err)
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// matcherStrings returns the matchers as label=value pairs
+func matcherStrings(matchers []labelMatcher) []string {
+	var pairs []string
+	for _, m := range matchers {
+		pairs = append(pairs, m.name+"="+m.value)
+	}
+	return pairs
+}
+
+// collectorsConfigHash returns the config hash of all collectors, which is
+// the config hash of the collector if there is only one. The order of the
+// collectors is not significant.
+func collectorsConfigHash(collectors []*RemoteAggregator) string {
+	if len(collectors) == 1 {
+		return collectors[0].configHash()
+	}
+
+	var hashes []string
+	for _, collector := range collectors {
+		hashes = append(hashes, collector.configHash())
+	}
+	slices.Sort(hashes)
+
+	sum := sha256.Sum256([]byte(strings.Join(hashes, ",")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// setConfigHash exports hash as the current config hash
+func setConfigHash(hash string) {
+	configHashGauge.Reset()
+	configHashGauge.WithLabelValues(hash).Set(1)
+}
+
+// parseAddLabels returns the labels of the given label=value pairs, the value
+// is everything after the first = and pairs without = are ignored
+func parseAddLabels(pairs []string) map[string]string {
+	labels := make(map[string]string)
+	for _, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) == 2 {
+			labels[kv[0]] = kv[1]
 		}
+	}
+	return labels
+}
 
-		if err != nil {
-			log.Error("error creating Prometheus metric", "err", err)
+// parseLabelMatchers returns the matchers of the given label=value pairs, the
+// value is everything after the first =
+func parseLabelMatchers(pairs []string) ([]labelMatcher, error) {
+	var matchers []labelMatcher
+	for _, pair := range pairs {
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid label=value pair %q", pair)
+		}
+		matchers = append(matchers, labelMatcher{name: name, value: value})
+	}
+	return matchers, nil
+}
+
+// parseHeaders returns the headers of the given 'Name: value' entries, the
+// values of repeated names are all kept
+func parseHeaders(entries []string) (http.Header, error) {
+	headers := make(http.Header)
+	for _, entry := range entries {
+		name, value, ok := strings.Cut(entry, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("invalid 'Name: value' header %q", entry)
+		}
+		headers.Add(name, strings.TrimSpace(value))
+	}
+	return headers, nil
+}
+
+// parseAddPrefix returns the prefix of all metrics and the prefixes of single
+// metrics of the given prefix and metric=prefix entries, at most one entry can
+// be a plain prefix
+func parseAddPrefix(entries []string) (string, map[string]string, error) {
+	var prefix string
+	metricPrefixes := make(map[string]string)
+	for _, entry := range entries {
+		metric, metricPrefix, ok := strings.Cut(entry, "=")
+		if !ok {
+			if prefix != "" {
+				return "", nil, fmt.Errorf("more than one prefix of all metrics %q", entry)
+			}
+			prefix = entry
 			continue
 		}
+		if metric == "" || metricPrefix == "" {
+			return "", nil, fmt.Errorf("invalid metric=prefix entry %q", entry)
+		}
+		if _, ok := metricPrefixes[metric]; ok {
+			return "", nil, fmt.Errorf("more than one prefix of metric %q", metric)
+		}
+		metricPrefixes[metric] = metricPrefix
+	}
+	return prefix, metricPrefixes, nil
+}
 
-		ch <- prometheus.NewMetricWithTimestamp(ct, promMetric)
+// parseRenameLabels returns the new label names of the given old=new pairs,
+// each label can only be renamed once and to a name no other label is renamed
+// to
+func parseRenameLabels(pairs []string) (map[string]string, error) {
+	renames := make(map[string]string)
+	seen := make(map[string]bool)
+	for _, pair := range pairs {
+		old, name, ok := strings.Cut(pair, "=")
+		if !ok || old == "" || name == "" {
+			return nil, fmt.Errorf("invalid old=new pair %q", pair)
+		}
+		if _, ok := renames[old]; ok {
+			return nil, fmt.Errorf("label %q renamed more than once", old)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("more than one label renamed to %q", name)
+		}
+		renames[old] = name
+		seen[name] = true
 	}
+	return renames, nil
 }
 
-// aggregateMetrics returns aggregated values and label pairs map on same key
-func aggregateMetrics(metrics []*dto.Metric, aggregateWithOutLabels []string) (map[string]map[string]string, map[string]float64) {
-	aggregatedValue := make(map[string]float64)
-	aggregatedLabels := make(map[string]map[string]string)
+// parseRenameMetrics returns the new metric family names of the given old=new
+// pairs, each family can only be renamed once. Several families may be renamed
+// to the same name to merge them.
+func parseRenameMetrics(pairs []string) (map[string]string, error) {
+	renames := make(map[string]string)
+	for _, pair := range pairs {
+		old, name, ok := strings.Cut(pair, "=")
+		if !ok || old == "" || name == "" {
+			return nil, fmt.Errorf("invalid old=new pair %q", pair)
+		}
+		if _, ok := renames[old]; ok {
+			return nil, fmt.Errorf("metric %q renamed more than once", old)
+		}
+		renames[old] = name
+	}
+	return renames, nil
+}
 
-	for _, metric := range metrics {
+// parseAggregationOutputs groups the labels of the given suffix=label pairs
+// by suffix, in the order the suffixes are first listed
+func parseAggregationOutputs(pairs []string) ([]aggregationOutput, error) {
+	var outputs []aggregationOutput
+	for _, pair := range pairs {
+		suffix, label, ok := strings.Cut(pair, "=")
+		if !ok || suffix == "" || label == "" {
+			return nil, fmt.Errorf("invalid suffix=label pair %q", pair)
+		}
+		i := slices.IndexFunc(outputs, func(o aggregationOutput) bool { return o.suffix == suffix })
+		if i < 0 {
+			outputs = append(outputs, aggregationOutput{suffix: suffix})
+			i = len(outputs) - 1
+		}
+		outputs[i].aggregateWithOutLabels = append(outputs[i].aggregateWithOutLabels, label)
+	}
+	return outputs, nil
+}
 
-		var key string
-		filteredLabels := make(map[string]string)
+// mapLabelValue returns the canonical value of the given raw label value
+func mapLabelValue(valueMap map[string]string, value string) string {
+	if canonical, ok := valueMap[value]; ok {
+		return canonical
+	}
+	if canonical, ok := valueMap["*"]; ok {
+		return canonical
+	}
+	return value
+}
 
-		for _, label := range metric.Label {
-			if !slices.Contains(aggregateWithOutLabels, label.GetName()) {
-				filteredLabels[label.GetName()] = label.GetValue()
-				key += label.GetName() + "=" + label.GetValue() + ","
-			}
+// parseLabelValueMaps reads the value map files of the given label=file pairs
+func parseLabelValueMaps(pairs []string) (map[string]map[string]string, error) {
+	labelValueMaps := make(map[string]map[string]string)
+	for _, pair := range pairs {
+		label, file, ok := strings.Cut(pair, "=")
+		if !ok || label == "" || file == "" {
+			return nil, fmt.Errorf("invalid label=file pair %q", pair)
+		}
+		valueMap, err := readLabelValueMap(file)
+		if err != nil {
+			return nil, err
+		}
+		labelValueMaps[label] = valueMap
+	}
+	return labelValueMaps, nil
+}
+
+// readLabelValueMap reads raw=canonical pairs from the file, empty lines and
+// lines starting with '#' are ignored
+func readLabelValueMap(file string) (map[string]string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading label value map %w", err)
+	}
+
+	valueMap := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		raw, canonical, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid raw=canonical pair at %s:%d", file, i+1)
 		}
+		valueMap[strings.TrimSpace(raw)] = strings.TrimSpace(canonical)
+	}
+	return valueMap, nil
+}
 
-		aggregatedLabels[key] = filteredLabels
+// parseMetricTypes converts metric type names into their dto.MetricType
+func parseMetricTypes(names []string) ([]dto.MetricType, error) {
+	var types []dto.MetricType
+	for _, name := range names {
+		value, ok := dto.MetricType_value[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown metric type %q", name)
+		}
+		types = append(types, dto.MetricType(value))
+	}
+	return types, nil
+}
 
-		if metric.GetGauge() != nil {
-			aggregatedValue[key] += metric.GetGauge().GetValue()
-		} else if metric.GetCounter() != nil {
-			aggregatedValue[key] += metric.GetCounter().GetValue()
+// parseForceTypes returns the types of the given metric=type pairs, which
+// must be counter, gauge or untyped
+func parseForceTypes(pairs []string) (map[string]dto.MetricType, error) {
+	types := make(map[string]dto.MetricType)
+	for _, pair := range pairs {
+		name, typeName, ok := strings.Cut(pair, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid metric=type pair %q", pair)
+		}
+		parsed, err := parseMetricTypes([]string{typeName})
+		if err != nil {
+			return nil, err
+		}
+		if !isValueType(parsed[0]) {
+			return nil, fmt.Errorf("metric type %q can't be forced, must be counter, gauge or untyped", typeName)
 		}
+		types[name] = parsed[0]
+	}
+	return types, nil
+}
+
+// newLogger returns a logger writing to stderr at the given level in the text
+// or json format
+func newLogger(level, format string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	}
+	return nil, fmt.Errorf("invalid log format %q, must be text or json", format)
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
 	}
-	return aggregatedLabels, aggregatedValue
+	return 0
+}
+
+// runtimeMetricsPrefix prefixes the Go runtime and process metrics of the
+// aggregator, as targets commonly export go_* and process_* families too
+const runtimeMetricsPrefix = "metrics_aggregator_"
+
+// registerRuntimeMetrics registers the collectors of the Go runtime and
+// process metrics with reg, prefixed with runtimeMetricsPrefix
+func registerRuntimeMetrics(reg prometheus.Registerer) {
+	prometheus.WrapRegistererWithPrefix(runtimeMetricsPrefix, reg).MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
 }
 
 func updateRunTime(remoteURL string, start time.Time) {
@@ -197,35 +2956,461 @@ func updateRunTime(remoteURL string, start time.Time) {
 
 func main() {
 	cmd := &cli.Command{
-		Name:  "metrics-aggregator",
-		Usage: "ggregate metrics to reduce cardinality by removing labels",
-		Flags: flags,
+		Name:    "metrics-aggregator",
+		Usage:   "ggregate metrics to reduce cardinality by removing labels",
+		Version: version,
+		Flags:   flags,
 		Action: func(ctx context.Context, cmd *cli.Command) error {
+			logger, err := newLogger(cmd.String("log-level"), cmd.String("log-format"))
+			if err != nil {
+				return err
+			}
+			log = logger
+
+			withoutLabels, byLabels := cmd.StringSlice("aggregate-without-label"), cmd.StringSlice("aggregate-by-label")
+			if len(withoutLabels) > 0 && len(byLabels) > 0 {
+				return fmt.Errorf("aggregate-without-label and aggregate-by-label can't be used together")
+			}
+			scheme := cmd.String("target-scheme")
+			if scheme != "http" && scheme != "https" {
+				return fmt.Errorf("invalid target-scheme %q, must be http or https", scheme)
+			}
+			staticTargets := slices.Clone(cmd.StringSlice("target-url"))
+			for _, spec := range cmd.StringSlice("target") {
+				url, err := targetURL(scheme, spec, cmd.String("target-metrics-path"))
+				if err != nil {
+					return fmt.Errorf("invalid target %w", err)
+				}
+				staticTargets = append(staticTargets, url)
+			}
+			if cmd.Bool("require-include-metric-match") && len(cmd.StringSlice("include-metric")) == 0 {
+				return fmt.Errorf("require-include-metric-match requires include-metric")
+			}
+
+			extraPaths := cmd.StringSlice("target-extra-path")
+			for _, path := range extraPaths {
+				if !strings.HasPrefix(path, "/") {
+					return fmt.Errorf("invalid target-extra-path %q, must start with /", path)
+				}
+			}
+			if len(staticTargets) == 0 && cmd.String("targets-file") == "" {
+				return fmt.Errorf("either target-url, target or targets-file is required")
+			}
+			if len(withoutLabels) == 0 && len(byLabels) == 0 && cmd.String("config-file") == "" {
+				return fmt.Errorf("either aggregate-without-label, aggregate-by-label or config-file is required")
+			}
+
+			var honorTimestamps string
+			if cmd.Bool("honor-timestamps") {
+				if cmd.Bool("stamp-scrape-time") {
+					return fmt.Errorf("honor-timestamps and stamp-scrape-time can't be used together")
+				}
+				honorTimestamps = cmd.String("honor-timestamps-aggregation")
+				if honorTimestamps != aggregationMin && honorTimestamps != aggregationMax {
+					return fmt.Errorf("invalid honor-timestamps-aggregation %q, must be min or max", honorTimestamps)
+				}
+			}
+
+			if cmd.Bool("skip-initial-scrape") && cmd.Duration("scrape-interval") == 0 {
+				return fmt.Errorf("skip-initial-scrape requires scrape-interval")
+			}
+			if cmd.Bool("fail-on-initial-scrape-error") && cmd.Duration("scrape-interval") == 0 {
+				return fmt.Errorf("fail-on-initial-scrape-error requires scrape-interval")
+			}
+			if cmd.Bool("skip-initial-scrape") && cmd.Bool("fail-on-initial-scrape-error") {
+				return fmt.Errorf("skip-initial-scrape and fail-on-initial-scrape-error can't be used together")
+			}
+
+			jitter := cmd.Float("scrape-jitter")
+			if jitter < 0 || jitter >= 1 {
+				return fmt.Errorf("invalid scrape-jitter %v, must be in [0, 1)", jitter)
+			}
+
+			fileConfig := newSharedConfig(&config{})
+			if file := cmd.String("config-file"); file != "" {
+				cfg, err := readConfig(file)
+				if err != nil {
+					return fmt.Errorf("invalid config-file %w", err)
+				}
+				fileConfig.Store(cfg)
+			} else if cmd.Bool("enable-reload") {
+				return fmt.Errorf("enable-reload requires config-file")
+			}
+
+			if selection := cmd.String("exemplar"); selection != "" && !slices.Contains(exemplarSelections, selection) {
+				return fmt.Errorf("invalid exemplar %q, must be one of %s", selection, strings.Join(exemplarSelections, ", "))
+			}
+
+			if !slices.Contains(aggregationFunctions, cmd.String("aggregation")) {
+				return fmt.Errorf("invalid aggregation %q, must be one of %s", cmd.String("aggregation"), strings.Join(aggregationFunctions, ", "))
+			}
+
+			includeTypes, err := parseMetricTypes(cmd.StringSlice("include-type"))
+			if err != nil {
+				return fmt.Errorf("invalid include-type %w", err)
+			}
+
+			forceTypes, err := parseForceTypes(cmd.StringSlice("force-type"))
+			if err != nil {
+				return fmt.Errorf("invalid force-type %w", err)
+			}
+
+			labelValueMaps, err := parseLabelValueMaps(cmd.StringSlice("label-value-map"))
+			if err != nil {
+				return fmt.Errorf("invalid label-value-map %w", err)
+			}
+
+			aggregationOutputs, err := parseAggregationOutputs(cmd.StringSlice("aggregation-output"))
+			if err != nil {
+				return fmt.Errorf("invalid aggregation-output %w", err)
+			}
+
+			observeIntoHistogram, err := parseHistogramBuckets(cmd.StringSlice("observe-into-histogram"))
+			if err != nil {
+				return fmt.Errorf("invalid observe-into-histogram %w", err)
+			}
+
+			weightBy, err := parseWeightBy(cmd.StringSlice("weight-by"))
+			if err != nil {
+				return fmt.Errorf("invalid weight-by %w", err)
+			}
+
+			keepIf, err := parseLabelMatchers(cmd.StringSlice("keep-if"))
+			if err != nil {
+				return fmt.Errorf("invalid keep-if %w", err)
+			}
+			dropIf, err := parseLabelMatchers(cmd.StringSlice("drop-if"))
+			if err != nil {
+				return fmt.Errorf("invalid drop-if %w", err)
+			}
+			exemptLabelValues, err := parseLabelMatchers(cmd.StringSlice("exempt-label-value"))
+			if err != nil {
+				return fmt.Errorf("invalid exempt-label-value %w", err)
+			}
+
+			if cmd.Bool("drop-zero-counters") && !cmd.Bool("drop-zero") {
+				return fmt.Errorf("drop-zero-counters requires drop-zero")
+			}
+
+			roundScale, err := roundDecimalsScale(cmd.Int("round-decimals"))
+			if err != nil {
+				return err
+			}
+
+			var scrapeFormat expfmt.Format
+			if name := cmd.String("scrape-format"); name != "" {
+				format, ok := scrapeFormats[name]
+				if !ok {
+					return fmt.Errorf("invalid scrape-format %q, must be text or protobuf", name)
+				}
+				scrapeFormat = format
+			}
+
+			headers, err := parseHeaders(cmd.StringSlice("header"))
+			if err != nil {
+				return fmt.Errorf("invalid header %w", err)
+			}
+
+			addPrefix, metricPrefixes, err := parseAddPrefix(cmd.StringSlice("add-prefix"))
+			if err != nil {
+				return fmt.Errorf("invalid add-prefix %w", err)
+			}
+			if cmd.Bool("keep-original") && cmd.String("original-prefix") == "" && addPrefix == "" {
+				return fmt.Errorf("keep-original requires original-prefix or add-prefix")
+			}
+
+			renames, err := parseRenameLabels(cmd.StringSlice("rename-label"))
+			if err != nil {
+				return fmt.Errorf("invalid rename-label %w", err)
+			}
 
-			collector := &RemoteAggregator{
-				url:                    cmd.String("target-url"),
-				includeMetrics:         cmd.StringSlice("include-metric"),
-				aggregateWithOutLabels: cmd.StringSlice("aggregate-without-label"),
-				addPrefix:              cmd.String("add-prefix"),
-				addLabels:              make(map[string]string),
+			metricRenames, err := parseRenameMetrics(cmd.StringSlice("rename-metric"))
+			if err != nil {
+				return fmt.Errorf("invalid rename-metric %w", err)
 			}
 
-			for _, pair := range cmd.StringSlice("add-labelValue") {
-				kv := strings.Split(pair, "=")
-				if len(kv) == 2 {
-					collector.addLabels[kv[0]] = kv[1]
+			addLabels := parseAddLabels(cmd.StringSlice("add-labelValue"))
+
+			clientCfg := clientConfig{
+				timeout:         cmd.Duration("scrape-timeout"),
+				dnsTimeout:      cmd.Duration("dns-timeout"),
+				maxIdleConns:    cmd.Int("max-idle-conns"),
+				idleConnTimeout: cmd.Duration("idle-conn-timeout"),
+			}
+
+			if address := cmd.String("dns-resolver"); address != "" {
+				clientCfg.resolver = newResolver(address)
+			}
+
+			if raw := cmd.String("proxy-url"); raw != "" {
+				clientCfg.proxyURL, err = parseProxyURL(raw)
+				if err != nil {
+					return fmt.Errorf("invalid proxy-url %w", err)
+				}
+			}
+
+			caFile, certFile, keyFile := cmd.String("tls-ca-file"), cmd.String("tls-cert-file"), cmd.String("tls-key-file")
+			if caFile != "" || certFile != "" || keyFile != "" || cmd.Bool("tls-insecure-skip-verify") {
+				if cmd.String("spiffe-socket") != "" {
+					return fmt.Errorf("TLS flags can't be used together with spiffe-socket")
+				}
+				clientCfg.tlsConfig, err = newTLSConfig(caFile, certFile, keyFile, cmd.Bool("tls-insecure-skip-verify"))
+				if err != nil {
+					return fmt.Errorf("invalid TLS config %w", err)
+				}
+			}
+
+			webCert, webKey, webClientCA := cmd.String("web-tls-cert"), cmd.String("web-tls-key"), cmd.String("web-client-ca")
+			if (webCert == "") != (webKey == "") {
+				return fmt.Errorf("both web-tls-cert and web-tls-key must be set")
+			}
+			if webClientCA != "" && webCert == "" {
+				return fmt.Errorf("web-client-ca requires web-tls-cert")
+			}
+			var webTLSConfig *tls.Config
+			if webCert != "" {
+				webTLSConfig, err = newServerTLSConfig(webClientCA)
+				if err != nil {
+					return fmt.Errorf("invalid web TLS config %w", err)
+				}
+			}
+
+			if socket := cmd.String("spiffe-socket"); socket != "" {
+				source, err := workloadapi.NewX509Source(ctx, workloadapi.WithClientOptions(workloadapi.WithAddr(socket)))
+				if err != nil {
+					return fmt.Errorf("error creating SPIFFE X.509 source %w", err)
+				}
+				defer source.Close()
+
+				clientCfg.tlsConfig = spiffeTLSConfig(source, source)
+			}
+
+			client := newHTTPClient(clientCfg)
+
+			bearerToken := cmd.String("bearer-token") != "" || cmd.String("bearer-token-file") != ""
+			basicAuth := cmd.String("basic-auth-username") != ""
+			if bearerToken && basicAuth {
+				return fmt.Errorf("bearer token and basic auth can't be used together")
+			}
+
+			var auth *requestAuth
+			if bearerToken || basicAuth {
+				auth = &requestAuth{
+					bearerToken:       cmd.String("bearer-token"),
+					basicAuthUsername: cmd.String("basic-auth-username"),
+					basicAuthPassword: cmd.String("basic-auth-password"),
+				}
+				if file := cmd.String("bearer-token-file"); file != "" {
+					auth.bearerTokenFile = &secretFile{path: file, refresh: secretRefreshInterval}
+				}
+				if file := cmd.String("basic-auth-password-file"); file != "" {
+					auth.basicAuthPasswordFile = &secretFile{path: file, refresh: secretRefreshInterval}
+				}
+			}
+
+			ready := &readiness{}
+
+			targetLabel := cmd.String("target-label")
+			if targetLabel != "" && !model.LegacyValidation.IsValidLabelName(targetLabel) {
+				return fmt.Errorf("invalid target-label %q", targetLabel)
+			}
+
+			newCollector := func(url string) *RemoteAggregator {
+				addLabels := addLabels
+				if targetLabel != "" {
+					addLabels = maps.Clone(addLabels)
+					addLabels[targetLabel] = url
+				}
+				collector := &RemoteAggregator{
+					url:                    url,
+					extraPaths:             extraPaths,
+					client:                 client,
+					auth:                   auth,
+					headers:                headers,
+					userAgent:              cmd.String("user-agent"),
+					scrapeFormat:           scrapeFormat,
+					scrapeTimeout:          cmd.Duration("scrape-timeout"),
+					scrapeRetries:          cmd.Int("scrape-retries"),
+					scrapeRetryBackoff:     cmd.Duration("scrape-retry-backoff"),
+					workers:                cmd.Int("workers"),
+					bodyReadTimeout:        cmd.Duration("body-read-timeout"),
+					maxScrapeSize:          int64(cmd.Int("max-scrape-size")),
+					includeMetrics:         cmd.StringSlice("include-metric"),
+					requireIncludeMatch:    cmd.Bool("require-include-metric-match"),
+					excludeMetrics:         cmd.StringSlice("exclude-metric"),
+					passthroughMetrics:     cmd.StringSlice("passthrough-metric"),
+					keepOriginal:           cmd.Bool("keep-original"),
+					originalPrefix:         cmd.String("original-prefix"),
+					includeTypes:           includeTypes,
+					keepIf:                 keepIf,
+					dropIf:                 dropIf,
+					skipNaN:                cmd.Bool("skip-nan"),
+					skipInf:                cmd.Bool("skip-inf"),
+					aggregateWithOutLabels: cmd.StringSlice("aggregate-without-label"),
+					aggregateByLabels:      cmd.StringSlice("aggregate-by-label"),
+					dropLabels:             cmd.StringSlice("drop-label"),
+					outputLabelAllowlist:   cmd.StringSlice("output-label-allowlist"),
+					exemptLabelValues:      exemptLabelValues,
+					forceTypes:             forceTypes,
+					aggregation:            cmd.String("aggregation"),
+					renameLabels:           renames,
+					renameMetrics:          metricRenames,
+					labelValueMaps:         labelValueMaps,
+					normalizeLabels:        cmd.StringSlice("normalize-label-values"),
+					roundScale:             roundScale,
+					dropZero:               cmd.Bool("drop-zero"),
+					dropZeroCounters:       cmd.Bool("drop-zero-counters"),
+					maxLabelValueLength:    cmd.Int("max-label-value-length"),
+					maxOutputSeries:        cmd.Int("max-output-series"),
+					aggregationOutputs:     aggregationOutputs,
+					observeIntoHistogram:   observeIntoHistogram,
+					weightBy:               weightBy,
+					fileConfig:             fileConfig,
+					addPrefix:              addPrefix,
+					metricPrefixes:         metricPrefixes,
+					addLabels:              addLabels,
+					stampScrapeTime:        cmd.Bool("stamp-scrape-time"),
+					honorTimestamps:        honorTimestamps,
+					exemplarSelection:      cmd.String("exemplar"),
+					nativeAsClassic:        cmd.Bool("native-histograms-as-classic"),
+					selfValidate:           cmd.Bool("self-validate"),
+					resultSeries:           cmd.Bool("self-validate"),
+					dedupInput:             cmd.Bool("dedup-input"),
+					seriesCount:            cmd.Bool("series-count"),
+					mergeDuplicates:        cmd.Bool("merge-duplicate-families"),
+					readiness:              ready,
+				}
+
+				if threshold := cmd.Int("breaker-threshold"); threshold > 0 {
+					collector.breaker = &circuitBreaker{
+						threshold: threshold,
+						cooldown:  cmd.Duration("breaker-cooldown"),
+					}
+				}
+				if cmd.Bool("handle-counter-resets") {
+					collector.counterResets = newCounterResets()
+				}
+				return collector
+			}
+
+			targets := &targetSet{
+				newCollector:   newCollector,
+				scrapeInterval: cmd.Duration("scrape-interval"),
+				scrapeJitter:   jitter,
+
+				skipInitialScrape: cmd.Bool("skip-initial-scrape"),
+				failInitialScrape: cmd.Bool("fail-on-initial-scrape-error"),
+			}
+			if file := cmd.String("targets-file"); file != "" {
+				if err := targets.watchTargetsFile(ctx, file, staticTargets, cmd.Duration("targets-file-refresh")); err != nil {
+					return err
+				}
+			} else if err := targets.update(ctx, staticTargets); err != nil {
+				return err
+			}
+
+			var reload func() error
+			if cmd.Bool("enable-reload") {
+				file := cmd.String("config-file")
+				reload = func() error {
+					cfg, err := readConfig(file)
+					if err != nil {
+						log.Error("error reloading config file", "file", file, "err", err)
+						return fmt.Errorf("invalid config-file %w", err)
+					}
+					fileConfig.Store(cfg)
+					setConfigHash(collectorsConfigHash(targets.collectors()))
+					log.Info("reloaded config file", "file", file)
+					return nil
 				}
 			}
 
+			buildInfo.Set(1)
+
 			reg := prometheus.NewPedanticRegistry()
 
-			reg.MustRegister(collector, pcDuration)
+			reg.MustRegister(remoteWriteFailures, otlpExportFailures, pcDuration, phaseDuration, scrapeErrors, partialScrapes, decodeResults, decodedFamilies, nameCollisions, duplicateSeries, counterResetsTotal, truncatedLabelValues, inputSeriesGauge, outputSeriesGauge, outputSeriesLimitExceeded, targetUp, lastScrapeSuccess, selfValidationErrors, dedupSeriesTotal, breakerOpen, configHashGauge, buildInfo, targets)
+			if cmd.Bool("enable-runtime-metrics") {
+				registerRuntimeMetrics(reg)
+			}
+
+			adminAddress := cmd.String("admin-bind-address")
+
+			metricsHandler := newMetricsHandler(reg, cmd.Bool("enable-openmetrics"), cmd.Bool("enable-response-compression"))
+			var webAuth func(http.Handler) http.Handler
+			if cmd.String("web-auth-password-file") != "" && cmd.String("web-auth-user") == "" {
+				return fmt.Errorf("web-auth-password-file requires web-auth-user")
+			}
+			if user := cmd.String("web-auth-user"); user != "" {
+				passwordFile := &secretFile{path: cmd.String("web-auth-password-file"), refresh: secretRefreshInterval}
+				if passwordFile.path == "" {
+					return fmt.Errorf("web-auth-user requires web-auth-password-file")
+				}
+				if _, err := passwordFile.get(time.Now()); err != nil {
+					return fmt.Errorf("invalid web-auth-password-file %w", err)
+				}
+				webAuth = func(next http.Handler) http.Handler {
+					return basicAuthHandler(user, passwordFile, next)
+				}
+			}
+
+			mux, adminMux := newServeMuxes(serverConfig{
+				metricsPath:   cmd.String("metrics-path"),
+				healthPath:    cmd.String("health-path"),
+				readyPath:     cmd.String("ready-path"),
+				proxyPath:     cmd.String("proxy-path"),
+				metadataPath:  cmd.String("metadata-path"),
+				enablePprof:   cmd.Bool("enable-pprof"),
+				separateAdmin: adminAddress != "",
+				reload:        reload,
+				auth:          webAuth,
+			}, metricsHandler, ready, targets.collectors)
+
+			if writeURL := cmd.String("remote-write-url"); writeURL != "" {
+				writer := &remoteWriter{
+					url:     writeURL,
+					client:  &http.Client{Timeout: cmd.Duration("remote-write-timeout")},
+					retries: cmd.Int("remote-write-retries"),
+					backoff: cmd.Duration("scrape-retry-backoff"),
+				}
+				log.Info("pushing metrics with remote write", "url", writeURL, "interval", cmd.Duration("remote-write-interval"))
+				go writer.run(ctx, reg, cmd.Duration("remote-write-interval"))
+			}
+
+			if endpoint := cmd.String("otlp-endpoint"); endpoint != "" {
+				exporter, err := newOTLPExporter(ctx, endpoint, cmd.Duration("otlp-timeout"))
+				if err != nil {
+					return fmt.Errorf("invalid otlp-endpoint %w", err)
+				}
+				log.Info("pushing metrics with OTLP", "endpoint", endpoint, "interval", cmd.Duration("otlp-interval"))
+				go exporter.run(ctx, reg, cmd.Duration("otlp-interval"))
+			}
 
-			log.Info("starting server", "port", cmd.String("metrics-bind-address"), "metrics", cmd.String("metrics-path"))
+			errCh := make(chan error, 2)
 
-			http.Handle(cmd.String("metrics-path"), promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+			// the admin server is served like the metrics server, as it
+			// serves the same protected endpoints
+			if adminAddress != "" {
+				adminServer := &http.Server{Addr: adminAddress, Handler: adminMux, TLSConfig: webTLSConfig}
+				if webCert != "" {
+					log.Info("starting admin TLS server", "port", adminAddress)
+					go func() { errCh <- adminServer.ListenAndServeTLS(webCert, webKey) }()
+				} else {
+					log.Info("starting admin server", "port", adminAddress)
+					go func() { errCh <- adminServer.ListenAndServe() }()
+				}
+			}
+
+			server := &http.Server{Addr: cmd.String("metrics-bind-address"), Handler: mux, TLSConfig: webTLSConfig}
+			if webCert != "" {
+				log.Info("starting TLS server", "port", server.Addr, "metrics", cmd.String("metrics-path"), "client_ca", webClientCA)
+				go func() { errCh <- server.ListenAndServeTLS(webCert, webKey) }()
+			} else {
+				log.Info("starting server", "port", server.Addr, "metrics", cmd.String("metrics-path"))
+				go func() { errCh <- server.ListenAndServe() }()
+			}
 
-			if err := http.ListenAndServe(cmd.String("metrics-bind-address"), nil); err != nil {
+			if err := <-errCh; err != nil {
 				return fmt.Errorf("error starting HTTP server %w", err)
 			}
 
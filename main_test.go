@@ -2,22 +2,49 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"maps"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 func pointer(v string) *string { return &v }
 
+// aggregateValues returns the scalar values of the aggregates
+func aggregateValues(aggregated map[string]*aggregate) map[string]float64 {
+	values := make(map[string]float64, len(aggregated))
+	for key, a := range aggregated {
+		values[key] = a.value
+	}
+	return values
+}
+
 func TestAggregateMetricss(t *testing.T) {
 	metrics := []*dto.Metric{
 		{
@@ -53,68 +80,69 @@ func TestAggregateMetricss(t *testing.T) {
 			"no-matching-labels",
 			[]string{"l4"},
 			map[string]map[string]string{
-				"l1=v1,":             {"l1": "v1"},
-				"l1=v1,l2=v2,":       {"l1": "v1", "l2": "v2"},
-				"l1=v1,l2=v2,l3=v3,": {"l1": "v1", "l2": "v2", "l3": "v3"},
+				"l1\xffv1\xff":                         {"l1": "v1"},
+				"l1\xffv1\xffl2\xffv2\xff":             {"l1": "v1", "l2": "v2"},
+				"l1\xffv1\xffl2\xffv2\xffl3\xffv3\xff": {"l1": "v1", "l2": "v2", "l3": "v3"},
 			},
 			map[string]float64{
-				"l1=v1,":             10,
-				"l1=v1,l2=v2,":       20,
-				"l1=v1,l2=v2,l3=v3,": 30,
+				"l1\xffv1\xff":                         10,
+				"l1\xffv1\xffl2\xffv2\xff":             20,
+				"l1\xffv1\xffl2\xffv2\xffl3\xffv3\xff": 30,
 			},
 		},
 		{
 			"matching-one",
 			[]string{"l3"},
 			map[string]map[string]string{
-				"l1=v1,":       {"l1": "v1"},
-				"l1=v1,l2=v2,": {"l1": "v1", "l2": "v2"},
+				"l1\xffv1\xff":             {"l1": "v1"},
+				"l1\xffv1\xffl2\xffv2\xff": {"l1": "v1", "l2": "v2"},
 			},
 			map[string]float64{
-				"l1=v1,":       10,
-				"l1=v1,l2=v2,": 50,
+				"l1\xffv1\xff":             10,
+				"l1\xffv1\xffl2\xffv2\xff": 50,
 			},
 		},
 		{
 			"matching-two",
 			[]string{"l2"},
 			map[string]map[string]string{
-				"l1=v1,":       {"l1": "v1"},
-				"l1=v1,l3=v3,": {"l1": "v1", "l3": "v3"},
+				"l1\xffv1\xff":             {"l1": "v1"},
+				"l1\xffv1\xffl3\xffv3\xff": {"l1": "v1", "l3": "v3"},
 			},
 			map[string]float64{
-				"l1=v1,":       30,
-				"l1=v1,l3=v3,": 30,
+				"l1\xffv1\xff":             30,
+				"l1\xffv1\xffl3\xffv3\xff": 30,
 			},
 		},
 		{
 			"matching-all",
 			[]string{"l1"},
 			map[string]map[string]string{
-				"":             {},
-				"l2=v2,":       {"l2": "v2"},
-				"l2=v2,l3=v3,": {"l2": "v2", "l3": "v3"},
+				"":                         {},
+				"l2\xffv2\xff":             {"l2": "v2"},
+				"l2\xffv2\xffl3\xffv3\xff": {"l2": "v2", "l3": "v3"},
 			},
 			map[string]float64{
-				"":             10,
-				"l2=v2,":       20,
-				"l2=v2,l3=v3,": 30,
+				"":                         10,
+				"l2\xffv2\xff":             20,
+				"l2\xffv2\xffl3\xffv3\xff": 30,
 			},
 		},
 		{
 			"multiple-labels",
 			[]string{"l2", "l3"},
 			map[string]map[string]string{
-				"l1=v1,": {"l1": "v1"},
+				"l1\xffv1\xff": {"l1": "v1"},
 			},
 			map[string]float64{
-				"l1=v1,": 60,
+				"l1\xffv1\xff": 60,
 			},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			aggregatedLabels, aggregatedValues := aggregateMetrics(metrics, tt.aggregateWithOutLabels)
+			aggregatedLabels, aggregated := aggregateMetrics(metrics, tt.aggregateWithOutLabels, false)
+			aggregatedValues := aggregateValues(aggregated)
 
 			if diff := cmp.Diff(aggregatedLabels, tt.wantAggregatedLabels, cmpopts.IgnoreUnexported(dto.LabelPair{})); diff != "" {
 				t.Errorf("filteredLabels mismatch (-want +got):\n%s", diff)
@@ -128,6 +156,41 @@ func TestAggregateMetricss(t *testing.T) {
 	}
 }
 
+func TestAggregateMetricsHistogram(t *testing.T) {
+	histogram := func(l2 string, count uint64, sum float64, buckets map[float64]uint64) *dto.Metric {
+		h := &dto.Histogram{SampleCount: proto.Uint64(count), SampleSum: proto.Float64(sum)}
+		for _, bound := range slices.Sorted(maps.Keys(buckets)) {
+			h.Bucket = append(h.Bucket, &dto.Bucket{UpperBound: proto.Float64(bound), CumulativeCount: proto.Uint64(buckets[bound])})
+		}
+		return &dto.Metric{
+			Label: []*dto.LabelPair{
+				{Name: pointer("l1"), Value: pointer("v1")},
+				{Name: pointer("l2"), Value: pointer(l2)},
+			},
+			Histogram: h,
+		}
+	}
+	metrics := []*dto.Metric{
+		histogram("a", 4, 2, map[float64]uint64{0.1: 1, 1: 3, math.Inf(+1): 4}),
+		histogram("b", 6, 3, map[float64]uint64{0.5: 2, 1: 5, math.Inf(+1): 6}),
+	}
+
+	_, aggregated := aggregateMetrics(metrics, []string{"l2"}, false)
+
+	got := aggregated["l1\xffv1\xff"]
+	if got == nil {
+		t.Fatalf("missing aggregate for l1=v1")
+	}
+	if got.count != 10 || got.sum != 5 {
+		t.Errorf("count, sum = %v, %v, want 10, 5", got.count, got.sum)
+	}
+	// buckets missing from a series carry its next lower bucket forward
+	wantBuckets := map[float64]uint64{0.1: 1, 0.5: 3, 1: 8}
+	if diff := cmp.Diff(got.buckets, wantBuckets); diff != "" {
+		t.Errorf("buckets mismatch (-want +got):\n%s", diff)
+	}
+}
+
 func Test_Collector(t *testing.T) {
 	log = slog.Default()
 
@@ -145,7 +208,7 @@ component_received_event_bytes_total{l1="v1",l2="v2",l3="v3"} 3000 1735054879000
 `
 
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
 		fmt.Fprintln(w, originalMetrics)
 	}))
 	defer ts.Close()
@@ -258,3 +321,3246 @@ func metricsToText(gathering []*dto.MetricFamily) string {
 	}
 	return out.String()
 }
+
+func Test_CollectorStampScrapeTime(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# TYPE component_received_events_total counter
+component_received_events_total{l1="v1",l2="v2"} 10 1735054883000
+component_received_events_total{l1="v1",l2="v3"} 20 1735054883000
+`)
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{
+		url:                    ts.URL,
+		aggregateWithOutLabels: []string{"l2"},
+		stampScrapeTime:        true,
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	before := time.Now().UnixMilli()
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+	after := time.Now().UnixMilli()
+
+	if len(gathering) != 1 || len(gathering[0].Metric) != 1 {
+		t.Fatalf("unexpected gathering: %v", gathering)
+	}
+	got := gathering[0].Metric[0].GetTimestampMs()
+	if got < before || got > after {
+		t.Errorf("timestamp = %d, want scrape time between %d and %d", got, before, after)
+	}
+}
+
+func Test_CollectorHonorTimestamps(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{l1="v1",l2="v2"} 10 1735054883000
+component_received_events_total{l1="v1",l2="v3"} 20 1735054885000
+component_received_events_total{l1="v4",l2="v2"} 30 1735054884000
+component_received_events_total{l1="v5",l2="v2"} 40
+`)
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		honorTimestamps string
+		want            string
+	}{
+		{
+			"",
+			`# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{l1="v1"} 30 1735054883000
+component_received_events_total{l1="v4"} 30 1735054883000
+component_received_events_total{l1="v5"} 40 1735054883000
+`,
+		},
+		{
+			aggregationMax,
+			`# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{l1="v1"} 30 1735054885000
+component_received_events_total{l1="v4"} 30 1735054884000
+component_received_events_total{l1="v5"} 40
+`,
+		},
+		{
+			aggregationMin,
+			`# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{l1="v1"} 30 1735054883000
+component_received_events_total{l1="v4"} 30 1735054884000
+component_received_events_total{l1="v5"} 40
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run("honor-"+tt.honorTimestamps, func(t *testing.T) {
+			collector := &RemoteAggregator{
+				url:                    ts.URL,
+				aggregateWithOutLabels: []string{"l2"},
+				honorTimestamps:        tt.honorTimestamps,
+			}
+
+			reg := prometheus.NewPedanticRegistry()
+			reg.MustRegister(collector)
+
+			gathering, err := reg.Gather()
+			if err != nil {
+				t.Fatalf("reg.Gather() error = %v", err)
+			}
+
+			if diff := cmp.Diff(metricsToText(gathering), tt.want); diff != "" {
+				t.Errorf("collector output mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_CollectorIncludeType(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# TYPE component_received_events_total counter
+component_received_events_total{l1="v1",l2="v2"} 10 1735054883000
+component_received_events_total{l1="v1",l2="v3"} 20 1735054883000
+# TYPE component_buffer_events gauge
+component_buffer_events{l1="v1",l2="v2"} 5 1735054883000
+component_buffer_events{l1="v1",l2="v3"} 6 1735054883000
+`)
+	}))
+	defer ts.Close()
+
+	includeTypes, err := parseMetricTypes([]string{"counter"})
+	if err != nil {
+		t.Fatalf("parseMetricTypes() error = %v", err)
+	}
+
+	collector := &RemoteAggregator{
+		url:                    ts.URL,
+		includeTypes:           includeTypes,
+		aggregateWithOutLabels: []string{"l2"},
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	want := `# HELP component_received_events_total 
+# TYPE component_received_events_total counter
+component_received_events_total{l1="v1"} 30 1735054883000
+`
+	if diff := cmp.Diff(metricsToText(gathering), want); diff != "" {
+		t.Errorf("collector output mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_CollectorExcludeMetric(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# TYPE component_received_events_total counter
+component_received_events_total{l1="v1",l2="v2"} 10 1735054883000
+# TYPE component_sent_events_total counter
+component_sent_events_total{l1="v1",l2="v2"} 20 1735054883000
+# TYPE component_buffer_events gauge
+component_buffer_events{l1="v1",l2="v2"} 5 1735054883000
+`)
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name           string
+		includeMetrics []string
+		excludeMetrics []string
+		want           []string
+	}{
+		{"exclude", nil, []string{"component_buffer_events"}, []string{"component_received_events_total", "component_sent_events_total"}},
+		// excluding takes precedence over including
+		{"include-and-exclude", []string{"component_received_events_total", "component_buffer_events"}, []string{"component_buffer_events"}, []string{"component_received_events_total"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collector := &RemoteAggregator{
+				url:                    ts.URL,
+				includeMetrics:         tt.includeMetrics,
+				excludeMetrics:         tt.excludeMetrics,
+				aggregateWithOutLabels: []string{"l2"},
+			}
+
+			reg := prometheus.NewPedanticRegistry()
+			reg.MustRegister(collector)
+
+			gathering, err := reg.Gather()
+			if err != nil {
+				t.Fatalf("reg.Gather() error = %v", err)
+			}
+
+			var got []string
+			for _, family := range gathering {
+				got = append(got, family.GetName())
+			}
+			if diff := cmp.Diff(got, tt.want); diff != "" {
+				t.Errorf("exported families mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseMetricTypes(t *testing.T) {
+	got, err := parseMetricTypes([]string{"counter", "Gauge", "HISTOGRAM"})
+	if err != nil {
+		t.Fatalf("parseMetricTypes() error = %v", err)
+	}
+	want := []dto.MetricType{dto.MetricType_COUNTER, dto.MetricType_GAUGE, dto.MetricType_HISTOGRAM}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("parseMetricTypes() mismatch (-want +got):\n%s", diff)
+	}
+
+	if _, err := parseMetricTypes([]string{"counters"}); err == nil {
+		t.Errorf("parseMetricTypes() expected error for unknown type")
+	}
+}
+
+func Test_CollectorLastResult(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{l1="v1",l2="v2"} 10 1735054883000
+component_received_events_total{l1="v1",l2="v3"} 20 1735054883000
+component_received_events_total{l1="v2",l2="v3"} 30 1735054883000
+# HELP component_buffer_events component_buffer_events
+# TYPE component_buffer_events gauge
+component_buffer_events{l1="v1",l2="v2"} 5 1735054883000
+component_buffer_events{l1="v1",l2="v3"} 6 1735054883000
+`)
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{
+		url:                    ts.URL,
+		aggregateWithOutLabels: []string{"l2"},
+		resultSeries:           true,
+	}
+
+	if got := collector.LastResult(); len(got) != 0 {
+		t.Errorf("LastResult() before collection = %v, want empty", got)
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	got := collector.LastResult()
+	// registry sorts families by name
+	slices.SortFunc(got, func(a, b *dto.MetricFamily) int { return strings.Compare(a.GetName(), b.GetName()) })
+
+	if diff := cmp.Diff(metricsToText(got), metricsToText(gathering)); diff != "" {
+		t.Errorf("LastResult() mismatch (-want +got):\n%s", diff)
+	}
+
+	// modifying the snapshot must not affect the collector
+	got[0].Name = proto.String("modified")
+	if name := collector.LastResult()[0].GetName(); name == "modified" {
+		t.Errorf("LastResult() returned a shared reference")
+	}
+}
+
+func Test_CollectorLastResultMetadata(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{l1="v1",l2="v2"} 10 1735054883000
+component_received_events_total{l1="v1",l2="v3"} 20 1735054883000
+`)
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{
+		url:                    ts.URL,
+		aggregateWithOutLabels: []string{"l2"},
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	if _, err := reg.Gather(); err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	// without resultSeries only the metadata of the families is kept
+	got := collector.LastResult()
+	if len(got) != 1 || got[0].GetName() != "component_received_events_total" || got[0].GetType() != dto.MetricType_COUNTER {
+		t.Fatalf("LastResult() = %v, want the component_received_events_total counter", got)
+	}
+	if len(got[0].Metric) != 0 {
+		t.Errorf("LastResult() series = %v, want none", got[0].Metric)
+	}
+	if got := testutil.ToFloat64(outputSeriesGauge.WithLabelValues(ts.URL)); got != 1 {
+		t.Errorf("output series = %v, want 1", got)
+	}
+}
+
+func TestRelabelSeriesLabelValueMap(t *testing.T) {
+	newMetrics := func() []*dto.Metric {
+		var metrics []*dto.Metric
+		hosts := []string{"host-a.dc1", "host-b.dc1", "host-c.dc2", "unknown"}
+		values := []float64{1, 2, 4, 8}
+		for i, host := range hosts {
+			metrics = append(metrics, &dto.Metric{
+				Label: []*dto.LabelPair{
+					{Name: pointer("host"), Value: pointer(host)},
+				},
+				Gauge: &dto.Gauge{Value: proto.Float64(values[i])},
+			})
+		}
+		return metrics
+	}
+
+	mapFile := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(mapFile, []byte(`# hostname to datacenter
+host-a.dc1=dc1
+host-b.dc1=dc1
+
+host-c.dc2 = dc2
+`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	labelValueMaps, err := parseLabelValueMaps([]string{"host=" + mapFile})
+	if err != nil {
+		t.Fatalf("parseLabelValueMaps() error = %v", err)
+	}
+
+	ra := &RemoteAggregator{labelValueMaps: labelValueMaps}
+	metrics := newMetrics()
+	ra.relabelSeries(metrics)
+	aggregatedLabels, aggregated := aggregateMetrics(metrics, nil, false)
+	aggregatedValues := aggregateValues(aggregated)
+
+	wantAggregatedLabels := map[string]map[string]string{
+		"host\xffdc1\xff":     {"host": "dc1"},
+		"host\xffdc2\xff":     {"host": "dc2"},
+		"host\xffunknown\xff": {"host": "unknown"},
+	}
+	if diff := cmp.Diff(aggregatedLabels, wantAggregatedLabels); diff != "" {
+		t.Errorf("aggregatedLabels mismatch (-want +got):\n%s", diff)
+	}
+
+	wantAggregatedValues := map[string]float64{
+		"host\xffdc1\xff":     3,
+		"host\xffdc2\xff":     4,
+		"host\xffunknown\xff": 8,
+	}
+	if diff := cmp.Diff(aggregatedValues, wantAggregatedValues); diff != "" {
+		t.Errorf("aggregatedValues mismatch (-want +got):\n%s", diff)
+	}
+
+	// unmapped values fold into the default value
+	labelValueMaps["host"]["*"] = "other"
+	metrics = newMetrics()
+	ra.relabelSeries(metrics)
+	_, aggregated = aggregateMetrics(metrics, nil, false)
+	aggregatedValues = aggregateValues(aggregated)
+	if got := aggregatedValues["host\xffother\xff"]; got != 8 {
+		t.Errorf("aggregatedValues[host=other] = %v, want 8", got)
+	}
+}
+
+func TestRelabelSeriesNormalizeLabelValues(t *testing.T) {
+	var metrics []*dto.Metric
+	values := []float64{1, 2, 4, 8}
+	for i, method := range []string{"get", "GET", "Post", "POST"} {
+		metrics = append(metrics, &dto.Metric{
+			Label: []*dto.LabelPair{
+				{Name: pointer("method"), Value: pointer(method)},
+				{Name: pointer("path"), Value: pointer(strings.ToUpper(method))},
+			},
+			Gauge: &dto.Gauge{Value: proto.Float64(values[i])},
+		})
+	}
+
+	ra := &RemoteAggregator{normalizeLabels: []string{"method"}}
+	ra.relabelSeries(metrics)
+	aggregatedLabels, aggregated := aggregateMetrics(metrics, []string{"path"}, false)
+
+	// the first seen value is exported
+	wantAggregatedLabels := map[string]map[string]string{
+		"method\xffget\xff":  {"method": "get"},
+		"method\xffPost\xff": {"method": "Post"},
+	}
+	if diff := cmp.Diff(aggregatedLabels, wantAggregatedLabels); diff != "" {
+		t.Errorf("aggregatedLabels mismatch (-want +got):\n%s", diff)
+	}
+	wantAggregatedValues := map[string]float64{
+		"method\xffget\xff":  3,
+		"method\xffPost\xff": 12,
+	}
+	if diff := cmp.Diff(aggregateValues(aggregated), wantAggregatedValues); diff != "" {
+		t.Errorf("aggregatedValues mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_CollectorPipelineOrder(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{host="host-a",env="dev",pod="p1"} 1 1735054883000
+component_received_events_total{host="host-b",env="prod",pod="p2"} 2 1735054883000
+component_received_events_total{host="host-c",env="prod",pod="p3"} 4 1735054883000
+# HELP component_dropped_events_total component_dropped_events_total
+# TYPE component_dropped_events_total counter
+component_dropped_events_total{host="host-a",env="dev",pod="p1"} 1 1735054883000
+`)
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{
+		url: ts.URL,
+		// filtering runs on the name before it's prefixed
+		includeMetrics: []string{"component_received_events_total"},
+		// value mapping runs before the key is built, so mapped values merge
+		labelValueMaps: map[string]map[string]string{"host": {"host-a": "dc1", "host-b": "dc1", "*": "dc2"}},
+		// constant labels are set before the key is built, so overridden
+		// values merge instead of producing duplicate series
+		addLabels:              map[string]string{"env": "all", "cluster": "c1"},
+		aggregateWithOutLabels: []string{"pod"},
+		aggregationOutputs:     []aggregationOutput{{suffix: "_by_cluster", aggregateWithOutLabels: []string{"pod", "host"}}},
+		addPrefix:              "agg_",
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	want := `# HELP agg_component_received_events_total component_received_events_total
+# TYPE agg_component_received_events_total counter
+agg_component_received_events_total{cluster="c1",env="all",host="dc1"} 3 1735054883000
+agg_component_received_events_total{cluster="c1",env="all",host="dc2"} 4 1735054883000
+# HELP agg_component_received_events_total_by_cluster component_received_events_total
+# TYPE agg_component_received_events_total_by_cluster counter
+agg_component_received_events_total_by_cluster{cluster="c1",env="all"} 7 1735054883000
+`
+	if diff := cmp.Diff(metricsToText(gathering), want); diff != "" {
+		t.Errorf("collector output mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_CollectorBodyReadTimeout(t *testing.T) {
+	log = slog.Default()
+
+	tests := []struct {
+		name    string
+		stall   time.Duration
+		wantLen int
+	}{
+		{"progressing", 10 * time.Millisecond, 2},
+		{"stalled", 500 * time.Millisecond, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for _, line := range []string{
+					"# TYPE component_received_events_total counter\n",
+					"component_received_events_total{l1=\"v1\"} 10\n",
+					"# TYPE component_buffer_events gauge\n",
+					"component_buffer_events{l1=\"v1\"} 5\n",
+				} {
+					fmt.Fprint(w, line)
+					w.(http.Flusher).Flush()
+					select {
+					case <-r.Context().Done():
+						return
+					case <-time.After(tt.stall):
+					}
+				}
+			}))
+			defer ts.Close()
+
+			collector := &RemoteAggregator{
+				url:             ts.URL,
+				bodyReadTimeout: 200 * time.Millisecond,
+			}
+
+			reg := prometheus.NewPedanticRegistry()
+			reg.MustRegister(collector)
+
+			start := time.Now()
+			gathering, err := reg.Gather()
+			if err != nil {
+				t.Fatalf("reg.Gather() error = %v", err)
+			}
+
+			if len(gathering) != tt.wantLen {
+				t.Errorf("got %d metric families, want %d", len(gathering), tt.wantLen)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("scrape took %s, expected to be aborted by body read timeout", elapsed)
+			}
+		})
+	}
+}
+
+func Test_CollectorScrapeTimeout(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{
+		url:           ts.URL,
+		scrapeTimeout: 100 * time.Millisecond,
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	start := time.Now()
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	if len(gathering) != 0 {
+		t.Errorf("got %d metric families, want 0", len(gathering))
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("scrape took %s, expected to be aborted by scrape timeout", elapsed)
+	}
+}
+
+func Test_CollectorScrapeTimeoutWhileDecoding(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		format := expfmt.NewFormat(expfmt.TypeProtoDelim)
+		w.Header().Set("Content-Type", string(format))
+		family := &dto.MetricFamily{
+			Name:   pointer("component_received_events_total"),
+			Type:   dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{{Counter: &dto.Counter{Value: proto.Float64(10)}}},
+		}
+		if err := expfmt.NewEncoder(w, format).Encode(family); err != nil {
+			t.Error(err)
+		}
+		w.(http.Flusher).Flush()
+		// the remaining families are never sent
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{
+		url:           ts.URL,
+		scrapeTimeout: 100 * time.Millisecond,
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	before := testutil.ToFloat64(scrapeErrors.WithLabelValues(ts.URL, "timeout"))
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	// the family decoded before the deadline isn't sent
+	if len(gathering) != 0 {
+		t.Errorf("got %d metric families, want 0", len(gathering))
+	}
+	if got := testutil.ToFloat64(scrapeErrors.WithLabelValues(ts.URL, "timeout")) - before; got != 1 {
+		t.Errorf("timeout scrape errors = %v, want 1", got)
+	}
+	if got := collector.LastResult(); len(got) != 0 {
+		t.Errorf("LastResult() = %v, want empty", got)
+	}
+}
+
+func TestConfigHash(t *testing.T) {
+	newAggregator := func() *RemoteAggregator {
+		return &RemoteAggregator{
+			url:                    "http://localhost:8080/metrics",
+			includeMetrics:         []string{"m1", "m2"},
+			aggregateWithOutLabels: []string{"l1", "l2"},
+			labelValueMaps:         map[string]map[string]string{"host": {"a": "dc1", "b": "dc1"}},
+			addLabels:              map[string]string{"k1": "v1", "k2": "v2"},
+		}
+	}
+
+	hash := newAggregator().configHash()
+
+	if got := newAggregator().configHash(); got != hash {
+		t.Errorf("configHash() of identical config = %s, want %s", got, hash)
+	}
+
+	reordered := newAggregator()
+	reordered.includeMetrics = []string{"m2", "m1"}
+	reordered.aggregateWithOutLabels = []string{"l2", "l1"}
+	if got := reordered.configHash(); got != hash {
+		t.Errorf("configHash() of reordered config = %s, want %s", got, hash)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(ra *RemoteAggregator)
+	}{
+		{"url", func(ra *RemoteAggregator) { ra.url = "http://localhost:8081/metrics" }},
+		{"scrape-timeout", func(ra *RemoteAggregator) { ra.scrapeTimeout = time.Second }},
+		{"include-metric", func(ra *RemoteAggregator) { ra.includeMetrics = []string{"m1"} }},
+		{"exclude-metric", func(ra *RemoteAggregator) { ra.excludeMetrics = []string{"m1"} }},
+		{"aggregate-without-label", func(ra *RemoteAggregator) { ra.aggregateWithOutLabels = []string{"l1", "l3"} }},
+		{"aggregate-by-label", func(ra *RemoteAggregator) { ra.aggregateByLabels = []string{"l1"} }},
+		{"aggregation", func(ra *RemoteAggregator) { ra.aggregation = aggregationAvg }},
+		{"label-value-map", func(ra *RemoteAggregator) { ra.labelValueMaps["host"]["b"] = "dc2" }},
+		{"add-prefix", func(ra *RemoteAggregator) { ra.addPrefix = "agg_" }},
+		{"add-labelValue", func(ra *RemoteAggregator) { ra.addLabels["k2"] = "v3" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ra := newAggregator()
+			tt.modify(ra)
+			if got := ra.configHash(); got == hash {
+				t.Errorf("configHash() = %s, expected change after modifying %s", got, tt.name)
+			}
+		})
+	}
+}
+
+func Test_CollectorAggregationOutputs(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{l1="v1",l2="v2",l3="v3"} 10 1735054883000
+component_received_events_total{l1="v1",l2="v2",l3="v4"} 20 1735054883000
+component_received_events_total{l1="v1",l2="v5",l3="v3"} 30 1735054883000
+`)
+	}))
+	defer ts.Close()
+
+	aggregationOutputs, err := parseAggregationOutputs([]string{"_by_l1=l2", "_by_l1=l3"})
+	if err != nil {
+		t.Fatalf("parseAggregationOutputs() error = %v", err)
+	}
+
+	collector := &RemoteAggregator{
+		url:                    ts.URL,
+		aggregateWithOutLabels: []string{"l3"},
+		aggregationOutputs:     aggregationOutputs,
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	want := `# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{l1="v1",l2="v2"} 30 1735054883000
+component_received_events_total{l1="v1",l2="v5"} 30 1735054883000
+# HELP component_received_events_total_by_l1 component_received_events_total
+# TYPE component_received_events_total_by_l1 counter
+component_received_events_total_by_l1{l1="v1"} 60 1735054883000
+`
+	if diff := cmp.Diff(metricsToText(gathering), want); diff != "" {
+		t.Errorf("collector output mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_CollectorAggregateBy(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{l1="v1",l2="v2",l3="v3"} 10 1735054883000
+component_received_events_total{l1="v1",l2="v2",l3="v4"} 20 1735054883000
+component_received_events_total{l1="v1",l2="v5"} 30 1735054883000
+component_received_events_total{l1="v6",l3="v3"} 40 1735054883000
+`)
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{
+		url:               ts.URL,
+		aggregateByLabels: []string{"l1"},
+		addLabels:         map[string]string{"env": "prod"},
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	want := `# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{env="prod",l1="v1"} 60 1735054883000
+component_received_events_total{env="prod",l1="v6"} 40 1735054883000
+`
+	if diff := cmp.Diff(metricsToText(gathering), want); diff != "" {
+		t.Errorf("collector output mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_CollectorAggregation(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP component_cpu_usage component_cpu_usage
+# TYPE component_cpu_usage gauge
+component_cpu_usage{l1="v1",l2="v2"} 1 1735054883000
+component_cpu_usage{l1="v1",l2="v3"} 4 1735054883000
+component_cpu_usage{l1="v1",l2="v4"} 7 1735054883000
+# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{l1="v1",l2="v2"} 10 1735054883000
+component_received_events_total{l1="v1",l2="v3"} 20 1735054883000
+`)
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		aggregation string
+		want        string
+	}{
+		{
+			aggregationSum,
+			`# HELP component_cpu_usage component_cpu_usage
+# TYPE component_cpu_usage gauge
+component_cpu_usage{l1="v1"} 12 1735054883000
+# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{l1="v1"} 30 1735054883000
+`,
+		},
+		{
+			aggregationAvg,
+			`# HELP component_cpu_usage component_cpu_usage
+# TYPE component_cpu_usage gauge
+component_cpu_usage{l1="v1"} 4 1735054883000
+# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{l1="v1"} 15 1735054883000
+`,
+		},
+		{
+			aggregationMin,
+			`# HELP component_cpu_usage component_cpu_usage
+# TYPE component_cpu_usage gauge
+component_cpu_usage{l1="v1"} 1 1735054883000
+# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{l1="v1"} 10 1735054883000
+`,
+		},
+		{
+			aggregationMax,
+			`# HELP component_cpu_usage component_cpu_usage
+# TYPE component_cpu_usage gauge
+component_cpu_usage{l1="v1"} 7 1735054883000
+# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{l1="v1"} 20 1735054883000
+`,
+		},
+		{
+			aggregationCount,
+			`# HELP component_cpu_usage component_cpu_usage
+# TYPE component_cpu_usage gauge
+component_cpu_usage{l1="v1"} 3 1735054883000
+# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total gauge
+component_received_events_total{l1="v1"} 2 1735054883000
+`,
+		},
+		{
+			aggregationPresent,
+			`# HELP component_cpu_usage component_cpu_usage
+# TYPE component_cpu_usage gauge
+component_cpu_usage{l1="v1"} 1 1735054883000
+# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total gauge
+component_received_events_total{l1="v1"} 1 1735054883000
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.aggregation, func(t *testing.T) {
+			collector := &RemoteAggregator{
+				url:                    ts.URL,
+				aggregateWithOutLabels: []string{"l2"},
+				aggregation:            tt.aggregation,
+			}
+
+			reg := prometheus.NewPedanticRegistry()
+			reg.MustRegister(collector)
+
+			gathering, err := reg.Gather()
+			if err != nil {
+				t.Fatalf("reg.Gather() error = %v", err)
+			}
+
+			if diff := cmp.Diff(metricsToText(gathering), tt.want); diff != "" {
+				t.Errorf("collector output mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseAddLabels(t *testing.T) {
+	got := parseAddLabels([]string{"env=prod", "region=eu=west", "query=a=b", "invalid"})
+
+	want := map[string]string{
+		"env":    "prod",
+		"region": "eu=west",
+		"query":  "a=b",
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("parseAddLabels() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseAggregationOutputs(t *testing.T) {
+	got, err := parseAggregationOutputs([]string{"_coarse=l1", "_fine=l1", "_coarse=l2"})
+	if err != nil {
+		t.Fatalf("parseAggregationOutputs() error = %v", err)
+	}
+	want := []aggregationOutput{
+		{suffix: "_coarse", aggregateWithOutLabels: []string{"l1", "l2"}},
+		{suffix: "_fine", aggregateWithOutLabels: []string{"l1"}},
+	}
+	if diff := cmp.Diff(got, want, cmp.AllowUnexported(aggregationOutput{})); diff != "" {
+		t.Errorf("parseAggregationOutputs() mismatch (-want +got):\n%s", diff)
+	}
+
+	if _, err := parseAggregationOutputs([]string{"_coarse"}); err == nil {
+		t.Errorf("parseAggregationOutputs() expected error for missing label")
+	}
+}
+
+func Test_CollectorDedupInput(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{l1="v1",l2="v2"} 10 1735054883000
+component_received_events_total{l1="v1",l2="v2"} 10 1735054883000
+component_received_events_total{l2="v2",l1="v1"} 10 1735054883000
+component_received_events_total{l1="v1",l2="v3"} 20 1735054883000
+component_received_events_total{l1="v1",l2="v4"} 20 1735054883000
+`)
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name       string
+		dedupInput bool
+		want       string
+	}{
+		{
+			"without-dedup",
+			false,
+			`# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{l1="v1"} 70 1735054883000
+`,
+		},
+		{
+			"with-dedup",
+			true,
+			`# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{l1="v1"} 50 1735054883000
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collector := &RemoteAggregator{
+				url:                    ts.URL,
+				aggregateWithOutLabels: []string{"l2"},
+				dedupInput:             tt.dedupInput,
+			}
+
+			reg := prometheus.NewPedanticRegistry()
+			reg.MustRegister(collector)
+
+			gathering, err := reg.Gather()
+			if err != nil {
+				t.Fatalf("reg.Gather() error = %v", err)
+			}
+
+			if diff := cmp.Diff(metricsToText(gathering), tt.want); diff != "" {
+				t.Errorf("collector output mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	if got := testutil.ToFloat64(dedupSeriesTotal.WithLabelValues(ts.URL)); got != 2 {
+		t.Errorf("deduplicated series = %v, want 2", got)
+	}
+}
+
+func Test_CollectorHistogram(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP http_request_duration_seconds http_request_duration_seconds
+# TYPE http_request_duration_seconds histogram
+http_request_duration_seconds_bucket{l1="v1",l2="v2",le="0.1"} 1 1735054883000
+http_request_duration_seconds_bucket{l1="v1",l2="v2",le="1"} 3 1735054883000
+http_request_duration_seconds_bucket{l1="v1",l2="v2",le="+Inf"} 4 1735054883000
+http_request_duration_seconds_sum{l1="v1",l2="v2"} 2 1735054883000
+http_request_duration_seconds_count{l1="v1",l2="v2"} 4 1735054883000
+http_request_duration_seconds_bucket{l1="v1",l2="v3",le="0.5"} 2 1735054883000
+http_request_duration_seconds_bucket{l1="v1",l2="v3",le="1"} 5 1735054883000
+http_request_duration_seconds_bucket{l1="v1",l2="v3",le="+Inf"} 6 1735054883000
+http_request_duration_seconds_sum{l1="v1",l2="v3"} 3 1735054883000
+http_request_duration_seconds_count{l1="v1",l2="v3"} 6 1735054883000
+`)
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{
+		url:                    ts.URL,
+		aggregateWithOutLabels: []string{"l2"},
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	want := `# HELP http_request_duration_seconds http_request_duration_seconds
+# TYPE http_request_duration_seconds histogram
+http_request_duration_seconds_bucket{l1="v1",le="0.1"} 1 1735054883000
+http_request_duration_seconds_bucket{l1="v1",le="0.5"} 3 1735054883000
+http_request_duration_seconds_bucket{l1="v1",le="1"} 8 1735054883000
+http_request_duration_seconds_bucket{l1="v1",le="+Inf"} 10 1735054883000
+http_request_duration_seconds_sum{l1="v1"} 5 1735054883000
+http_request_duration_seconds_count{l1="v1"} 10 1735054883000
+`
+	if diff := cmp.Diff(metricsToText(gathering), want); diff != "" {
+		t.Errorf("collector output mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_CollectorSummary(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP rpc_duration_seconds rpc_duration_seconds
+# TYPE rpc_duration_seconds summary
+rpc_duration_seconds{l1="v1",l2="v2",quantile="0.5"} 0.2 1735054883000
+rpc_duration_seconds{l1="v1",l2="v2",quantile="0.9"} 0.7 1735054883000
+rpc_duration_seconds_sum{l1="v1",l2="v2"} 2 1735054883000
+rpc_duration_seconds_count{l1="v1",l2="v2"} 4 1735054883000
+rpc_duration_seconds{l1="v1",l2="v3",quantile="0.5"} 0.4 1735054883000
+rpc_duration_seconds{l1="v1",l2="v3",quantile="0.9"} 0.9 1735054883000
+rpc_duration_seconds_sum{l1="v1",l2="v3"} 3 1735054883000
+rpc_duration_seconds_count{l1="v1",l2="v3"} 6 1735054883000
+`)
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{
+		url:                    ts.URL,
+		aggregateWithOutLabels: []string{"l2"},
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	want := `# HELP rpc_duration_seconds rpc_duration_seconds
+# TYPE rpc_duration_seconds summary
+rpc_duration_seconds_sum{l1="v1"} 5 1735054883000
+rpc_duration_seconds_count{l1="v1"} 10 1735054883000
+`
+	if diff := cmp.Diff(metricsToText(gathering), want); diff != "" {
+		t.Errorf("collector output mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_CollectorMultipleTargets(t *testing.T) {
+	log = slog.Default()
+
+	ts1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{l1="v1",l2="v2"} 10 1735054883000
+component_received_events_total{l1="v1",l2="v3"} 20 1735054883000
+`)
+	}))
+	defer ts1.Close()
+
+	ts2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer ts2.Close()
+
+	ts3 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{l1="v2",l2="v2"} 5 1735054883000
+`)
+	}))
+	defer ts3.Close()
+
+	reg := prometheus.NewPedanticRegistry()
+	for _, url := range []string{ts1.URL, ts2.URL, ts3.URL} {
+		reg.MustRegister(&RemoteAggregator{
+			url:                    url,
+			aggregateWithOutLabels: []string{"l2"},
+		})
+	}
+
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	// the failing target doesn't prevent collecting the others
+	want := `# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{l1="v1"} 30 1735054883000
+component_received_events_total{l1="v2"} 5 1735054883000
+`
+	if diff := cmp.Diff(metricsToText(gathering), want); diff != "" {
+		t.Errorf("collector output mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestCollectorsConfigHash(t *testing.T) {
+	c1 := &RemoteAggregator{url: "http://localhost:8080/metrics"}
+	c2 := &RemoteAggregator{url: "http://localhost:8081/metrics"}
+
+	if got, want := collectorsConfigHash([]*RemoteAggregator{c1}), c1.configHash(); got != want {
+		t.Errorf("collectorsConfigHash() of one collector = %s, want %s", got, want)
+	}
+
+	hash := collectorsConfigHash([]*RemoteAggregator{c1, c2})
+	if got := collectorsConfigHash([]*RemoteAggregator{c2, c1}); got != hash {
+		t.Errorf("collectorsConfigHash() of reordered collectors = %s, want %s", got, hash)
+	}
+	if hash == c1.configHash() || hash == c2.configHash() {
+		t.Errorf("collectorsConfigHash() = %s, expected to differ from the single collector hashes", hash)
+	}
+}
+
+func Test_CollectorProtobuf(t *testing.T) {
+	log = slog.Default()
+
+	families := []*dto.MetricFamily{{
+		Name: proto.String("component_received_events_total"),
+		Help: proto.String("component_received_events_total"),
+		Type: dto.MetricType_COUNTER.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Label:   []*dto.LabelPair{{Name: pointer("l1"), Value: pointer("v1")}, {Name: pointer("l2"), Value: pointer("v2")}},
+				Counter: &dto.Counter{Value: proto.Float64(10)},
+			},
+			{
+				Label:   []*dto.LabelPair{{Name: pointer("l1"), Value: pointer("v1")}, {Name: pointer("l2"), Value: pointer("v3")}},
+				Counter: &dto.Counter{Value: proto.Float64(20)},
+			},
+		},
+	}}
+
+	var format expfmt.Format
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		format = expfmt.NegotiateIncludingOpenMetrics(r.Header)
+		w.Header().Set("Content-Type", string(format))
+		encoder := expfmt.NewEncoder(w, format)
+		for _, family := range families {
+			if err := encoder.Encode(family); err != nil {
+				t.Error(err)
+			}
+		}
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{
+		url:                    ts.URL,
+		aggregateWithOutLabels: []string{"l2"},
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	if format.FormatType() != expfmt.TypeProtoDelim {
+		t.Errorf("negotiated format = %q, expected protobuf to be preferred", format)
+	}
+	if len(gathering) != 1 || gathering[0].Metric[0].GetCounter().GetValue() != 30 {
+		t.Errorf("unexpected gathering: %v", gathering)
+	}
+}
+
+func Test_CollectorGzip(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			t.Errorf("Accept-Encoding = %q, want gzip", r.Header.Get("Accept-Encoding"))
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		fmt.Fprint(gz, `# TYPE component_received_events_total counter
+component_received_events_total{l1="v1",l2="v2"} 10
+component_received_events_total{l1="v1",l2="v3"} 20
+`)
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{
+		url:                    ts.URL,
+		aggregateWithOutLabels: []string{"l2"},
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	if len(gathering) != 1 || gathering[0].Metric[0].GetCounter().GetValue() != 30 {
+		t.Errorf("unexpected gathering: %v", gathering)
+	}
+}
+
+func Test_CollectorTargetUp(t *testing.T) {
+	log = slog.Default()
+
+	var fail atomic.Bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, `# TYPE component_received_events_total counter
+component_received_events_total{l1="v1"} 10
+`)
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{url: ts.URL}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	for _, tt := range []struct {
+		fail bool
+		want float64
+	}{{false, 1}, {true, 0}, {false, 1}} {
+		fail.Store(tt.fail)
+		if _, err := reg.Gather(); err != nil {
+			t.Fatalf("reg.Gather() error = %v", err)
+		}
+		if got := testutil.ToFloat64(targetUp.WithLabelValues(ts.URL)); got != tt.want {
+			t.Errorf("target up with failing target %v = %v, want %v", tt.fail, got, tt.want)
+		}
+	}
+}
+
+func Test_sizeLimitReader(t *testing.T) {
+	body := strings.Repeat("a", 100)
+	for _, tt := range []struct {
+		limit   int64
+		wantErr bool
+	}{
+		{limit: 99, wantErr: true},
+		{limit: 100},
+		{limit: 101},
+	} {
+		got, err := io.ReadAll(&sizeLimitReader{reader: strings.NewReader(body), limit: tt.limit})
+		if gotErr := errors.Is(err, errScrapeTooLarge); gotErr != tt.wantErr {
+			t.Errorf("reading %d bytes limited to %d error = %v, want error %v", len(body), tt.limit, err, tt.wantErr)
+		}
+		if want := body[:min(len(body), int(tt.limit))]; string(got) != want {
+			t.Errorf("reading %d bytes limited to %d read %d bytes, want %d", len(body), tt.limit, len(got), len(want))
+		}
+	}
+}
+
+func Test_CollectorScrapeErrors(t *testing.T) {
+	log = slog.Default()
+
+	for _, tt := range []struct {
+		name    string
+		handler http.HandlerFunc
+		url     string
+		timeout time.Duration
+		maxSize int64
+		want    string
+	}{
+		{
+			name: "status",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+			want: "status",
+		},
+		{
+			name: "unauthorized",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusUnauthorized)
+			},
+			want: "status",
+		},
+		{
+			name: "decode",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+				fmt.Fprint(w, "# TYPE metric counter\nmetric{l1=\"v1\" 1\n")
+			},
+			want: "decode",
+		},
+		{
+			name: "timeout",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				<-r.Context().Done()
+			},
+			timeout: 10 * time.Millisecond,
+			want:    "timeout",
+		},
+		{
+			name: "size",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, "# TYPE metric counter\nmetric{l1=\"v1\"} 1\n")
+			},
+			maxSize: 16,
+			want:    "size",
+		},
+		{
+			name: "connection",
+			url:  "http://127.0.0.1:1",
+			want: "connection",
+		},
+		{
+			name: "request",
+			url:  "http://[::1",
+			want: "request",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			url := tt.url
+			if tt.handler != nil {
+				ts := httptest.NewServer(tt.handler)
+				defer ts.Close()
+				url = ts.URL
+			}
+
+			collector := &RemoteAggregator{url: url, scrapeTimeout: tt.timeout, maxScrapeSize: tt.maxSize}
+
+			reg := prometheus.NewPedanticRegistry()
+			reg.MustRegister(collector)
+
+			before := testutil.ToFloat64(scrapeErrors.WithLabelValues(url, tt.want))
+			if _, err := reg.Gather(); err != nil {
+				t.Fatalf("reg.Gather() error = %v", err)
+			}
+			if got := testutil.ToFloat64(scrapeErrors.WithLabelValues(url, tt.want)) - before; got != 1 {
+				t.Errorf("scrape errors with reason %q = %v, want 1", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestScrapeErrorReason(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want string
+	}{
+		{&scrapeError{"connection", &net.DNSError{Err: "no such host", Name: "example"}}, "dns"},
+		{&scrapeError{"connection", fmt.Errorf("error fetching metrics %w", context.DeadlineExceeded)}, "timeout"},
+		{&scrapeError{"decode", errBodyReadTimeout}, "timeout"},
+		{&scrapeError{"status", errUnauthorized}, "status"},
+		{errors.New("other"), "unknown"},
+	} {
+		if got := scrapeErrorReason(tt.err); got != tt.want {
+			t.Errorf("scrapeErrorReason(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	tests := []struct {
+		level, format string
+		wantDebug     bool
+		wantErr       bool
+	}{
+		{"info", "text", false, false},
+		{"debug", "json", true, false},
+		{"WARN", "text", false, false},
+		{"error", "json", false, false},
+		{"verbose", "text", false, true},
+		{"info", "logfmt", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level+"-"+tt.format, func(t *testing.T) {
+			got, err := newLogger(tt.level, tt.format)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newLogger() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if debug := got.Enabled(context.Background(), slog.LevelDebug); debug != tt.wantDebug {
+				t.Errorf("debug enabled = %v, want %v", debug, tt.wantDebug)
+			}
+		})
+	}
+}
+
+func TestParseRenameLabels(t *testing.T) {
+	got, err := parseRenameLabels([]string{"instance=source_instance", "pod=source_pod"})
+	if err != nil {
+		t.Fatalf("parseRenameLabels() error = %v", err)
+	}
+	want := map[string]string{"instance": "source_instance", "pod": "source_pod"}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("parseRenameLabels() mismatch (-want +got):\n%s", diff)
+	}
+
+	for _, pairs := range [][]string{
+		{"instance"},
+		{"instance="},
+		{"instance=a", "instance=b"},
+		{"instance=a", "pod=a"},
+	} {
+		if _, err := parseRenameLabels(pairs); err == nil {
+			t.Errorf("parseRenameLabels(%q) expected error", pairs)
+		}
+	}
+}
+
+func TestParseRenameMetrics(t *testing.T) {
+	got, err := parseRenameMetrics([]string{"legacy_requests=http_requests_total", "old_requests=http_requests_total"})
+	if err != nil {
+		t.Fatalf("parseRenameMetrics() error = %v", err)
+	}
+	want := map[string]string{"legacy_requests": "http_requests_total", "old_requests": "http_requests_total"}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("parseRenameMetrics() mismatch (-want +got):\n%s", diff)
+	}
+
+	for _, pairs := range [][]string{
+		{"legacy_requests"},
+		{"=http_requests_total"},
+		{"legacy_requests=a", "legacy_requests=b"},
+	} {
+		if _, err := parseRenameMetrics(pairs); err == nil {
+			t.Errorf("parseRenameMetrics(%q) expected error", pairs)
+		}
+	}
+}
+
+func Test_CollectorRenameMetric(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP legacy_requests legacy_requests
+# TYPE legacy_requests counter
+legacy_requests{service="api",pod="p1"} 1 1735054883000
+legacy_requests{service="web",pod="p1"} 2 1735054883000
+# HELP component_buffer_events component_buffer_events
+# TYPE component_buffer_events gauge
+component_buffer_events{pod="p1"} 5 1735054883000
+# HELP http_requests_total http_requests_total
+# TYPE http_requests_total counter
+http_requests_total{service="api",pod="p2"} 4 1735054883000
+# HELP legacy_buffer_events legacy_buffer_events
+# TYPE legacy_buffer_events counter
+legacy_buffer_events{pod="p1"} 3 1735054883000
+`)
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{
+		url:                    ts.URL,
+		aggregateWithOutLabels: []string{"pod"},
+		renameMetrics:          map[string]string{"legacy_requests": "http_requests_total", "legacy_buffer_events": "component_buffer_events"},
+		metricPrefixes:         map[string]string{"http_requests_total": "app_"},
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	before := testutil.ToFloat64(nameCollisions.WithLabelValues(ts.URL))
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	// the renamed counter is merged into the family scraped under the new
+	// name, the counter renamed to the name of a gauge is skipped and later
+	// stages refer to the new name
+	want := `# HELP app_http_requests_total http_requests_total
+# TYPE app_http_requests_total counter
+app_http_requests_total{service="api"} 5 1735054883000
+app_http_requests_total{service="web"} 2 1735054883000
+# HELP component_buffer_events component_buffer_events
+# TYPE component_buffer_events gauge
+component_buffer_events 5 1735054883000
+`
+	if diff := cmp.Diff(metricsToText(gathering), want); diff != "" {
+		t.Errorf("collector output mismatch (-want +got):\n%s", diff)
+	}
+	if got := testutil.ToFloat64(nameCollisions.WithLabelValues(ts.URL)) - before; got != 1 {
+		t.Errorf("name collisions = %v, want 1", got)
+	}
+}
+
+func TestRenameLabels(t *testing.T) {
+	newMetrics := func() []*dto.Metric {
+		return []*dto.Metric{
+			{
+				Label: []*dto.LabelPair{
+					{Name: pointer("instance"), Value: pointer("i1")},
+					{Name: pointer("pod"), Value: pointer("p1")},
+				},
+				Counter: &dto.Counter{Value: proto.Float64(1)},
+			},
+			{
+				Label: []*dto.LabelPair{
+					{Name: pointer("instance"), Value: pointer("i1")},
+					{Name: pointer("pod"), Value: pointer("p2")},
+					{Name: pointer("source_instance"), Value: pointer("overridden")},
+				},
+				Counter: &dto.Counter{Value: proto.Float64(2)},
+			},
+		}
+	}
+
+	ra := &RemoteAggregator{renameLabels: map[string]string{"instance": "source_instance"}}
+	metrics := newMetrics()
+	ra.relabelSeries(metrics)
+	aggregatedLabels, aggregated := aggregateMetrics(metrics, []string{"pod"}, false)
+
+	wantAggregatedLabels := map[string]map[string]string{
+		"source_instance\xffi1\xff": {"source_instance": "i1"},
+	}
+	if diff := cmp.Diff(aggregatedLabels, wantAggregatedLabels); diff != "" {
+		t.Errorf("aggregatedLabels mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(aggregateValues(aggregated), map[string]float64{"source_instance\xffi1\xff": 3}); diff != "" {
+		t.Errorf("aggregatedValues mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_CollectorDropLabel(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{l1="v1",l2="v2",pod="p1"} 10 1735054883000
+component_received_events_total{l1="v1",l2="v3",pod="p2"} 20 1735054883000
+component_received_events_total{l1="v4",l2="v2",pod="p3"} 40 1735054883000
+`)
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name      string
+		collector *RemoteAggregator
+		want      string
+	}{
+		{
+			name: "without",
+			collector: &RemoteAggregator{
+				aggregateWithOutLabels: []string{"l2"},
+				dropLabels:             []string{"pod"},
+				aggregationOutputs:     []aggregationOutput{{suffix: ":l1", aggregateWithOutLabels: []string{"l1"}}},
+			},
+			want: `# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{l1="v1"} 30 1735054883000
+component_received_events_total{l1="v4"} 40 1735054883000
+# HELP component_received_events_total:l1 component_received_events_total
+# TYPE component_received_events_total:l1 counter
+component_received_events_total:l1{l2="v2"} 50 1735054883000
+component_received_events_total:l1{l2="v3"} 20 1735054883000
+`,
+		},
+		{
+			name: "by",
+			collector: &RemoteAggregator{
+				aggregateByLabels: []string{"l1", "pod"},
+				dropLabels:        []string{"pod"},
+			},
+			want: `# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{l1="v1"} 30 1735054883000
+component_received_events_total{l1="v4"} 40 1735054883000
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.collector.url = ts.URL
+
+			reg := prometheus.NewPedanticRegistry()
+			reg.MustRegister(tt.collector)
+
+			gathering, err := reg.Gather()
+			if err != nil {
+				t.Fatalf("reg.Gather() error = %v", err)
+			}
+			if diff := cmp.Diff(metricsToText(gathering), tt.want); diff != "" {
+				t.Errorf("collector output mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_CollectorOutputLabelAllowlist(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{l1="v1",l2="v2",pod="p1"} 10 1735054883000
+component_received_events_total{l1="v1",l2="v3",pod="p2",new="n1"} 20 1735054883000
+component_received_events_total{l1="v1",l2="v3",pod="p3",new="n2"} 40 1735054883000
+`)
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{
+		url:                    ts.URL,
+		aggregateWithOutLabels: []string{"pod"},
+		addLabels:              map[string]string{"source": "aggregator"},
+		outputLabelAllowlist:   []string{"l1", "l2"},
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	// the unexpected label is aggregated over, the constant label is kept
+	want := `# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{l1="v1",l2="v2",source="aggregator"} 10 1735054883000
+component_received_events_total{l1="v1",l2="v3",source="aggregator"} 60 1735054883000
+`
+	if diff := cmp.Diff(metricsToText(gathering), want); diff != "" {
+		t.Errorf("collector output mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_CollectorKeepDropIf(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{environment="production",region="eu",pod="p1"} 1 1735054883000
+component_received_events_total{environment="production",region="us",pod="p2"} 2 1735054883000
+component_received_events_total{environment="production",pod="p3"} 4 1735054883000
+component_received_events_total{environment="dev",region="eu",pod="p4"} 8 1735054883000
+`)
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name           string
+		keepIf, dropIf []string
+		want           string
+	}{
+		{
+			name:   "keep",
+			keepIf: []string{"environment=production"},
+			want: `# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{environment="production"} 7 1735054883000
+`,
+		},
+		{
+			name:   "keep-all",
+			keepIf: []string{"environment=production", "region=eu"},
+			want: `# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{environment="production"} 1 1735054883000
+`,
+		},
+		{
+			name:   "drop-all",
+			dropIf: []string{"environment=production", "region="},
+			want: `# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{environment="dev"} 8 1735054883000
+component_received_events_total{environment="production"} 3 1735054883000
+`,
+		},
+		{
+			name:   "keep-and-drop",
+			keepIf: []string{"environment=production"},
+			dropIf: []string{"region=us"},
+			want: `# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{environment="production"} 5 1735054883000
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keepIf, err := parseLabelMatchers(tt.keepIf)
+			if err != nil {
+				t.Fatalf("parseLabelMatchers() error = %v", err)
+			}
+			dropIf, err := parseLabelMatchers(tt.dropIf)
+			if err != nil {
+				t.Fatalf("parseLabelMatchers() error = %v", err)
+			}
+			collector := &RemoteAggregator{
+				url:               ts.URL,
+				aggregateByLabels: []string{"environment"},
+				keepIf:            keepIf,
+				dropIf:            dropIf,
+			}
+
+			reg := prometheus.NewPedanticRegistry()
+			reg.MustRegister(collector)
+
+			gathering, err := reg.Gather()
+			if err != nil {
+				t.Fatalf("reg.Gather() error = %v", err)
+			}
+			if diff := cmp.Diff(metricsToText(gathering), tt.want); diff != "" {
+				t.Errorf("collector output mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseLabelMatchers(t *testing.T) {
+	got, err := parseLabelMatchers([]string{"env=prod", "query=a=b", "region="})
+	if err != nil {
+		t.Fatalf("parseLabelMatchers() error = %v", err)
+	}
+	want := []labelMatcher{{"env", "prod"}, {"query", "a=b"}, {"region", ""}}
+	if diff := cmp.Diff(got, want, cmp.AllowUnexported(labelMatcher{})); diff != "" {
+		t.Errorf("parseLabelMatchers() mismatch (-want +got):\n%s", diff)
+	}
+
+	for _, pair := range []string{"env", "=prod"} {
+		if _, err := parseLabelMatchers([]string{pair}); err == nil {
+			t.Errorf("parseLabelMatchers(%q) expected error", pair)
+		}
+	}
+}
+
+func Test_CollectorNameCollision(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP component_events component_events
+# TYPE component_events counter
+component_events{l1="v1",l2="v2"} 1 1735054883000
+component_events{l1="v1",l2="v3"} 2 1735054883000
+# HELP component_events_l1 component_events_l1
+# TYPE component_events_l1 gauge
+component_events_l1{l1="v1",l2="v2"} 4 1735054883000
+`)
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{
+		url:                    ts.URL,
+		aggregateWithOutLabels: []string{"l2"},
+		aggregationOutputs:     []aggregationOutput{{suffix: "_l1", aggregateWithOutLabels: []string{"l1", "l2"}}},
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	before := testutil.ToFloat64(nameCollisions.WithLabelValues(ts.URL))
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	// the text decoder doesn't keep the order of the families, so either of
+	// the colliding families is exported
+	var names []string
+	for _, mf := range gathering {
+		names = append(names, mf.GetName())
+	}
+	want := []string{"component_events", "component_events_l1", "component_events_l1_l1"}
+	if diff := cmp.Diff(names, want); diff != "" {
+		t.Errorf("exported names mismatch (-want +got):\n%s", diff)
+	}
+	if got := testutil.ToFloat64(nameCollisions.WithLabelValues(ts.URL)) - before; got != 1 {
+		t.Errorf("name collisions = %v, want 1", got)
+	}
+}
+
+func TestParseHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		want    http.Header
+		wantErr bool
+	}{
+		{"none", nil, http.Header{}, false},
+		{"trimmed", []string{"X-Scope-OrgID:  tenant "}, http.Header{"X-Scope-Orgid": {"tenant"}}, false},
+		{"repeated", []string{"X-Tenant: a", "x-tenant: b"}, http.Header{"X-Tenant": {"a", "b"}}, false},
+		{"colon-in-value", []string{"X-Url: http://host"}, http.Header{"X-Url": {"http://host"}}, false},
+		{"no-colon", []string{"X-Tenant"}, nil, true},
+		{"no-name", []string{": value"}, nil, true},
+		{"space-in-name", []string{"X Tenant: a"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseHeaders(tt.entries)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseHeaders() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(got, tt.want); diff != "" {
+				t.Errorf("parseHeaders() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_CollectorUserAgent(t *testing.T) {
+	log = slog.Default()
+
+	var got string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.UserAgent()
+		fmt.Fprint(w, `component_received_events_total{l1="v1"} 10`)
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name      string
+		userAgent string
+		headers   http.Header
+		want      string
+	}{
+		{"default", "", nil, "metrics-aggregator/" + version},
+		{"configured", "scraper/1.0", nil, "scraper/1.0"},
+		{"header", "scraper/1.0", http.Header{"User-Agent": {"header/1.0"}}, "header/1.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collector := &RemoteAggregator{
+				url:                    ts.URL,
+				userAgent:              tt.userAgent,
+				headers:                tt.headers,
+				aggregateWithOutLabels: []string{"l1"},
+			}
+
+			reg := prometheus.NewPedanticRegistry()
+			reg.MustRegister(collector)
+			if _, err := reg.Gather(); err != nil {
+				t.Fatalf("reg.Gather() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("User-Agent = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_CollectorHeaders(t *testing.T) {
+	log = slog.Default()
+
+	var got http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+		fmt.Fprint(w, `component_received_events_total{l1="v1"} 10`)
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{
+		url:                    ts.URL,
+		headers:                http.Header{"X-Scope-Orgid": {"tenant"}, "X-Tenant": {"a", "b"}, "Authorization": {"Bearer header"}},
+		auth:                   &requestAuth{bearerToken: "token"},
+		aggregateWithOutLabels: []string{"l1"},
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+	if _, err := reg.Gather(); err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	if diff := cmp.Diff(got.Values("X-Scope-OrgID"), []string{"tenant"}); diff != "" {
+		t.Errorf("X-Scope-OrgID mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(got.Values("X-Tenant"), []string{"a", "b"}); diff != "" {
+		t.Errorf("X-Tenant mismatch (-want +got):\n%s", diff)
+	}
+	// the auth flags take precedence
+	if auth := got.Get("Authorization"); auth != "Bearer token" {
+		t.Errorf("Authorization = %q, want %q", auth, "Bearer token")
+	}
+}
+
+func TestParseAddPrefix(t *testing.T) {
+	prefix, metricPrefixes, err := parseAddPrefix([]string{"subsystem_a_events_total=subsystem_a_", "agg_", "cpu_usage=subsystem_b_"})
+	if err != nil {
+		t.Fatalf("parseAddPrefix() error = %v", err)
+	}
+	if prefix != "agg_" {
+		t.Errorf("parseAddPrefix() prefix = %q, want agg_", prefix)
+	}
+	want := map[string]string{"subsystem_a_events_total": "subsystem_a_", "cpu_usage": "subsystem_b_"}
+	if diff := cmp.Diff(metricPrefixes, want); diff != "" {
+		t.Errorf("parseAddPrefix() mismatch (-want +got):\n%s", diff)
+	}
+
+	for _, entries := range [][]string{
+		{"a_", "b_"},
+		{"cpu_usage="},
+		{"=b_"},
+		{"cpu_usage=a_", "cpu_usage=b_"},
+	} {
+		if _, _, err := parseAddPrefix(entries); err == nil {
+			t.Errorf("parseAddPrefix(%q) expected error", entries)
+		}
+	}
+}
+
+func Test_CollectorMetricPrefix(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP cpu_usage cpu_usage
+# TYPE cpu_usage gauge
+cpu_usage{l1="v1"} 1 1735054883000
+# HELP events_total events_total
+# TYPE events_total counter
+events_total{l1="v1"} 2 1735054883000
+# HELP memory_usage memory_usage
+# TYPE memory_usage gauge
+memory_usage{l1="v1"} 4 1735054883000
+`)
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{
+		url:                    ts.URL,
+		aggregateWithOutLabels: []string{"l1"},
+		addPrefix:              "agg_",
+		metricPrefixes:         map[string]string{"cpu_usage": "subsystem_a_", "events_total": "subsystem_b_"},
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	want := `# HELP agg_memory_usage memory_usage
+# TYPE agg_memory_usage gauge
+agg_memory_usage 4 1735054883000
+# HELP subsystem_a_cpu_usage cpu_usage
+# TYPE subsystem_a_cpu_usage gauge
+subsystem_a_cpu_usage 1 1735054883000
+# HELP subsystem_b_events_total events_total
+# TYPE subsystem_b_events_total counter
+subsystem_b_events_total 2 1735054883000
+`
+	if diff := cmp.Diff(metricsToText(gathering), want); diff != "" {
+		t.Errorf("collector output mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_CollectorScrapeRetries(t *testing.T) {
+	log = slog.Default()
+
+	tests := []struct {
+		name         string
+		failures     int32
+		status       int
+		retries      int
+		wantRequests int32
+		wantUp       float64
+	}{
+		{"no-retries", 1, http.StatusServiceUnavailable, 0, 1, 0},
+		{"recovering", 2, http.StatusServiceUnavailable, 2, 3, 1},
+		{"exhausted", 3, http.StatusServiceUnavailable, 2, 3, 0},
+		{"client-error", 1, http.StatusNotFound, 2, 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if requests.Add(1) <= tt.failures {
+					w.WriteHeader(tt.status)
+					return
+				}
+				fmt.Fprint(w, `# TYPE component_received_events_total counter
+component_received_events_total{l1="v1"} 10
+`)
+			}))
+			defer ts.Close()
+
+			collector := &RemoteAggregator{
+				url:                ts.URL,
+				scrapeTimeout:      time.Second,
+				scrapeRetries:      tt.retries,
+				scrapeRetryBackoff: time.Millisecond,
+			}
+
+			reg := prometheus.NewPedanticRegistry()
+			reg.MustRegister(collector)
+
+			if _, err := reg.Gather(); err != nil {
+				t.Fatalf("reg.Gather() error = %v", err)
+			}
+			if got := requests.Load(); got != tt.wantRequests {
+				t.Errorf("requests = %d, want %d", got, tt.wantRequests)
+			}
+			if got := testutil.ToFloat64(targetUp.WithLabelValues(ts.URL)); got != tt.wantUp {
+				t.Errorf("target up = %v, want %v", got, tt.wantUp)
+			}
+		})
+	}
+}
+
+func Test_CollectorScrapeRetriesDecodeError(t *testing.T) {
+	log = slog.Default()
+
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		fmt.Fprint(w, "# TYPE metric counter\nmetric{l1=\"v1\" 1\n")
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{url: ts.URL, scrapeRetries: 2, scrapeRetryBackoff: time.Millisecond}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	if _, err := reg.Gather(); err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("requests = %d, want 1", got)
+	}
+}
+
+func Test_CollectorPartialScrape(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		format := expfmt.NewFormat(expfmt.TypeProtoDelim)
+		w.Header().Set("Content-Type", string(format))
+		family := &dto.MetricFamily{
+			Name: pointer("component_received_events_total"),
+			Type: dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{
+				{Label: []*dto.LabelPair{{Name: pointer("l1"), Value: pointer("v1")}, {Name: pointer("l2"), Value: pointer("v2")}}, Counter: &dto.Counter{Value: proto.Float64(10)}},
+				{Label: []*dto.LabelPair{{Name: pointer("l1"), Value: pointer("v1")}, {Name: pointer("l2"), Value: pointer("v3")}}, Counter: &dto.Counter{Value: proto.Float64(20)}},
+			},
+		}
+		if err := expfmt.NewEncoder(w, format).Encode(family); err != nil {
+			t.Error(err)
+		}
+		// a truncated message following the first family
+		w.Write([]byte{0x10, 0x0a})
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{url: ts.URL, aggregateWithOutLabels: []string{"l2"}}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	before := testutil.ToFloat64(partialScrapes.WithLabelValues(ts.URL))
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+	if len(gathering) != 1 || gathering[0].GetMetric()[0].GetCounter().GetValue() != 30 {
+		t.Errorf("got %v, want the aggregated family decoded before the error", gathering)
+	}
+	if got := testutil.ToFloat64(partialScrapes.WithLabelValues(ts.URL)) - before; got != 1 {
+		t.Errorf("partial scrapes = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(scrapeErrors.WithLabelValues(ts.URL, "decode")); got != 1 {
+		t.Errorf("decode scrape errors = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(decodeResults.WithLabelValues(ts.URL, "error")); got != 1 {
+		t.Errorf("decode results with error = %v, want 1", got)
+	}
+}
+
+func Test_CollectorDecodeResults(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# TYPE component_received_events_total counter
+component_received_events_total{l1="v1"} 10
+# TYPE component_buffer_events gauge
+component_buffer_events{l1="v1"} 5
+`)
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{url: ts.URL}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+	for range 2 {
+		if _, err := reg.Gather(); err != nil {
+			t.Fatalf("reg.Gather() error = %v", err)
+		}
+	}
+
+	if got := testutil.ToFloat64(decodeResults.WithLabelValues(ts.URL, "eof")); got != 2 {
+		t.Errorf("decode results with eof = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(decodeResults.WithLabelValues(ts.URL, "error")); got != 0 {
+		t.Errorf("decode results with error = %v, want 0", got)
+	}
+	metric := &dto.Metric{}
+	if err := decodedFamilies.WithLabelValues(ts.URL).(prometheus.Histogram).Write(metric); err != nil {
+		t.Fatal(err)
+	}
+	if count, sum := metric.GetHistogram().GetSampleCount(), metric.GetHistogram().GetSampleSum(); count != 2 || sum != 4 {
+		t.Errorf("decoded families count, sum = %d, %v, want 2, 4", count, sum)
+	}
+}
+
+func Test_CollectorScrapeFormat(t *testing.T) {
+	log = slog.Default()
+
+	var accept atomic.Value
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accept.Store(r.Header.Get("Accept"))
+		// a target announcing protobuf but serving text
+		w.Header().Set("Content-Type", string(expfmt.NewFormat(expfmt.TypeProtoDelim)))
+		fmt.Fprint(w, `# TYPE component_received_events_total counter
+component_received_events_total{l1="v1",l2="v2"} 10
+component_received_events_total{l1="v1",l2="v3"} 20
+`)
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{
+		url:                    ts.URL,
+		aggregateWithOutLabels: []string{"l2"},
+		scrapeFormat:           scrapeFormats["text"],
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+	if got, want := accept.Load(), string(scrapeFormats["text"]); got != want {
+		t.Errorf("Accept = %q, want %q", got, want)
+	}
+	if len(gathering) != 1 || gathering[0].GetMetric()[0].GetCounter().GetValue() != 30 {
+		t.Errorf("got %v, want the aggregated text family", gathering)
+	}
+}
+
+func Test_CollectorRoundDecimals(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP component_buffer_ratio component_buffer_ratio
+# TYPE component_buffer_ratio gauge
+component_buffer_ratio{l1="v1",l2="v2"} 0.1 1735054883000
+component_buffer_ratio{l1="v1",l2="v3"} 0.2 1735054883000
+# HELP component_request_duration_seconds component_request_duration_seconds
+# TYPE component_request_duration_seconds summary
+component_request_duration_seconds_sum{l1="v1",l2="v2"} 0.1 1735054883000
+component_request_duration_seconds_count{l1="v1",l2="v2"} 1 1735054883000
+component_request_duration_seconds_sum{l1="v1",l2="v3"} 0.2 1735054883000
+component_request_duration_seconds_count{l1="v1",l2="v3"} 1 1735054883000
+`)
+	}))
+	defer ts.Close()
+
+	for _, tt := range []struct {
+		name       string
+		roundScale float64
+		want       float64
+	}{
+		{"disabled", 0, 0.30000000000000004},
+		{"two-decimals", 100, 0.3},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			collector := &RemoteAggregator{
+				url:                    ts.URL,
+				aggregateWithOutLabels: []string{"l2"},
+				roundScale:             tt.roundScale,
+			}
+
+			reg := prometheus.NewPedanticRegistry()
+			reg.MustRegister(collector)
+
+			gathering, err := reg.Gather()
+			if err != nil {
+				t.Fatalf("reg.Gather() error = %v", err)
+			}
+			if len(gathering) != 2 {
+				t.Fatalf("got %d metric families, want 2", len(gathering))
+			}
+			if got := gathering[0].GetMetric()[0].GetGauge().GetValue(); got != tt.want {
+				t.Errorf("gauge value = %v, want %v", got, tt.want)
+			}
+			if got := gathering[1].GetMetric()[0].GetSummary().GetSampleSum(); got != tt.want {
+				t.Errorf("summary sum = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoundDecimalsScale(t *testing.T) {
+	tests := []struct {
+		decimals int
+		want     float64
+		wantErr  bool
+	}{
+		{decimals: -1, want: 0},
+		{decimals: 0, want: 1},
+		{decimals: 2, want: 100},
+		{decimals: 15, want: 1e15},
+		{decimals: 16, wantErr: true},
+		{decimals: 400, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.decimals), func(t *testing.T) {
+			got, err := roundDecimalsScale(tt.decimals)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("roundDecimalsScale() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("roundDecimalsScale() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_CollectorDropZero(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP queue_length queue_length
+# TYPE queue_length gauge
+queue_length{pod="p1",queue="a"} 0 1735054883000
+queue_length{pod="p2",queue="a"} 0 1735054883000
+queue_length{pod="p1",queue="b"} 2 1735054883000
+queue_length{pod="p2",queue="b"} -2 1735054883000
+queue_length{pod="p1",queue="c"} 1 1735054883000
+# HELP errors_total errors_total
+# TYPE errors_total counter
+errors_total{pod="p1",code="500"} 0 1735054883000
+errors_total{pod="p1",code="503"} 1 1735054883000
+`)
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name     string
+		counters bool
+		want     string
+	}{
+		{
+			name: "gauges",
+			want: `# HELP errors_total errors_total
+# TYPE errors_total counter
+errors_total{code="500"} 0 1735054883000
+errors_total{code="503"} 1 1735054883000
+# HELP queue_length queue_length
+# TYPE queue_length gauge
+queue_length{queue="c"} 1 1735054883000
+`,
+		},
+		{
+			name:     "counters",
+			counters: true,
+			want: `# HELP errors_total errors_total
+# TYPE errors_total counter
+errors_total{code="503"} 1 1735054883000
+# HELP queue_length queue_length
+# TYPE queue_length gauge
+queue_length{queue="c"} 1 1735054883000
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collector := &RemoteAggregator{
+				url:                    ts.URL,
+				aggregateWithOutLabels: []string{"pod"},
+				dropZero:               true,
+				dropZeroCounters:       tt.counters,
+			}
+
+			reg := prometheus.NewPedanticRegistry()
+			reg.MustRegister(collector)
+
+			gathering, err := reg.Gather()
+			if err != nil {
+				t.Fatalf("reg.Gather() error = %v", err)
+			}
+			if diff := cmp.Diff(metricsToText(gathering), tt.want); diff != "" {
+				t.Errorf("collector output mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_CollectorWorkers(t *testing.T) {
+	log = slog.Default()
+
+	var body strings.Builder
+	for i := range 50 {
+		fmt.Fprintf(&body, "# HELP component_%02d_total component_%02d_total\n# TYPE component_%02d_total counter\n", i, i, i)
+		fmt.Fprintf(&body, "component_%02d_total{l1=\"v1\",l2=\"v2\"} %d 1735054883000\n", i, i)
+		fmt.Fprintf(&body, "component_%02d_total{l1=\"v1\",l2=\"v3\"} %d 1735054883000\n", i, i)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, body.String())
+	}))
+	defer ts.Close()
+
+	gather := func(workers int) (string, []string) {
+		collector := &RemoteAggregator{
+			url:                    ts.URL,
+			aggregateWithOutLabels: []string{"l2"},
+			workers:                workers,
+		}
+
+		reg := prometheus.NewPedanticRegistry()
+		reg.MustRegister(collector)
+
+		gathering, err := reg.Gather()
+		if err != nil {
+			t.Fatalf("reg.Gather() error = %v", err)
+		}
+		var names []string
+		for _, mf := range collector.LastResult() {
+			names = append(names, mf.GetName())
+		}
+		// the text decoder doesn't keep the order of the families
+		slices.Sort(names)
+		return metricsToText(gathering), names
+	}
+
+	wantText, wantNames := gather(1)
+	gotText, gotNames := gather(8)
+	if diff := cmp.Diff(gotText, wantText); diff != "" {
+		t.Errorf("collector output mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(gotNames, wantNames); diff != "" {
+		t.Errorf("LastResult() names mismatch (-want +got):\n%s", diff)
+	}
+	if len(wantNames) != 50 {
+		t.Errorf("LastResult() families = %d, want 50", len(wantNames))
+	}
+}
+
+func TestBuildInfo(t *testing.T) {
+	buildInfo.Set(1)
+
+	want := fmt.Sprintf(`# HELP metrics_aggregator_build_info Build information of the aggregator, value is always 1
+# TYPE metrics_aggregator_build_info gauge
+metrics_aggregator_build_info{commit="unknown",date="unknown",goversion=%q,version="dev"} 1
+`, runtime.Version())
+	if err := testutil.CollectAndCompare(buildInfo, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_registerRuntimeMetrics(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	registerRuntimeMetrics(reg)
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+	names := make(map[string]bool, len(gathering))
+	for _, mf := range gathering {
+		names[mf.GetName()] = true
+	}
+	if !names["metrics_aggregator_go_goroutines"] {
+		t.Errorf("registerRuntimeMetrics() names = %v, want metrics_aggregator_go_goroutines", slices.Sorted(maps.Keys(names)))
+	}
+}
+
+func Test_CollectorRuntimeMetrics(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP go_goroutines Number of goroutines that currently exist.
+# TYPE go_goroutines gauge
+go_goroutines{pod="p1"} 10 1735054883000
+go_goroutines{pod="p2"} 20 1735054883000
+# HELP http_requests_total http_requests_total
+# TYPE http_requests_total counter
+http_requests_total{pod="p1"} 1 1735054883000
+`)
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{
+		url:                    ts.URL,
+		aggregateWithOutLabels: []string{"pod"},
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+	registerRuntimeMetrics(reg)
+
+	// the target families named like the runtime metrics are exported next
+	// to the prefixed runtime metrics
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+	names := make(map[string]bool, len(gathering))
+	for _, mf := range gathering {
+		names[mf.GetName()] = true
+	}
+	for _, name := range []string{"go_goroutines", "http_requests_total", "metrics_aggregator_go_goroutines"} {
+		if !names[name] {
+			t.Errorf("missing family %s in %v", name, slices.Sorted(maps.Keys(names)))
+		}
+	}
+}
+
+func Test_CollectorCheckAggregateLabels(t *testing.T) {
+	var logs bytes.Buffer
+	log = slog.New(slog.NewTextHandler(&logs, nil))
+	defer func() { log = slog.Default() }()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# TYPE component_received_events_total counter
+component_received_events_total{l1="v1",pod="p1"} 10
+`)
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{
+		url:                    ts.URL,
+		aggregateWithOutLabels: []string{"pdo", "l1"},
+		aggregationOutputs:     []aggregationOutput{{suffix: "_all", aggregateWithOutLabels: []string{"l1", "pod", "instance"}}},
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	for range 2 {
+		if _, err := reg.Gather(); err != nil {
+			t.Fatalf("reg.Gather() error = %v", err)
+		}
+	}
+
+	var missing []string
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(line, "aggregation label not found") {
+			_, label, _ := strings.Cut(line, "label=")
+			missing = append(missing, label)
+		}
+	}
+	// every missing label is only reported once
+	if diff := cmp.Diff(missing, []string{"instance", "pdo"}); diff != "" {
+		t.Errorf("missing labels mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_CollectorCheckIncludeMetrics(t *testing.T) {
+	var logs bytes.Buffer
+	log = slog.New(slog.NewTextHandler(&logs, nil))
+	defer func() { log = slog.Default() }()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# TYPE component_received_events_total counter
+component_received_events_total{l1="v1",pod="p1"} 10
+# TYPE component_sent_events_total counter
+component_sent_events_total{l1="v1",pod="p1"} 10
+`)
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{
+		url:                    ts.URL,
+		aggregateWithOutLabels: []string{"pod"},
+		includeMetrics:         []string{"component_recieved_events_total", "component_sent_events", "received_events_total"},
+		renameMetrics:          map[string]string{"component_received_events_total": "received_events_total"},
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	for range 2 {
+		if _, err := reg.Gather(); err != nil {
+			t.Fatalf("reg.Gather() error = %v", err)
+		}
+	}
+
+	var warnings []string
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(line, "included metrics not found") {
+			_, metrics, _ := strings.Cut(line, "metrics=")
+			warnings = append(warnings, metrics)
+		}
+	}
+	// the missing metrics are only reported once, renamed metrics are
+	// included by their new name
+	if diff := cmp.Diff(warnings, []string{"\"[component_recieved_events_total component_sent_events]\""}); diff != "" {
+		t.Errorf("missing metrics mismatch (-want +got):\n%s", diff)
+	}
+	if !collector.includeMatched.Load() {
+		t.Errorf("includeMatched = false, want true")
+	}
+}
+
+func Test_CollectorSkipNonFinite(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP component_cpu_usage component_cpu_usage
+# TYPE component_cpu_usage gauge
+component_cpu_usage{l1="v1",l2="v2"} 1 1735054883000
+component_cpu_usage{l1="v1",l2="v3"} NaN 1735054883000
+component_cpu_usage{l1="v1",l2="v4"} +Inf 1735054883000
+component_cpu_usage{l1="v1",l2="v5"} 2 1735054883000
+`)
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name             string
+		skipNaN, skipInf bool
+		want             string
+	}{
+		{"none", false, false, "NaN"},
+		{"nan", true, false, "+Inf"},
+		{"inf", false, true, "NaN"},
+		{"both", true, true, "3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collector := &RemoteAggregator{
+				url:                    ts.URL,
+				aggregateWithOutLabels: []string{"l2"},
+				skipNaN:                tt.skipNaN,
+				skipInf:                tt.skipInf,
+			}
+
+			reg := prometheus.NewPedanticRegistry()
+			reg.MustRegister(collector)
+
+			gathering, err := reg.Gather()
+			if err != nil {
+				t.Fatalf("reg.Gather() error = %v", err)
+			}
+			want := `# HELP component_cpu_usage component_cpu_usage
+# TYPE component_cpu_usage gauge
+component_cpu_usage{l1="v1"} ` + tt.want + ` 1735054883000
+`
+			if diff := cmp.Diff(metricsToText(gathering), want); diff != "" {
+				t.Errorf("collector output mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_CollectorSeriesCounts(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# TYPE component_received_events_total counter
+component_received_events_total{l1="v1",pod="p1"} 1
+component_received_events_total{l1="v1",pod="p2"} 2
+component_received_events_total{l1="v2",pod="p3"} 4
+# TYPE component_buffer_events gauge
+component_buffer_events{l1="v1",pod="p1"} 1
+component_buffer_events{l1="v1",pod="p2"} 2
+`)
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{url: ts.URL, aggregateWithOutLabels: []string{"pod"}}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	if _, err := reg.Gather(); err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+	if got := testutil.ToFloat64(inputSeriesGauge.WithLabelValues(ts.URL)); got != 5 {
+		t.Errorf("input series = %v, want 5", got)
+	}
+	if got := testutil.ToFloat64(outputSeriesGauge.WithLabelValues(ts.URL)); got != 3 {
+		t.Errorf("output series = %v, want 3", got)
+	}
+}
+
+func Test_CollectorLastScrapeSuccess(t *testing.T) {
+	log = slog.Default()
+
+	var fail atomic.Bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			// decoding fails after the first family
+			fmt.Fprint(w, "# TYPE component_buffer_events gauge\ncomponent_buffer_events{pod=\"p1\"} 1\ncomponent_buffer_events{pod=\"p1\" 1\n")
+			return
+		}
+		fmt.Fprint(w, "component_buffer_events{pod=\"p1\"} 1\n")
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{url: ts.URL, aggregateWithOutLabels: []string{"pod"}}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	before := float64(time.Now().Unix())
+	if _, err := reg.Gather(); err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+	success := testutil.ToFloat64(lastScrapeSuccess.WithLabelValues(ts.URL))
+	if success < before {
+		t.Errorf("last scrape success = %v, want at least %v", success, before)
+	}
+
+	fail.Store(true)
+	reg.Gather()
+	if got := testutil.ToFloat64(lastScrapeSuccess.WithLabelValues(ts.URL)); got != success {
+		t.Errorf("last scrape success after failed scrape = %v, want %v", got, success)
+	}
+}
+
+func TestAggregationKey(t *testing.T) {
+	metric := func(pairs ...string) *dto.Metric {
+		m := &dto.Metric{}
+		for i := 0; i < len(pairs); i += 2 {
+			m.Label = append(m.Label, &dto.LabelPair{Name: pointer(pairs[i]), Value: pointer(pairs[i+1])})
+		}
+		return m
+	}
+
+	tests := []struct {
+		name      string
+		a, b      *dto.Metric
+		wantEqual bool
+	}{
+		{"label-order", metric("a", "b", "c", "d"), metric("c", "d", "a", "b"), true},
+		{"without-label", metric("a", "b", "pod", "p1"), metric("pod", "p2", "a", "b"), true},
+		{"comma-in-value", metric("a", "b,c=d"), metric("a", "b", "c", "d"), false},
+		{"equals-in-value", metric("a", "b=c"), metric("a=b", "c"), false},
+		{"empty-value", metric("a", "", "b", "c"), metric("a", "b", "c", ""), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, _ := aggregationKey(tt.a, []string{"pod"})
+			b, _ := aggregationKey(tt.b, []string{"pod"})
+			if (a == b) != tt.wantEqual {
+				t.Errorf("aggregationKey() keys %q and %q, want equal %v", a, b, tt.wantEqual)
+			}
+		})
+	}
+}
+
+func Test_CollectorCreatedTimestamp(t *testing.T) {
+	log = slog.Default()
+
+	families := []*dto.MetricFamily{
+		{
+			Name: proto.String("component_received_events_total"),
+			Help: proto.String("component_received_events_total"),
+			Type: dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Label:   []*dto.LabelPair{{Name: pointer("l1"), Value: pointer("v1")}, {Name: pointer("l2"), Value: pointer("v2")}},
+					Counter: &dto.Counter{Value: proto.Float64(10), CreatedTimestamp: timestamppb.New(time.Unix(100, 0))},
+				},
+				{
+					Label:   []*dto.LabelPair{{Name: pointer("l1"), Value: pointer("v1")}, {Name: pointer("l2"), Value: pointer("v3")}},
+					Counter: &dto.Counter{Value: proto.Float64(20), CreatedTimestamp: timestamppb.New(time.Unix(50, 0))},
+				},
+				{
+					Label:   []*dto.LabelPair{{Name: pointer("l1"), Value: pointer("v2")}, {Name: pointer("l2"), Value: pointer("v2")}},
+					Counter: &dto.Counter{Value: proto.Float64(5)},
+				},
+			},
+		},
+		{
+			Name: proto.String("component_request_duration_seconds"),
+			Help: proto.String("component_request_duration_seconds"),
+			Type: dto.MetricType_HISTOGRAM.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Label:     []*dto.LabelPair{{Name: pointer("l1"), Value: pointer("v1")}, {Name: pointer("l2"), Value: pointer("v2")}},
+					Histogram: &dto.Histogram{SampleCount: proto.Uint64(1), SampleSum: proto.Float64(1), CreatedTimestamp: timestamppb.New(time.Unix(70, 0))},
+				},
+			},
+		},
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		format := expfmt.NewFormat(expfmt.TypeProtoDelim)
+		w.Header().Set("Content-Type", string(format))
+		encoder := expfmt.NewEncoder(w, format)
+		for _, family := range families {
+			if err := encoder.Encode(family); err != nil {
+				t.Error(err)
+			}
+		}
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{
+		url:                    ts.URL,
+		aggregateWithOutLabels: []string{"l2"},
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	handler := promhttp.HandlerFor(reg, promhttp.HandlerOpts{EnableOpenMetrics: true, EnableOpenMetricsTextCreatedSamples: true})
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	handler.ServeHTTP(rec, req)
+
+	// the earliest created timestamp of the aggregated series, none for
+	// series without one
+	want := []string{
+		`component_received_events_created{l1="v1"} 50.0`,
+		`component_request_duration_seconds_created{l1="v1"} 70.0`,
+	}
+	for _, line := range want {
+		if !strings.Contains(rec.Body.String(), line+"\n") {
+			t.Errorf("OpenMetrics output missing %q:\n%s", line, rec.Body.String())
+		}
+	}
+	if strings.Contains(rec.Body.String(), `component_received_events_created{l1="v2"}`) {
+		t.Errorf("OpenMetrics output has a created timestamp for a series without one:\n%s", rec.Body.String())
+	}
+}
+
+func Test_CollectorSeriesCount(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{l1="v1",pod="p1"} 1 1735054883000
+component_received_events_total{l1="v1",pod="p2"} 2 1735054883000
+component_received_events_total{l1="v2",pod="p3"} 4 1735054883000
+# HELP component_request_duration_seconds component_request_duration_seconds
+# TYPE component_request_duration_seconds histogram
+component_request_duration_seconds_bucket{l1="v1",pod="p1",le="+Inf"} 1 1735054883000
+component_request_duration_seconds_sum{l1="v1",pod="p1"} 1 1735054883000
+component_request_duration_seconds_count{l1="v1",pod="p1"} 1 1735054883000
+component_request_duration_seconds_bucket{l1="v1",pod="p2",le="+Inf"} 2 1735054883000
+component_request_duration_seconds_sum{l1="v1",pod="p2"} 3 1735054883000
+component_request_duration_seconds_count{l1="v1",pod="p2"} 2 1735054883000
+`)
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{
+		url:                    ts.URL,
+		aggregateWithOutLabels: []string{"pod"},
+		aggregation:            aggregationMax,
+		seriesCount:            true,
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	// the count is independent of the aggregation and the family type
+	want := `# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{l1="v1"} 2 1735054883000
+component_received_events_total{l1="v2"} 4 1735054883000
+# HELP component_received_events_total_aggregated_series_count Number of series of component_received_events_total aggregated into each series
+# TYPE component_received_events_total_aggregated_series_count gauge
+component_received_events_total_aggregated_series_count{l1="v1"} 2 1735054883000
+component_received_events_total_aggregated_series_count{l1="v2"} 1 1735054883000
+# HELP component_request_duration_seconds component_request_duration_seconds
+# TYPE component_request_duration_seconds histogram
+component_request_duration_seconds_bucket{l1="v1",le="+Inf"} 3 1735054883000
+component_request_duration_seconds_sum{l1="v1"} 4 1735054883000
+component_request_duration_seconds_count{l1="v1"} 3 1735054883000
+# HELP component_request_duration_seconds_aggregated_series_count Number of series of component_request_duration_seconds aggregated into each series
+# TYPE component_request_duration_seconds_aggregated_series_count gauge
+component_request_duration_seconds_aggregated_series_count{l1="v1"} 2 1735054883000
+`
+	if diff := cmp.Diff(metricsToText(gathering), want); diff != "" {
+		t.Errorf("collector output mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseForceTypes(t *testing.T) {
+	got, err := parseForceTypes([]string{"component_buffer_events=counter", "component_received_events_total=Gauge"})
+	if err != nil {
+		t.Fatalf("parseForceTypes() error = %v", err)
+	}
+	want := map[string]dto.MetricType{
+		"component_buffer_events":         dto.MetricType_COUNTER,
+		"component_received_events_total": dto.MetricType_GAUGE,
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("parseForceTypes() mismatch (-want +got):\n%s", diff)
+	}
+
+	for _, pairs := range [][]string{
+		{"component_buffer_events"},
+		{"=counter"},
+		{"component_buffer_events=counters"},
+		{"component_buffer_events=histogram"},
+	} {
+		if _, err := parseForceTypes(pairs); err == nil {
+			t.Errorf("parseForceTypes(%q) expected error", pairs)
+		}
+	}
+}
+
+func Test_CollectorForceType(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP component_buffer_events component_buffer_events
+# TYPE component_buffer_events gauge
+component_buffer_events{l1="v1",pod="p1"} 1 1735054883000
+component_buffer_events{l1="v1",pod="p2"} 2 1735054883000
+# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{l1="v1",pod="p1"} 3 1735054883000
+component_received_events_total{l1="v1",pod="p2"} 4 1735054883000
+component_untyped_events{l1="v1",pod="p1"} 5 1735054883000
+component_untyped_events{l1="v1",pod="p2"} 6 1735054883000
+# HELP component_request_duration_seconds component_request_duration_seconds
+# TYPE component_request_duration_seconds histogram
+component_request_duration_seconds_bucket{l1="v1",pod="p1",le="+Inf"} 1 1735054883000
+component_request_duration_seconds_sum{l1="v1",pod="p1"} 1 1735054883000
+component_request_duration_seconds_count{l1="v1",pod="p1"} 1 1735054883000
+`)
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{
+		url:                    ts.URL,
+		aggregateWithOutLabels: []string{"pod"},
+		forceTypes: map[string]dto.MetricType{
+			"component_buffer_events":            dto.MetricType_COUNTER,
+			"component_received_events_total":    dto.MetricType_GAUGE,
+			"component_request_duration_seconds": dto.MetricType_GAUGE,
+		},
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	// untyped series are aggregated too and histograms keep their type
+	want := `# HELP component_buffer_events component_buffer_events
+# TYPE component_buffer_events counter
+component_buffer_events{l1="v1"} 3 1735054883000
+# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total gauge
+component_received_events_total{l1="v1"} 7 1735054883000
+# HELP component_request_duration_seconds component_request_duration_seconds
+# TYPE component_request_duration_seconds histogram
+component_request_duration_seconds_bucket{l1="v1",le="+Inf"} 1 1735054883000
+component_request_duration_seconds_sum{l1="v1"} 1 1735054883000
+component_request_duration_seconds_count{l1="v1"} 1 1735054883000
+# HELP component_untyped_events 
+# TYPE component_untyped_events untyped
+component_untyped_events{l1="v1"} 11 1735054883000
+`
+	if diff := cmp.Diff(metricsToText(gathering), want); diff != "" {
+		t.Errorf("collector output mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_CollectorPhaseDuration(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprint(w, "# TYPE component_buffer_events gauge\ncomponent_buffer_events{pod=\"p1\"} 1\n")
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{url: ts.URL, aggregateWithOutLabels: []string{"pod"}}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+	if _, err := reg.Gather(); err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	for _, phase := range []string{"fetch", "decode", "aggregate"} {
+		metric := &dto.Metric{}
+		if err := phaseDuration.WithLabelValues(ts.URL, phase).(prometheus.Histogram).Write(metric); err != nil {
+			t.Fatal(err)
+		}
+		if got := metric.GetHistogram().GetSampleCount(); got != 1 {
+			t.Errorf("%s observations = %d, want 1", phase, got)
+		}
+		// the target delays its response headers
+		if got := metric.GetHistogram().GetSampleSum(); phase == "fetch" && got < 0.05 {
+			t.Errorf("fetch duration = %v, want at least 0.05", got)
+		}
+	}
+}
+
+func Test_CollectorMergeDuplicateFamilies(t *testing.T) {
+	log = slog.Default()
+
+	gauge := func(help, pod string, value float64) *dto.MetricFamily {
+		return &dto.MetricFamily{
+			Name: proto.String("component_buffer_events"),
+			Help: proto.String(help),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{
+				Label:       []*dto.LabelPair{{Name: pointer("l1"), Value: pointer("v1")}, {Name: pointer("pod"), Value: pointer(pod)}},
+				Gauge:       &dto.Gauge{Value: proto.Float64(value)},
+				TimestampMs: proto.Int64(1735054883000),
+			}},
+		}
+	}
+	counter := gauge("Buffered events", "p4", 8)
+	counter.Type = dto.MetricType_COUNTER.Enum()
+	counter.Metric[0].Gauge, counter.Metric[0].Counter = nil, &dto.Counter{Value: proto.Float64(8)}
+	families := []*dto.MetricFamily{
+		gauge("Number of buffered events", "p1", 1),
+		gauge("Number of buffered events.", "p2", 2),
+		counter,
+		gauge("Buffered events", "p3", 4),
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		format := expfmt.NewFormat(expfmt.TypeProtoDelim)
+		w.Header().Set("Content-Type", string(format))
+		encoder := expfmt.NewEncoder(w, format)
+		for _, family := range families {
+			if err := encoder.Encode(family); err != nil {
+				t.Error(err)
+			}
+		}
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name            string
+		mergeDuplicates bool
+		want            string
+	}{
+		{
+			name: "skipped",
+			want: `# HELP component_buffer_events Number of buffered events
+# TYPE component_buffer_events gauge
+component_buffer_events{l1="v1"} 1 1735054883000
+`,
+		},
+		{
+			name:            "merged",
+			mergeDuplicates: true,
+			want: `# HELP component_buffer_events Number of buffered events
+# TYPE component_buffer_events gauge
+component_buffer_events{l1="v1"} 7 1735054883000
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collector := &RemoteAggregator{
+				url:                    ts.URL,
+				aggregateWithOutLabels: []string{"pod"},
+				mergeDuplicates:        tt.mergeDuplicates,
+			}
+
+			reg := prometheus.NewPedanticRegistry()
+			reg.MustRegister(collector)
+
+			gathering, err := reg.Gather()
+			if err != nil {
+				t.Fatalf("reg.Gather() error = %v", err)
+			}
+			if diff := cmp.Diff(metricsToText(gathering), tt.want); diff != "" {
+				t.Errorf("collector output mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_CollectorMergeDuplicateFamiliesText(t *testing.T) {
+	log = slog.Default()
+
+	// the text parser rejects a family declared more than once
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP component_buffer_events Number of buffered events
+# TYPE component_buffer_events gauge
+component_buffer_events{l1="v1",pod="p1"} 1 1735054883000
+# HELP component_buffer_events Number of buffered events.
+# TYPE component_buffer_events gauge
+component_buffer_events{l1="v1",pod="p2"} 2 1735054883000
+# HELP component_buffer_events Buffered events
+# TYPE component_buffer_events counter
+component_buffer_events{l1="v1",pod="p4"} 8 1735054883000
+# HELP component_buffer_events Buffered events
+# TYPE component_buffer_events gauge
+component_buffer_events{l1="v1",pod="p3"} 4 1735054883000
+# HELP component_queue_length Queue length
+# TYPE component_queue_length gauge
+component_queue_length{l1="v1",pod="p1"} 3 1735054883000
+`)
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{
+		url:                    ts.URL,
+		aggregateWithOutLabels: []string{"pod"},
+		mergeDuplicates:        true,
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+	want := `# HELP component_buffer_events Number of buffered events
+# TYPE component_buffer_events gauge
+component_buffer_events{l1="v1"} 7 1735054883000
+# HELP component_queue_length Queue length
+# TYPE component_queue_length gauge
+component_queue_length{l1="v1"} 3 1735054883000
+`
+	if diff := cmp.Diff(metricsToText(gathering), want); diff != "" {
+		t.Errorf("collector output mismatch (-want +got):\n%s", diff)
+	}
+	if got := testutil.ToFloat64(targetUp.WithLabelValues(ts.URL)); got != 1 {
+		t.Errorf("target up = %v, want 1", got)
+	}
+}
+
+func TestTruncateLabelValue(t *testing.T) {
+	tests := []struct {
+		value  string
+		length int
+		want   string
+		wantOK bool
+	}{
+		{"short", 0, "short", false},
+		{"short", 5, "short", false},
+		{"too long", 5, "too …", true},
+		{"ünïcödé", 4, "ünï…", true},
+	}
+	for _, tt := range tests {
+		got, ok := truncateLabelValue(tt.value, tt.length)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("truncateLabelValue(%q, %d) = %q, %v, want %q, %v", tt.value, tt.length, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func Test_CollectorMaxLabelValueLength(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP component_errors_total component_errors_total
+# TYPE component_errors_total counter
+component_errors_total{error="panic: runtime error at main.go:10",pod="p1"} 1 1735054883000
+component_errors_total{error="panic: runtime error at main.go:20",pod="p2"} 2 1735054883000
+component_errors_total{error="timeout",pod="p3"} 4 1735054883000
+`)
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{
+		url:                    ts.URL,
+		aggregateWithOutLabels: []string{"pod"},
+		maxLabelValueLength:    21,
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	before := testutil.ToFloat64(truncatedLabelValues.WithLabelValues(ts.URL))
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	// values truncated to the same value are aggregated together
+	want := `# HELP component_errors_total component_errors_total
+# TYPE component_errors_total counter
+component_errors_total{error="panic: runtime error…"} 3 1735054883000
+component_errors_total{error="timeout"} 4 1735054883000
+`
+	if diff := cmp.Diff(metricsToText(gathering), want); diff != "" {
+		t.Errorf("collector output mismatch (-want +got):\n%s", diff)
+	}
+	if got := testutil.ToFloat64(truncatedLabelValues.WithLabelValues(ts.URL)) - before; got != 2 {
+		t.Errorf("truncated label values = %v, want 2", got)
+	}
+}
+
+func Test_CollectorMaxOutputSeries(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# TYPE component_buffer_events gauge
+component_buffer_events{l1="v1",pod="p1"} 1 1735054883000
+component_buffer_events{l1="v2",pod="p1"} 2 1735054883000
+# TYPE component_received_events_total counter
+component_received_events_total{l1="v1",pod="p1"} 3 1735054883000
+`)
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		limit        int
+		wantSeries   int
+		wantExceeded float64
+	}{
+		{0, 3, 0},
+		{3, 3, 0},
+		{2, 2, 1},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.limit), func(t *testing.T) {
+			collector := &RemoteAggregator{
+				url:                    ts.URL,
+				aggregateWithOutLabels: []string{"pod"},
+				maxOutputSeries:        tt.limit,
+			}
+
+			reg := prometheus.NewPedanticRegistry()
+			reg.MustRegister(collector)
+
+			gathering, err := reg.Gather()
+			if err != nil {
+				t.Fatalf("reg.Gather() error = %v", err)
+			}
+			var series int
+			for _, mf := range gathering {
+				series += len(mf.Metric)
+			}
+			if series != tt.wantSeries {
+				t.Errorf("exported series = %d, want %d", series, tt.wantSeries)
+			}
+			if got := testutil.ToFloat64(outputSeriesLimitExceeded.WithLabelValues(ts.URL)); got != tt.wantExceeded {
+				t.Errorf("limit exceeded = %v, want %v", got, tt.wantExceeded)
+			}
+		})
+	}
+}
+
+func Test_CollectorExemptLabelValues(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{l1="v1",pod="p1",zone="z1"} 1 1735054883000
+component_received_events_total{l1="v1",pod="p2",zone="z2"} 2 1735054883000
+component_received_events_total{l1="v1",pod="canary",zone="z1"} 4 1735054883000
+component_received_events_total{l1="v1",pod="canary",zone="z2"} 8 1735054883000
+`)
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{
+		url:                    ts.URL,
+		aggregateWithOutLabels: []string{"pod", "zone"},
+		exemptLabelValues:      []labelMatcher{{"pod", "canary"}, {"l1", "v1"}},
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	// the canary is still aggregated over the zone
+	want := `# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{l1="v1"} 3 1735054883000
+component_received_events_total{l1="v1",pod="canary"} 12 1735054883000
+`
+	if diff := cmp.Diff(metricsToText(gathering), want); diff != "" {
+		t.Errorf("collector output mismatch (-want +got):\n%s", diff)
+	}
+}
+
+// benchmarkMetrics returns n counter series with labels of a 50 way service
+// and a pod unique to every series
+func benchmarkMetrics(n int) []*dto.Metric {
+	metrics := make([]*dto.Metric, 0, n)
+	for i := range n {
+		metrics = append(metrics, &dto.Metric{
+			Label: []*dto.LabelPair{
+				{Name: pointer("cluster"), Value: pointer("prod")},
+				{Name: pointer("method"), Value: pointer("GET")},
+				{Name: pointer("pod"), Value: pointer(fmt.Sprintf("pod-%d", i))},
+				{Name: pointer("service"), Value: pointer(fmt.Sprintf("service-%d", i%50))},
+			},
+			Counter: &dto.Counter{Value: proto.Float64(float64(i))},
+		})
+	}
+	return metrics
+}
+
+func BenchmarkAggregateMetrics(b *testing.B) {
+	metrics := benchmarkMetrics(50000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		aggregateMetrics(metrics, []string{"pod"}, false)
+	}
+}
+
+// BenchmarkScrapePeakHeap reports the peak heap of scraping and aggregating a
+// family of 50k series into 25k series, with the collected metrics written
+// and discarded like the registry does. The metrics are only streamed with
+// timeout=0s, with a scrape timeout, as by default, they're buffered until the
+// response is decoded.
+func BenchmarkScrapePeakHeap(b *testing.B) {
+	log = slog.New(slog.NewTextHandler(io.Discard, nil))
+	defer func() { log = slog.Default() }()
+
+	metrics := benchmarkMetrics(50000)
+	for i, metric := range metrics {
+		// every pair of pods is aggregated into one series
+		metric.Label[2].Value = pointer(fmt.Sprintf("pod-%d", i/2))
+		metric.Label = append(metric.Label, &dto.LabelPair{Name: pointer("replica"), Value: pointer(fmt.Sprint(i % 2))})
+	}
+	var body bytes.Buffer
+	family := &dto.MetricFamily{Name: pointer("component_received_events_total"), Type: dto.MetricType_COUNTER.Enum(), Metric: metrics}
+	format := expfmt.NewFormat(expfmt.TypeProtoDelim)
+	if err := expfmt.NewEncoder(&body, format).Encode(family); err != nil {
+		b.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", string(format))
+		w.Write(body.Bytes())
+	}))
+	defer ts.Close()
+
+	for _, timeout := range []time.Duration{0, 10 * time.Second} {
+		b.Run(fmt.Sprintf("timeout=%s", timeout), func(b *testing.B) {
+			collector := &RemoteAggregator{url: ts.URL, aggregateWithOutLabels: []string{"replica"}, scrapeTimeout: timeout}
+
+			// a low GC target keeps the heap close to the live heap
+			defer debug.SetGCPercent(debug.SetGCPercent(10))
+			var peak uint64
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				ch := make(chan prometheus.Metric)
+				done := make(chan struct{})
+				go func() {
+					defer close(done)
+					var stats runtime.MemStats
+					for metric := range ch {
+						if err := metric.Write(&dto.Metric{}); err != nil {
+							b.Error(err)
+						}
+						runtime.ReadMemStats(&stats)
+						peak = max(peak, stats.HeapAlloc)
+					}
+				}()
+
+				runtime.GC()
+				if _, err := collector.scrape(context.Background(), time.Now(), ch, false); err != nil {
+					b.Fatal(err)
+				}
+				close(ch)
+				<-done
+			}
+			b.ReportMetric(float64(peak)/(1<<20), "peak-heap-MiB")
+		})
+	}
+}
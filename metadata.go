@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// metricMetadata is the metadata of an exported metric family, in the format
+// of the Prometheus /api/v1/metadata endpoint
+type metricMetadata struct {
+	Type string `json:"type"`
+	Help string `json:"help"`
+	Unit string `json:"unit"`
+}
+
+// metadataResponse is the response of the metadata endpoint, with the metadata
+// of every metric family by name
+type metadataResponse struct {
+	Status string                      `json:"status"`
+	Data   map[string][]metricMetadata `json:"data"`
+}
+
+// metadataHandler returns a handler which lists the type and help of the
+// metric families exported by the last collection of all targets. Families
+// exported by several targets are listed once per distinct metadata.
+func metadataHandler(collectors func() []*RemoteAggregator) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		response := metadataResponse{Status: "success", Data: make(map[string][]metricMetadata)}
+		for _, collector := range collectors() {
+			for _, mf := range collector.LastResult() {
+				metadata := metricMetadata{Type: metadataType(mf.GetType()), Help: mf.GetHelp(), Unit: mf.GetUnit()}
+				if !slices.Contains(response.Data[mf.GetName()], metadata) {
+					response.Data[mf.GetName()] = append(response.Data[mf.GetName()], metadata)
+				}
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			log.Error("error writing metadata", "err", err)
+		}
+	})
+}
+
+// metadataType returns the Prometheus metadata name of the metric type, e.g.
+// gaugehistogram
+func metadataType(metricType dto.MetricType) string {
+	if metricType == dto.MetricType_UNTYPED {
+		return "unknown"
+	}
+	return strings.ReplaceAll(strings.ToLower(metricType.String()), "_", "")
+}
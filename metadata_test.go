@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestMetadataHandler(t *testing.T) {
+	log = slog.Default()
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP component_received_events_total Number of received events
+# TYPE component_received_events_total counter
+component_received_events_total{l1="v1",l2="v2"} 10 1735054883000
+# HELP component_buffer_events Number of buffered events
+# TYPE component_buffer_events gauge
+component_buffer_events{l1="v1",l2="v2"} 5 1735054883000
+`)
+	}))
+	defer target.Close()
+
+	c1 := &RemoteAggregator{url: target.URL, aggregateWithOutLabels: []string{"l2"}}
+	c2 := &RemoteAggregator{url: target.URL, aggregateWithOutLabels: []string{"l2"}, addPrefix: "prefixed_"}
+	collectors := func() []*RemoteAggregator { return []*RemoteAggregator{c1, c2} }
+
+	rec := httptest.NewRecorder()
+	metadataHandler(collectors).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metadata", nil))
+	var got metadataResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+	// nothing is listed before the first collection
+	if diff := cmp.Diff(got, metadataResponse{Status: "success", Data: map[string][]metricMetadata{}}); diff != "" {
+		t.Errorf("metadata mismatch (-want +got):\n%s", diff)
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c1, c2)
+	if _, err := reg.Gather(); err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	rec = httptest.NewRecorder()
+	metadataHandler(collectors).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metadata", nil))
+	if contentType := rec.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("content type = %q, want application/json", contentType)
+	}
+	got = metadataResponse{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+
+	counter := []metricMetadata{{Type: "counter", Help: "Number of received events"}}
+	gauge := []metricMetadata{{Type: "gauge", Help: "Number of buffered events"}}
+	want := metadataResponse{Status: "success", Data: map[string][]metricMetadata{
+		"component_received_events_total":          counter,
+		"component_buffer_events":                  gauge,
+		"prefixed_component_received_events_total": counter,
+		"prefixed_component_buffer_events":         gauge,
+	}}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("metadata mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"maps"
+	"math"
+	"slices"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// nativeHistogram is the sum of native histograms, merged at the lowest
+// schema and the highest zero threshold of the summed histograms
+type nativeHistogram struct {
+	schema        int32
+	zeroThreshold float64
+	zeroCount     uint64
+	// positive and negative are the bucket counts by bucket index
+	positive map[int]int64
+	negative map[int]int64
+}
+
+// isNativeHistogram reports whether h is a native histogram, which may have
+// classic buckets as well
+func isNativeHistogram(h *dto.Histogram) bool {
+	return h.GetZeroThreshold() > 0 || h.GetZeroCount() > 0 || len(h.PositiveSpan) > 0 || len(h.NegativeSpan) > 0
+}
+
+// addNative adds the native buckets of a histogram to the aggregate. Those of
+// histograms without classic buckets are also summed apart, as they replace
+// their classic buckets if the native buckets are dropped.
+func (a *aggregate) addNative(h *dto.Histogram) {
+	a.native = addNativeBuckets(a.native, h)
+	if len(h.Bucket) == 0 {
+		a.nativeOnly = addNativeBuckets(a.nativeOnly, h)
+	}
+}
+
+// dropNative drops the native buckets of an aggregate of native and classic
+// only histograms, as they don't count the observations of the classic only
+// ones. The histograms without classic buckets add their native buckets as
+// classic buckets instead, so the classic buckets count all observations.
+func (a *aggregate) dropNative() {
+	if a.nativeOnly != nil {
+		a.addBucketCounts(a.nativeOnly.classicBuckets())
+	}
+	a.native, a.nativeOnly = nil, nil
+}
+
+// addNativeBuckets returns n with the native buckets of h added, or the
+// native buckets of h if n is nil
+func addNativeBuckets(n *nativeHistogram, h *dto.Histogram) *nativeHistogram {
+	positive := nativeBuckets(h.PositiveSpan, h.PositiveDelta)
+	negative := nativeBuckets(h.NegativeSpan, h.NegativeDelta)
+	if n == nil {
+		return &nativeHistogram{
+			schema:        h.GetSchema(),
+			zeroThreshold: h.GetZeroThreshold(),
+			zeroCount:     h.GetZeroCount(),
+			positive:      positive,
+			negative:      negative,
+		}
+	}
+
+	if h.GetSchema() < n.schema {
+		n.positive = downscaleBuckets(n.positive, n.schema, h.GetSchema())
+		n.negative = downscaleBuckets(n.negative, n.schema, h.GetSchema())
+		n.schema = h.GetSchema()
+	}
+	for index, count := range downscaleBuckets(positive, h.GetSchema(), n.schema) {
+		n.positive[index] += count
+	}
+	for index, count := range downscaleBuckets(negative, h.GetSchema(), n.schema) {
+		n.negative[index] += count
+	}
+	n.zeroCount += h.GetZeroCount()
+	if h.GetZeroThreshold() > n.zeroThreshold {
+		n.zeroThreshold = h.GetZeroThreshold()
+	}
+	n.widenZeroBucket()
+	return n
+}
+
+// nativeBuckets returns the bucket counts by bucket index of the spans and
+// the count deltas of their buckets
+func nativeBuckets(spans []*dto.BucketSpan, deltas []int64) map[int]int64 {
+	buckets := make(map[int]int64)
+	var index int
+	var count int64
+	var i int
+	for _, span := range spans {
+		// the offset of the first span is the index of its first bucket,
+		// the following ones are the gap to the previous span
+		index += int(span.GetOffset())
+		for range span.GetLength() {
+			if i >= len(deltas) {
+				return buckets
+			}
+			count += deltas[i]
+			i++
+			buckets[index] = count
+			index++
+		}
+	}
+	return buckets
+}
+
+// downscaleBuckets returns the buckets of schema merged into the buckets of
+// the lower or equal schema target
+func downscaleBuckets(buckets map[int]int64, schema, target int32) map[int]int64 {
+	if schema == target {
+		return buckets
+	}
+	result := make(map[int]int64, len(buckets))
+	for index, count := range buckets {
+		// every schema step merges two adjacent buckets
+		result[((index-1)>>(schema-target))+1] += count
+	}
+	return result
+}
+
+// upperBound returns the absolute upper bound of the bucket with index
+func (n *nativeHistogram) upperBound(index int) float64 {
+	return math.Exp2(math.Ldexp(float64(index), -int(n.schema)))
+}
+
+// widenZeroBucket moves the counts of the buckets within the zero threshold
+// into the zero bucket
+func (n *nativeHistogram) widenZeroBucket() {
+	for _, buckets := range []map[int]int64{n.positive, n.negative} {
+		for index, count := range buckets {
+			if n.upperBound(index) <= n.zeroThreshold {
+				n.zeroCount += uint64(count)
+				delete(buckets, index)
+			}
+		}
+	}
+}
+
+// classicBuckets returns the cumulative counts of the buckets by upper bound,
+// with a classic bucket for every native bucket
+func (n *nativeHistogram) classicBuckets() map[float64]uint64 {
+	counts := make(map[float64]uint64)
+	for index, count := range n.negative {
+		// negative buckets are mirrored, so their upper bound is the lower
+		// bound of the positive bucket
+		counts[-n.upperBound(index-1)] += uint64(count)
+	}
+	counts[n.zeroThreshold] += n.zeroCount
+	for index, count := range n.positive {
+		counts[n.upperBound(index)] += uint64(count)
+	}
+
+	buckets := make(map[float64]uint64, len(counts))
+	var cumulative uint64
+	for _, bound := range slices.Sorted(maps.Keys(counts)) {
+		cumulative += counts[bound]
+		buckets[bound] = cumulative
+	}
+	return buckets
+}
+
+// nativeHistogramMetric returns the native histogram of the aggregate, which
+// keeps the classic buckets of the aggregated histograms if they had any
+func nativeHistogramMetric(desc *prometheus.Desc, a *aggregate) (prometheus.Metric, error) {
+	n := a.native
+	metric, err := prometheus.NewConstNativeHistogram(desc, a.count, a.sum, n.positive, n.negative, n.zeroCount, n.schema, n.zeroThreshold, a.created)
+	if err != nil {
+		return nil, err
+	}
+	return &hybridHistogram{Metric: metric, created: !a.created.IsZero(), buckets: a.buckets}, nil
+}
+
+// hybridHistogram is a native histogram with classic buckets
+type hybridHistogram struct {
+	prometheus.Metric
+	// created is whether the histogram has a created timestamp
+	created bool
+	// buckets are the cumulative counts of the classic buckets by upper bound
+	buckets map[float64]uint64
+}
+
+func (h *hybridHistogram) Write(out *dto.Metric) error {
+	if err := h.Metric.Write(out); err != nil {
+		return err
+	}
+	if !h.created {
+		out.Histogram.CreatedTimestamp = nil
+	}
+	for _, bound := range slices.Sorted(maps.Keys(h.buckets)) {
+		out.Histogram.Bucket = append(out.Histogram.Bucket, &dto.Bucket{
+			UpperBound:      proto.Float64(bound),
+			CumulativeCount: proto.Uint64(h.buckets[bound]),
+		})
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestNativeBuckets(t *testing.T) {
+	spans := []*dto.BucketSpan{
+		{Offset: proto.Int32(-1), Length: proto.Uint32(2)},
+		{Offset: proto.Int32(2), Length: proto.Uint32(1)},
+	}
+	got := nativeBuckets(spans, []int64{3, -1, 2})
+	want := map[int]int64{-1: 3, 0: 2, 3: 4}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("nativeBuckets() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestDownscaleBuckets(t *testing.T) {
+	// at schema 1 the buckets 1 and 2 are (1, 1.41] and (1.41, 2], which
+	// make up the bucket 1 (1, 2] at schema 0
+	got := downscaleBuckets(map[int]int64{-1: 1, 0: 2, 1: 3, 2: 4, 3: 5}, 1, 0)
+	want := map[int]int64{0: 3, 1: 7, 2: 5}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("downscaleBuckets() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestWidenZeroBucket(t *testing.T) {
+	n := &nativeHistogram{
+		zeroThreshold: 2,
+		zeroCount:     1,
+		positive:      map[int]int64{0: 1, 1: 2, 2: 3},
+		negative:      map[int]int64{1: 4, 2: 5},
+	}
+	n.widenZeroBucket()
+	if n.zeroCount != 8 {
+		t.Errorf("zero count = %d, want 8", n.zeroCount)
+	}
+	if diff := cmp.Diff(n.positive, map[int]int64{2: 3}); diff != "" {
+		t.Errorf("positive buckets mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(n.negative, map[int]int64{2: 5}); diff != "" {
+		t.Errorf("negative buckets mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_CollectorNativeHistograms(t *testing.T) {
+	log = slog.Default()
+
+	series := func(pod string, h *dto.Histogram) *dto.Metric {
+		return &dto.Metric{
+			Label:     []*dto.LabelPair{{Name: pointer("l1"), Value: pointer("v1")}, {Name: pointer("pod"), Value: pointer(pod)}},
+			Histogram: h,
+		}
+	}
+	family := &dto.MetricFamily{
+		Name: proto.String("component_request_duration_seconds"),
+		Help: proto.String("component_request_duration_seconds"),
+		Type: dto.MetricType_HISTOGRAM.Enum(),
+		Metric: []*dto.Metric{
+			series("p1", &dto.Histogram{
+				SampleCount:   proto.Uint64(4),
+				SampleSum:     proto.Float64(4),
+				Schema:        proto.Int32(0),
+				ZeroThreshold: proto.Float64(0.001),
+				ZeroCount:     proto.Uint64(1),
+				PositiveSpan:  []*dto.BucketSpan{{Offset: proto.Int32(0), Length: proto.Uint32(2)}},
+				PositiveDelta: []int64{1, 1},
+			}),
+			series("p2", &dto.Histogram{
+				SampleCount:   proto.Uint64(3),
+				SampleSum:     proto.Float64(5),
+				Schema:        proto.Int32(1),
+				ZeroThreshold: proto.Float64(0.001),
+				PositiveSpan:  []*dto.BucketSpan{{Offset: proto.Int32(1), Length: proto.Uint32(2)}},
+				PositiveDelta: []int64{2, -1},
+			}),
+		},
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		format := expfmt.NewFormat(expfmt.TypeProtoDelim)
+		w.Header().Set("Content-Type", string(format))
+		if err := expfmt.NewEncoder(w, format).Encode(family); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer ts.Close()
+
+	gather := func(nativeAsClassic bool) *dto.Histogram {
+		collector := &RemoteAggregator{
+			url:                    ts.URL,
+			aggregateWithOutLabels: []string{"pod"},
+			nativeAsClassic:        nativeAsClassic,
+		}
+
+		reg := prometheus.NewPedanticRegistry()
+		reg.MustRegister(collector)
+
+		gathering, err := reg.Gather()
+		if err != nil {
+			t.Fatalf("reg.Gather() error = %v", err)
+		}
+		if len(gathering) != 1 || len(gathering[0].Metric) != 1 {
+			t.Fatalf("got %v, want a single aggregated histogram", gathering)
+		}
+		return gathering[0].Metric[0].GetHistogram()
+	}
+
+	// merged at schema 0, where both buckets of p2 fall into the bucket 1
+	h := gather(false)
+	if h.GetSampleCount() != 7 || h.GetSampleSum() != 9 || h.GetSchema() != 0 || h.GetZeroCount() != 1 {
+		t.Errorf("got count %d, sum %v, schema %d and zero count %d, want 7, 9, 0 and 1", h.GetSampleCount(), h.GetSampleSum(), h.GetSchema(), h.GetZeroCount())
+	}
+	if diff := cmp.Diff(nativeBuckets(h.PositiveSpan, h.PositiveDelta), map[int]int64{0: 1, 1: 5}); diff != "" {
+		t.Errorf("positive buckets mismatch (-want +got):\n%s", diff)
+	}
+	if h.CreatedTimestamp != nil {
+		t.Errorf("created timestamp = %v, want none", h.CreatedTimestamp)
+	}
+
+	h = gather(true)
+	if isNativeHistogram(h) {
+		t.Errorf("got native histogram %v, want classic", h)
+	}
+	got := make(map[float64]uint64)
+	for _, bucket := range h.Bucket {
+		got[bucket.GetUpperBound()] = bucket.GetCumulativeCount()
+	}
+	if diff := cmp.Diff(got, map[float64]uint64{0.001: 1, 1: 2, 2: 7}); diff != "" {
+		t.Errorf("classic buckets mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_CollectorNativeAndClassicHistograms(t *testing.T) {
+	log = slog.Default()
+
+	series := func(pod string, h *dto.Histogram) *dto.Metric {
+		return &dto.Metric{
+			Label:     []*dto.LabelPair{{Name: pointer("l1"), Value: pointer("v1")}, {Name: pointer("pod"), Value: pointer(pod)}},
+			Histogram: h,
+		}
+	}
+	family := &dto.MetricFamily{
+		Name: proto.String("component_request_duration_seconds"),
+		Help: proto.String("component_request_duration_seconds"),
+		Type: dto.MetricType_HISTOGRAM.Enum(),
+		Metric: []*dto.Metric{
+			series("p1", &dto.Histogram{
+				SampleCount:   proto.Uint64(4),
+				SampleSum:     proto.Float64(4),
+				Schema:        proto.Int32(0),
+				ZeroThreshold: proto.Float64(0.001),
+				ZeroCount:     proto.Uint64(1),
+				PositiveSpan:  []*dto.BucketSpan{{Offset: proto.Int32(0), Length: proto.Uint32(2)}},
+				PositiveDelta: []int64{1, 1},
+			}),
+			series("p2", &dto.Histogram{
+				SampleCount: proto.Uint64(3),
+				SampleSum:   proto.Float64(5),
+				Bucket: []*dto.Bucket{
+					{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(2)},
+					{UpperBound: proto.Float64(5), CumulativeCount: proto.Uint64(3)},
+				},
+			}),
+		},
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		format := expfmt.NewFormat(expfmt.TypeProtoDelim)
+		w.Header().Set("Content-Type", string(format))
+		if err := expfmt.NewEncoder(w, format).Encode(family); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{url: ts.URL, aggregateWithOutLabels: []string{"pod"}}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+	if len(gathering) != 1 || len(gathering[0].Metric) != 1 {
+		t.Fatalf("got %v, want a single aggregated histogram", gathering)
+	}
+	h := gathering[0].Metric[0].GetHistogram()
+
+	// the native buckets wouldn't count the observations of p2, so they're
+	// dropped and p1 adds its native buckets as classic buckets
+	if isNativeHistogram(h) {
+		t.Errorf("got native histogram %v, want classic", h)
+	}
+	if h.GetSampleCount() != 7 || h.GetSampleSum() != 9 {
+		t.Errorf("got count %d and sum %v, want 7 and 9", h.GetSampleCount(), h.GetSampleSum())
+	}
+	got := make(map[float64]uint64)
+	for _, bucket := range h.Bucket {
+		got[bucket.GetUpperBound()] = bucket.GetCumulativeCount()
+	}
+	if diff := cmp.Diff(got, map[float64]uint64{0.001: 1, 1: 4, 2: 6, 5: 7}); diff != "" {
+		t.Errorf("classic buckets mismatch (-want +got):\n%s", diff)
+	}
+}
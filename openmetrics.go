@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/proto"
+)
+
+// openMetricsType is the media type of the OpenMetrics text format, which
+// expfmt.ResponseFormat doesn't recognize
+const openMetricsType = "application/openmetrics-text"
+
+// responseFormat returns the format of a response from its content type,
+// including the OpenMetrics text format
+func responseFormat(header http.Header) expfmt.Format {
+	if mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type")); err == nil && mediaType == openMetricsType {
+		return expfmt.NewFormat(expfmt.TypeOpenMetrics)
+	}
+	return expfmt.ResponseFormat(header)
+}
+
+// openMetricsDecoder decodes the OpenMetrics text format by translating it
+// into the text format, which the text parser decodes. Exemplars and created
+// timestamps are dropped as the text format can't carry them.
+type openMetricsDecoder struct {
+	decoder expfmt.Decoder
+	// types are the OpenMetrics types of the families by name
+	types map[string]string
+}
+
+func newOpenMetricsDecoder(body io.Reader) *openMetricsDecoder {
+	d := &openMetricsDecoder{types: make(map[string]string)}
+	reader := &openMetricsReader{reader: bufio.NewReader(body), types: d.types}
+	d.decoder = expfmt.NewDecoder(reader, expfmt.NewFormat(expfmt.TypeTextPlain))
+	return d
+}
+
+func (d *openMetricsDecoder) Decode(metricFamily *dto.MetricFamily) error {
+	if err := d.decoder.Decode(metricFamily); err != nil {
+		return err
+	}
+	// the samples of counters and info metrics were translated to the name
+	// of their family, which lacks the suffix of the text format
+	name := metricFamily.GetName()
+	switch d.types[name] {
+	case "counter":
+		if !strings.HasSuffix(name, "_total") {
+			metricFamily.Name = proto.String(name + "_total")
+		}
+	case "info":
+		metricFamily.Name = proto.String(name + "_info")
+	}
+	return nil
+}
+
+// openMetricsReader translates the lines of an OpenMetrics body into the text
+// format as they're read
+type openMetricsReader struct {
+	reader *bufio.Reader
+	types  map[string]string
+	// family and familyType are the name and type of the last declared family
+	family     string
+	familyType string
+	// buf is the unread rest of the last translated line and err the error
+	// returned once it's read
+	buf []byte
+	err error
+}
+
+func (r *openMetricsReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		var line string
+		line, r.err = r.reader.ReadString('\n')
+		r.buf = []byte(r.translate(line))
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// translate returns line in the text format, or "" if it has no equivalent
+func (r *openMetricsReader) translate(line string) string {
+	if line == "" || line == "\n" {
+		return line
+	}
+	if strings.HasPrefix(line, "#") {
+		return r.translateDescriptor(line)
+	}
+
+	name, rest := line, ""
+	if i := strings.IndexAny(line, "{ "); i >= 0 {
+		name, rest = line[:i], line[i:]
+	}
+	var labels string
+	if strings.HasPrefix(rest, "{") {
+		end := labelsEnd(rest)
+		labels, rest = rest[:end], rest[end:]
+	}
+	// the exemplar follows the value and timestamp
+	if i := strings.IndexByte(rest, '#'); i >= 0 {
+		rest = rest[:i]
+	}
+
+	if suffix, ok := strings.CutPrefix(name, r.family); ok {
+		switch {
+		case suffix == "_created":
+			return ""
+		case r.familyType == "counter" && suffix == "_total",
+			r.familyType == "info" && suffix == "_info":
+			name = r.family
+		case r.familyType == "gaugehistogram" && suffix == "_gcount":
+			name = r.family + "_count"
+		case r.familyType == "gaugehistogram" && suffix == "_gsum":
+			name = r.family + "_sum"
+		}
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) == 2 {
+		// OpenMetrics timestamps are in seconds, the text format ones in
+		// milliseconds
+		if timestamp, err := strconv.ParseFloat(fields[1], 64); err == nil {
+			fields[1] = strconv.FormatInt(int64(math.Round(timestamp*1000)), 10)
+		}
+	}
+	return name + labels + " " + strings.Join(fields, " ") + "\n"
+}
+
+// translateDescriptor translates a comment line, recording the declared
+// families
+func (r *openMetricsReader) translateDescriptor(line string) string {
+	fields := strings.SplitN(strings.TrimSuffix(line, "\n"), " ", 4)
+	if len(fields) < 2 {
+		return line
+	}
+	switch fields[1] {
+	case "EOF", "UNIT":
+		return ""
+	case "TYPE":
+		if len(fields) < 4 {
+			return line
+		}
+		r.family, r.familyType = fields[2], fields[3]
+		r.types[r.family] = r.familyType
+		return "# TYPE " + r.family + " " + textType(r.familyType) + "\n"
+	case "HELP":
+		if len(fields) < 4 {
+			return line
+		}
+		// quotes are escaped in OpenMetrics help texts only
+		return "# HELP " + fields[2] + " " + strings.ReplaceAll(fields[3], `\"`, `"`) + "\n"
+	}
+	return line
+}
+
+// textType returns the text format type of an OpenMetrics type
+func textType(openMetricsType string) string {
+	switch openMetricsType {
+	case "counter", "gauge", "histogram", "summary":
+		return openMetricsType
+	case "gaugehistogram":
+		return "histogram"
+	case "stateset", "info":
+		return "gauge"
+	}
+	return "untyped"
+}
+
+// labelsEnd returns the index following the label set at the start of s,
+// skipping the braces within quoted label values
+func labelsEnd(s string) int {
+	quoted := false
+	for i := 1; i < len(s); i++ {
+		switch {
+		case quoted && s[i] == '\\':
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case !quoted && s[i] == '}':
+			return i + 1
+		}
+	}
+	return len(s)
+}
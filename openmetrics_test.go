@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func Test_CollectorOpenMetrics(t *testing.T) {
+	log = slog.Default()
+
+	// the target serves OpenMetrics whatever the scraper accepts
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+		fmt.Fprint(w, `# HELP http_requests Requests with a \"quoted\" help.
+# TYPE http_requests counter
+http_requests_total{pod="p1",path="/a{b}"} 1 1735054883.5 # {trace_id="abc"} 1 1735054883.0
+http_requests_created{pod="p1",path="/a{b}"} 1735054000
+http_requests_total{pod="p2",path="/a{b}"} 2 1735054883.5
+# HELP build build
+# TYPE build info
+build_info{version="1.0"} 1 1735054883
+# HELP latency_seconds latency_seconds
+# TYPE latency_seconds histogram
+# UNIT latency_seconds seconds
+latency_seconds_bucket{pod="p1",le="1.0"} 1 1735054883
+latency_seconds_bucket{pod="p1",le="+Inf"} 2 1735054883
+latency_seconds_sum{pod="p1"} 3 1735054883
+latency_seconds_count{pod="p1"} 2 1735054883
+latency_seconds_created{pod="p1"} 1735054000
+latency_seconds_bucket{pod="p2",le="1.0"} 0 1735054883
+latency_seconds_bucket{pod="p2",le="+Inf"} 1 1735054883
+latency_seconds_sum{pod="p2"} 2 1735054883
+latency_seconds_count{pod="p2"} 1 1735054883
+# EOF
+`)
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{
+		url:                    ts.URL,
+		aggregateWithOutLabels: []string{"pod"},
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	// the families get the names of the text format, the timestamps are
+	// converted to milliseconds and the exemplars and created lines dropped
+	want := `# HELP build_info build
+# TYPE build_info gauge
+build_info{version="1.0"} 1 1735054883000
+# HELP http_requests_total Requests with a "quoted" help.
+# TYPE http_requests_total counter
+http_requests_total{path="/a{b}"} 3 1735054883500
+# HELP latency_seconds latency_seconds
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="1"} 1 1735054883000
+latency_seconds_bucket{le="+Inf"} 3 1735054883000
+latency_seconds_sum 5 1735054883000
+latency_seconds_count 3 1735054883000
+`
+	if diff := cmp.Diff(metricsToText(gathering), want); diff != "" {
+		t.Errorf("collector output mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"math"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/sdk/instrumentation"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var otlpExportFailures = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "aggregator_otlp_export_failures_total",
+	Help: "Number of OTLP metrics exports which failed after all retries",
+})
+
+// otlpExporter pushes the gathered metrics to an OTLP metrics endpoint
+type otlpExporter struct {
+	exporter *otlpmetrichttp.Exporter
+	resource *resource.Resource
+	// start is the start time of cumulative metrics without a created
+	// timestamp
+	start time.Time
+}
+
+// newOTLPExporter returns an exporter pushing to the OTLP/HTTP endpoint url,
+// failed exports are retried by the OTLP exporter until timeout
+func newOTLPExporter(ctx context.Context, endpoint string, timeout time.Duration) (*otlpExporter, error) {
+	// the OTLP exporter silently ignores invalid urls
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q, must be http or https", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing host")
+	}
+
+	exporter, err := otlpmetrichttp.New(ctx,
+		otlpmetrichttp.WithEndpointURL(endpoint),
+		otlpmetrichttp.WithTimeout(timeout),
+		otlpmetrichttp.WithRetry(otlpmetrichttp.RetryConfig{
+			Enabled:         true,
+			InitialInterval: time.Second,
+			MaxInterval:     timeout / 2,
+			MaxElapsedTime:  timeout,
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &otlpExporter{
+		exporter: exporter,
+		resource: resource.NewSchemaless(attribute.String("service.name", "metrics-aggregator")),
+		start:    time.Now(),
+	}, nil
+}
+
+// run pushes the metrics gathered from gatherer every interval until ctx is
+// done
+func (e *otlpExporter) run(ctx context.Context, gatherer prometheus.Gatherer, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			e.push(ctx, gatherer)
+		}
+	}
+}
+
+// push gathers the metrics and exports them, metrics gathered despite a
+// gathering error are still exported
+func (e *otlpExporter) push(ctx context.Context, gatherer prometheus.Gatherer) {
+	families, err := gatherer.Gather()
+	if err != nil {
+		log.Error("error gathering metrics for OTLP export", "err", err)
+	}
+	if len(families) == 0 {
+		return
+	}
+
+	rm := &metricdata.ResourceMetrics{
+		Resource: e.resource,
+		ScopeMetrics: []metricdata.ScopeMetrics{{
+			Scope:   instrumentation.Scope{Name: "github.com/utilitywarehouse/metrics-aggregator", Version: version},
+			Metrics: otlpMetrics(families, e.start, time.Now()),
+		}},
+	}
+	if err := e.exporter.Export(ctx, rm); err != nil {
+		log.Error("error exporting OTLP metrics", "err", err)
+		otlpExportFailures.Inc()
+	}
+}
+
+// otlpMetrics converts the metric families into OTLP metrics. Counters become
+// monotonic cumulative sums, gauges and untyped metrics gauges, classic and
+// native histograms explicit bucket and exponential histograms. Cumulative
+// metrics without a created timestamp start at start and metrics without a
+// timestamp are stamped with now.
+func otlpMetrics(families []*dto.MetricFamily, start, now time.Time) []metricdata.Metrics {
+	var result []metricdata.Metrics
+	for _, mf := range families {
+		sum := metricdata.Sum[float64]{Temporality: metricdata.CumulativeTemporality, IsMonotonic: true}
+		var gauge metricdata.Gauge[float64]
+		histogram := metricdata.Histogram[float64]{Temporality: metricdata.CumulativeTemporality}
+		exponential := metricdata.ExponentialHistogram[float64]{Temporality: metricdata.CumulativeTemporality}
+		var summary metricdata.Summary
+
+		for _, metric := range mf.Metric {
+			attributes := otlpAttributes(metric.Label)
+			timestamp := now
+			if metric.TimestampMs != nil {
+				timestamp = time.UnixMilli(metric.GetTimestampMs())
+			}
+
+			switch {
+			case metric.Counter != nil:
+				sum.DataPoints = append(sum.DataPoints, metricdata.DataPoint[float64]{
+					Attributes: attributes,
+					StartTime:  startTime(metric.GetCounter().GetCreatedTimestamp(), start),
+					Time:       timestamp,
+					Value:      metric.GetCounter().GetValue(),
+				})
+			case metric.Gauge != nil, metric.Untyped != nil:
+				value := metric.GetGauge().GetValue()
+				if metric.Untyped != nil {
+					value = metric.GetUntyped().GetValue()
+				}
+				gauge.DataPoints = append(gauge.DataPoints, metricdata.DataPoint[float64]{
+					Attributes: attributes,
+					Time:       timestamp,
+					Value:      value,
+				})
+			case metric.Summary != nil:
+				s := metric.GetSummary()
+				point := metricdata.SummaryDataPoint{
+					Attributes: attributes,
+					StartTime:  startTime(s.GetCreatedTimestamp(), start),
+					Time:       timestamp,
+					Count:      s.GetSampleCount(),
+					Sum:        s.GetSampleSum(),
+				}
+				for _, quantile := range s.Quantile {
+					point.QuantileValues = append(point.QuantileValues, metricdata.QuantileValue{Quantile: quantile.GetQuantile(), Value: quantile.GetValue()})
+				}
+				summary.DataPoints = append(summary.DataPoints, point)
+			case metric.Histogram != nil && isNativeHistogram(metric.Histogram):
+				h := metric.GetHistogram()
+				exponential.DataPoints = append(exponential.DataPoints, metricdata.ExponentialHistogramDataPoint[float64]{
+					Attributes:     attributes,
+					StartTime:      startTime(h.GetCreatedTimestamp(), start),
+					Time:           timestamp,
+					Count:          h.GetSampleCount(),
+					Sum:            h.GetSampleSum(),
+					Scale:          h.GetSchema(),
+					ZeroCount:      h.GetZeroCount(),
+					ZeroThreshold:  h.GetZeroThreshold(),
+					PositiveBucket: exponentialBucket(nativeBuckets(h.PositiveSpan, h.PositiveDelta)),
+					NegativeBucket: exponentialBucket(nativeBuckets(h.NegativeSpan, h.NegativeDelta)),
+				})
+			case metric.Histogram != nil:
+				h := metric.GetHistogram()
+				point := metricdata.HistogramDataPoint[float64]{
+					Attributes: attributes,
+					StartTime:  startTime(h.GetCreatedTimestamp(), start),
+					Time:       timestamp,
+					Count:      h.GetSampleCount(),
+					Sum:        h.GetSampleSum(),
+				}
+				// OTLP buckets are not cumulative and the +Inf bucket is
+				// implicit
+				var cumulative uint64
+				for _, bucket := range h.Bucket {
+					if math.IsInf(bucket.GetUpperBound(), +1) {
+						break
+					}
+					point.Bounds = append(point.Bounds, bucket.GetUpperBound())
+					point.BucketCounts = append(point.BucketCounts, bucket.GetCumulativeCount()-cumulative)
+					cumulative = bucket.GetCumulativeCount()
+				}
+				point.BucketCounts = append(point.BucketCounts, h.GetSampleCount()-cumulative)
+				histogram.DataPoints = append(histogram.DataPoints, point)
+			}
+		}
+
+		add := func(data metricdata.Aggregation, points int) {
+			if points > 0 {
+				result = append(result, metricdata.Metrics{Name: mf.GetName(), Description: mf.GetHelp(), Unit: mf.GetUnit(), Data: data})
+			}
+		}
+		add(sum, len(sum.DataPoints))
+		add(gauge, len(gauge.DataPoints))
+		add(histogram, len(histogram.DataPoints))
+		add(exponential, len(exponential.DataPoints))
+		add(summary, len(summary.DataPoints))
+	}
+	return result
+}
+
+// otlpAttributes returns the labels as attributes
+func otlpAttributes(labels []*dto.LabelPair) attribute.Set {
+	kvs := make([]attribute.KeyValue, 0, len(labels))
+	for _, label := range labels {
+		kvs = append(kvs, attribute.String(label.GetName(), label.GetValue()))
+	}
+	return attribute.NewSet(kvs...)
+}
+
+// startTime returns the created timestamp if the metric has one and start
+// otherwise
+func startTime(created *timestamppb.Timestamp, start time.Time) time.Time {
+	if created != nil {
+		return created.AsTime()
+	}
+	return start
+}
+
+// exponentialBucket returns the OTLP buckets of native histogram bucket
+// counts by index
+func exponentialBucket(buckets map[int]int64) metricdata.ExponentialBucket {
+	if len(buckets) == 0 {
+		return metricdata.ExponentialBucket{}
+	}
+	indexes := slices.Sorted(maps.Keys(buckets))
+	first, last := indexes[0], indexes[len(indexes)-1]
+	counts := make([]uint64, last-first+1)
+	for index, count := range buckets {
+		counts[index-first] = uint64(count)
+	}
+	// the native bucket with index i is (base^(i-1), base^i] while the OTLP
+	// bucket with index i is (base^i, base^(i+1)]
+	return metricdata.ExponentialBucket{Offset: int32(first - 1), Counts: counts}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata/metricdatatest"
+	collectormetrics "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestOTLPMetrics(t *testing.T) {
+	start, now := time.UnixMilli(1735054800000), time.UnixMilli(1735054890000)
+	families := []*dto.MetricFamily{
+		{
+			Name: proto.String("component_received_events_total"),
+			Help: proto.String("Received events"),
+			Type: dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{{
+				Label:       []*dto.LabelPair{labelPair("l1", "v1")},
+				Counter:     &dto.Counter{Value: proto.Float64(10)},
+				TimestampMs: proto.Int64(1735054883000),
+			}},
+		},
+		{
+			Name:   proto.String("component_queue_length"),
+			Type:   dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(3)}}},
+		},
+		{
+			Name: proto.String("component_request_duration_seconds"),
+			Type: dto.MetricType_HISTOGRAM.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Label: []*dto.LabelPair{labelPair("l1", "v1")},
+					Histogram: &dto.Histogram{
+						SampleCount: proto.Uint64(6),
+						SampleSum:   proto.Float64(4),
+						Bucket: []*dto.Bucket{
+							{UpperBound: proto.Float64(0.5), CumulativeCount: proto.Uint64(1)},
+							{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(4)},
+						},
+					},
+				},
+				{
+					Label: []*dto.LabelPair{labelPair("l1", "v2")},
+					Histogram: &dto.Histogram{
+						SampleCount:   proto.Uint64(4),
+						SampleSum:     proto.Float64(4),
+						Schema:        proto.Int32(0),
+						ZeroThreshold: proto.Float64(0.001),
+						ZeroCount:     proto.Uint64(1),
+						PositiveSpan:  []*dto.BucketSpan{{Offset: proto.Int32(0), Length: proto.Uint32(2)}},
+						PositiveDelta: []int64{1, 1},
+					},
+				},
+			},
+		},
+	}
+
+	got := otlpMetrics(families, start, now)
+	want := []metricdata.Metrics{
+		{
+			Name:        "component_received_events_total",
+			Description: "Received events",
+			Data: metricdata.Sum[float64]{
+				Temporality: metricdata.CumulativeTemporality,
+				IsMonotonic: true,
+				DataPoints: []metricdata.DataPoint[float64]{{
+					Attributes: attribute.NewSet(attribute.String("l1", "v1")),
+					StartTime:  start,
+					Time:       time.UnixMilli(1735054883000),
+					Value:      10,
+				}},
+			},
+		},
+		{
+			Name: "component_queue_length",
+			Data: metricdata.Gauge[float64]{
+				DataPoints: []metricdata.DataPoint[float64]{{Time: now, Value: 3}},
+			},
+		},
+		{
+			Name: "component_request_duration_seconds",
+			Data: metricdata.Histogram[float64]{
+				Temporality: metricdata.CumulativeTemporality,
+				DataPoints: []metricdata.HistogramDataPoint[float64]{{
+					Attributes:   attribute.NewSet(attribute.String("l1", "v1")),
+					StartTime:    start,
+					Time:         now,
+					Count:        6,
+					Sum:          4,
+					Bounds:       []float64{0.5, 1},
+					BucketCounts: []uint64{1, 3, 2},
+				}},
+			},
+		},
+		{
+			Name: "component_request_duration_seconds",
+			Data: metricdata.ExponentialHistogram[float64]{
+				Temporality: metricdata.CumulativeTemporality,
+				DataPoints: []metricdata.ExponentialHistogramDataPoint[float64]{{
+					Attributes:    attribute.NewSet(attribute.String("l1", "v2")),
+					StartTime:     start,
+					Time:          now,
+					Count:         4,
+					Sum:           4,
+					ZeroCount:     1,
+					ZeroThreshold: 0.001,
+					// the native buckets (0.5, 1] and (1, 2]
+					PositiveBucket: metricdata.ExponentialBucket{Offset: -1, Counts: []uint64{1, 2}},
+				}},
+			},
+		},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d metrics, want %d", len(got), len(want))
+	}
+	for i := range want {
+		metricdatatest.AssertEqual(t, want[i], got[i])
+	}
+}
+
+func TestOTLPExporterPush(t *testing.T) {
+	log = slog.Default()
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# TYPE component_received_events_total counter
+component_received_events_total{l1="v1",l2="v2"} 10 1735054883000
+component_received_events_total{l1="v1",l2="v3"} 20 1735054883000
+`)
+	}))
+	defer target.Close()
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(&RemoteAggregator{url: target.URL, aggregateWithOutLabels: []string{"l2"}})
+
+	tests := []struct {
+		name        string
+		status      int
+		wantFailure bool
+	}{
+		{"success", http.StatusOK, false},
+		{"bad-request", http.StatusBadRequest, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, err := io.ReadAll(r.Body)
+				if err != nil {
+					t.Error(err)
+				}
+				request := &collectormetrics.ExportMetricsServiceRequest{}
+				if err := proto.Unmarshal(body, request); err != nil {
+					t.Errorf("proto.Unmarshal() error = %v", err)
+				}
+				for _, rm := range request.ResourceMetrics {
+					for _, sm := range rm.ScopeMetrics {
+						for _, m := range sm.Metrics {
+							for _, point := range m.GetSum().GetDataPoints() {
+								got = append(got, fmt.Sprintf("%s %v %d", m.GetName(), point.GetAsDouble(), len(point.GetAttributes())))
+							}
+						}
+					}
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer endpoint.Close()
+
+			exporter, err := newOTLPExporter(context.Background(), endpoint.URL+"/v1/metrics", time.Second)
+			if err != nil {
+				t.Fatalf("newOTLPExporter() error = %v", err)
+			}
+			before := testutil.ToFloat64(otlpExportFailures)
+			exporter.push(context.Background(), reg)
+
+			if failed := testutil.ToFloat64(otlpExportFailures) > before; failed != tt.wantFailure {
+				t.Errorf("failed = %v, want %v", failed, tt.wantFailure)
+			}
+			want := []string{"component_received_events_total 30 1"}
+			if diff := cmp.Diff(got, want); diff != "" {
+				t.Errorf("exported metrics mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestNewOTLPExporterInvalidEndpoint(t *testing.T) {
+	for _, endpoint := range []string{"collector:4318", "grpc://collector:4317", "http://"} {
+		if _, err := newOTLPExporter(context.Background(), endpoint, time.Second); err == nil {
+			t.Errorf("newOTLPExporter(%q) error = nil, want error", endpoint)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"maps"
+	"slices"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// passthroughMetric is a scraped series exported verbatim
+type passthroughMetric struct {
+	desc   *prometheus.Desc
+	metric *dto.Metric
+}
+
+func (m passthroughMetric) Desc() *prometheus.Desc {
+	return m.desc
+}
+
+func (m passthroughMetric) Write(out *dto.Metric) error {
+	proto.Merge(out, m.metric)
+	return nil
+}
+
+// passThroughAndSend sends the series of the family to ch unchanged under
+// name, without aggregating, relabeling or prefixing them. Only the constant
+// labels are set, so the same series of several targets don't collide.
+// Series with the labels of a previous series are skipped, as they would fail
+// the collection. The series must not be modified afterwards.
+func (ra *RemoteAggregator) passThroughAndSend(metricFamily *dto.MetricFamily, name string, state *scrapeState, ch chan<- prometheus.Metric) *dto.MetricFamily {
+	result := &dto.MetricFamily{
+		Name: proto.String(name),
+		Help: metricFamily.Help,
+		Type: metricFamily.Type,
+	}
+
+	constantLabels := slices.Sorted(maps.Keys(ra.addLabels))
+	seen := make(map[string]bool, len(metricFamily.Metric))
+	for _, metric := range metricFamily.Metric {
+		for _, name := range constantLabels {
+			metric.Label = setLabel(metric.Label, name, ra.addLabels[name])
+		}
+		key, labels := aggregationKey(metric, nil)
+		if seen[key] {
+			log.Error("skipping passed through series identical to a previous series", "remote", ra.url, "metric", name, "labels", key)
+			continue
+		}
+		seen[key] = true
+
+		// the registry expects the labels sorted by name
+		metric.Label = slices.SortedFunc(slices.Values(metric.Label), compareLabelNames)
+		if !state.send() {
+			continue
+		}
+		ch <- passthroughMetric{desc: prometheus.NewDesc(name, metricFamily.GetHelp(), nil, labels), metric: metric}
+		if ra.resultSeries {
+			result.Metric = append(result.Metric, metric)
+		}
+	}
+	return result
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func Test_CollectorPassthrough(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP up up
+# TYPE up gauge
+up{pod="p1",job="a"} 1
+up{pod="p2",job="a"} 0
+up{pod="p2",job="a"} 0
+# HELP scrape_duration_seconds scrape_duration_seconds
+# TYPE scrape_duration_seconds summary
+scrape_duration_seconds{pod="p1",quantile="0.5"} 0.1 1735054883000
+scrape_duration_seconds_sum{pod="p1"} 1 1735054883000
+scrape_duration_seconds_count{pod="p1"} 10 1735054883000
+# HELP http_requests_total http_requests_total
+# TYPE http_requests_total counter
+http_requests_total{pod="p1"} 1 1735054883000
+http_requests_total{pod="p2"} 2 1735054883000
+`)
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{
+		url:                    ts.URL,
+		aggregateWithOutLabels: []string{"pod"},
+		addPrefix:              "agg_",
+		addLabels:              map[string]string{"source": "aggregator"},
+		passthroughMetrics:     []string{"up", "scrape_duration_seconds"},
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	// passed through series keep their labels, quantiles and missing
+	// timestamps and get the constant labels, the duplicate series is skipped
+	want := `# HELP agg_http_requests_total http_requests_total
+# TYPE agg_http_requests_total counter
+agg_http_requests_total{source="aggregator"} 3 1735054883000
+# HELP scrape_duration_seconds scrape_duration_seconds
+# TYPE scrape_duration_seconds summary
+scrape_duration_seconds{pod="p1",source="aggregator",quantile="0.5"} 0.1 1735054883000
+scrape_duration_seconds_sum{pod="p1",source="aggregator"} 1 1735054883000
+scrape_duration_seconds_count{pod="p1",source="aggregator"} 10 1735054883000
+# HELP up up
+# TYPE up gauge
+up{job="a",pod="p1",source="aggregator"} 1
+up{job="a",pod="p2",source="aggregator"} 0
+`
+	if diff := cmp.Diff(metricsToText(gathering), want); diff != "" {
+		t.Errorf("collector output mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_CollectorKeepOriginal(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP http_requests_total http_requests_total
+# TYPE http_requests_total counter
+http_requests_total{pod="p1",service="api"} 1 1735054883000
+http_requests_total{pod="p2",service="api"} 2 1735054883000
+http_requests_total{pod="p3",service="debug"} 4 1735054883000
+`)
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{
+		url:                    ts.URL,
+		aggregateWithOutLabels: []string{"pod"},
+		renameLabels:           map[string]string{"service": "svc"},
+		dropIf:                 []labelMatcher{{name: "service", value: "debug"}},
+		keepOriginal:           true,
+		originalPrefix:         "raw_",
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	// the original series are filtered but not relabeled
+	want := `# HELP http_requests_total http_requests_total
+# TYPE http_requests_total counter
+http_requests_total{svc="api"} 3 1735054883000
+# HELP raw_http_requests_total http_requests_total
+# TYPE raw_http_requests_total counter
+raw_http_requests_total{pod="p1",service="api"} 1 1735054883000
+raw_http_requests_total{pod="p2",service="api"} 2 1735054883000
+`
+	if diff := cmp.Diff(metricsToText(gathering), want); diff != "" {
+		t.Errorf("collector output mismatch (-want +got):\n%s", diff)
+	}
+
+	// without a prefix the original metric collides with the aggregated one
+	collector.originalPrefix = ""
+	before := testutil.ToFloat64(nameCollisions.WithLabelValues(ts.URL))
+	if _, err := reg.Gather(); err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+	if got := testutil.ToFloat64(nameCollisions.WithLabelValues(ts.URL)) - before; got != 1 {
+		t.Errorf("name collisions = %v, want 1", got)
+	}
+}
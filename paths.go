@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// pathURL returns the url scraping path on the host of the target url
+func pathURL(targetURL, path string) (string, error) {
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid target url %q %w", targetURL, err)
+	}
+	u.Path = path
+	u.RawPath = ""
+	u.RawQuery = ""
+	return u.String(), nil
+}
+
+// pathsDecoder decodes the metric families of the target url and its extra
+// paths in turn. A path failing to be fetched or decoded is skipped, so it
+// doesn't abort the other paths.
+type pathsDecoder struct {
+	ctx      context.Context
+	remote   string
+	urls     []string
+	decoders []expfmt.Decoder
+	closers  []func()
+	// errs are the errors of the paths which failed out of all paths
+	errs  []error
+	paths int
+}
+
+// openPaths fetches the target url and its extra paths and returns the
+// decoder of their responses
+func (ra *RemoteAggregator) openPaths(ctx context.Context) *pathsDecoder {
+	d := &pathsDecoder{ctx: ctx, remote: ra.url, paths: 1 + len(ra.extraPaths)}
+	urls := []string{ra.url}
+	for _, path := range ra.extraPaths {
+		u, err := pathURL(ra.url, path)
+		if err != nil {
+			d.fail(path, &scrapeError{"request", err})
+			continue
+		}
+		urls = append(urls, u)
+	}
+
+	for _, u := range urls {
+		body, format, closeBody, err := ra.open(ctx, u)
+		if err != nil {
+			d.fail(u, err)
+			continue
+		}
+		d.urls = append(d.urls, u)
+		d.decoders = append(d.decoders, ra.newDecoder(body, format))
+		d.closers = append(d.closers, closeBody)
+	}
+	return d
+}
+
+// fail records the error of the path scraped on url
+func (d *pathsDecoder) fail(url string, err error) {
+	log.Error("error scraping path, skipping it", "remote", d.remote, "url", url, "err", err)
+	d.errs = append(d.errs, err)
+}
+
+func (d *pathsDecoder) Decode(metricFamily *dto.MetricFamily) error {
+	for len(d.decoders) > 0 {
+		err := d.decoders[0].Decode(metricFamily)
+		if err == nil {
+			return nil
+		}
+		if err != io.EOF {
+			// the scrape deadline aborts all paths
+			if d.ctx.Err() != nil {
+				return err
+			}
+			metricFamily.Reset()
+			d.fail(d.urls[0], &scrapeError{"decode", fmt.Errorf("error decoding metric family %w", err)})
+		}
+		d.urls, d.decoders = d.urls[1:], d.decoders[1:]
+	}
+	return io.EOF
+}
+
+// err returns the error of the scrape, which only fails if all paths failed,
+// and counts the scrape as partial if some failed. It's nil for a nil decoder.
+func (d *pathsDecoder) err() error {
+	if d == nil || len(d.errs) == 0 {
+		return nil
+	}
+	if len(d.errs) == d.paths {
+		return errors.Join(d.errs...)
+	}
+	partialScrapes.WithLabelValues(d.remote).Inc()
+	return nil
+}
+
+// close closes the responses of all paths
+func (d *pathsDecoder) close() {
+	for _, close := range d.closers {
+		close()
+	}
+}
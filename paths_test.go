@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func Test_pathURL(t *testing.T) {
+	tests := []struct {
+		name      string
+		targetURL string
+		path      string
+		want      string
+	}{
+		{
+			name:      "replaces the path",
+			targetURL: "http://localhost:9100/metrics",
+			path:      "/metrics/extra",
+			want:      "http://localhost:9100/metrics/extra",
+		},
+		{
+			name:      "drops the query",
+			targetURL: "https://localhost:9100/federate?match[]=up",
+			path:      "/metrics",
+			want:      "https://localhost:9100/metrics",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := pathURL(tt.targetURL, tt.path)
+			if err != nil {
+				t.Fatalf("pathURL() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("pathURL() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_CollectorExtraPaths(t *testing.T) {
+	log = slog.Default()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP http_requests_total http_requests_total
+# TYPE http_requests_total counter
+http_requests_total{pod="p1",service="api"} 1 1735054883000
+`)
+	})
+	mux.HandleFunc("/metrics/extra", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP http_requests_total http_requests_total
+# TYPE http_requests_total counter
+http_requests_total{pod="p2",service="api"} 2 1735054883000
+# HELP queue_length queue_length
+# TYPE queue_length gauge
+queue_length{pod="p2"} 5 1735054883000
+`)
+	})
+	mux.HandleFunc("/metrics/broken", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# TYPE broken gauge
+broken{pod="p1" 1
+`)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	collector := &RemoteAggregator{
+		url:                    ts.URL + "/metrics",
+		extraPaths:             []string{"/metrics/extra", "/metrics/missing", "/metrics/broken"},
+		aggregateWithOutLabels: []string{"pod"},
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	before := testutil.ToFloat64(partialScrapes.WithLabelValues(collector.url))
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	// the families of all paths are merged before aggregation, the failing
+	// paths are skipped
+	want := `# HELP http_requests_total http_requests_total
+# TYPE http_requests_total counter
+http_requests_total{service="api"} 3 1735054883000
+# HELP queue_length queue_length
+# TYPE queue_length gauge
+queue_length 5 1735054883000
+`
+	if diff := cmp.Diff(metricsToText(gathering), want); diff != "" {
+		t.Errorf("collector output mismatch (-want +got):\n%s", diff)
+	}
+	if got := testutil.ToFloat64(partialScrapes.WithLabelValues(collector.url)) - before; got != 1 {
+		t.Errorf("partial scrapes = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(targetUp.WithLabelValues(collector.url)); got != 1 {
+		t.Errorf("target up = %v, want 1", got)
+	}
+}
+
+func Test_CollectorExtraPathsAllFailing(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	collector := &RemoteAggregator{
+		url:                    ts.URL + "/metrics",
+		extraPaths:             []string{"/metrics/extra"},
+		aggregateWithOutLabels: []string{"pod"},
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	before := testutil.ToFloat64(scrapeErrors.WithLabelValues(collector.url, "status"))
+	if _, err := reg.Gather(); err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	if got := testutil.ToFloat64(targetUp.WithLabelValues(collector.url)); got != 0 {
+		t.Errorf("target up = %v, want 0", got)
+	}
+	if got := testutil.ToFloat64(scrapeErrors.WithLabelValues(collector.url, "status")) - before; got != 1 {
+		t.Errorf("scrape errors = %v, want 1", got)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+)
+
+// proxyHandler returns a handler which fetches the target's metrics and
+// serves the response unchanged
+func (ra *RemoteAggregator) proxyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, err := ra.newRequest(r.Context(), ra.url)
+		if err != nil {
+			log.Error("error creating proxy request", "remote", ra.url, "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if accept := r.Header.Get("Accept"); accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+
+		resp, err := ra.httpClient().Do(req)
+		if err != nil {
+			log.Error("error proxying metrics", "remote", ra.url, "err", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+
+		if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		w.WriteHeader(resp.StatusCode)
+
+		if _, err := io.Copy(w, resp.Body); err != nil {
+			log.Error("error proxying metrics", "remote", ra.url, "err", err)
+		}
+	})
+}
+
+// targetsProxyHandler returns a handler which proxies the target whose url is
+// given by the target query parameter, which may be omitted if there is only
+// one target. The targets are looked up on every request.
+func targetsProxyHandler(collectors func() []*RemoteAggregator) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		targets := collectors()
+		target := r.URL.Query().Get("target")
+		if target == "" && len(targets) == 1 {
+			target = targets[0].url
+		}
+
+		i := slices.IndexFunc(targets, func(c *RemoteAggregator) bool { return c.url == target })
+		if i < 0 {
+			http.Error(w, fmt.Sprintf("unknown target %q", target), http.StatusBadRequest)
+			return
+		}
+		targets[i].proxyHandler().ServeHTTP(w, r)
+	})
+}
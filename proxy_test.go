@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestProxyHandler(t *testing.T) {
+	log = slog.Default()
+
+	body := `# HELP component_received_events_total component_received_events_total
+# TYPE component_received_events_total counter
+component_received_events_total{l1="v1",l2="v2"} 10 1735054883000
+component_received_events_total{l1="v1",l2="v3"} 20 1735054883000
+`
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		fmt.Fprint(w, body)
+	}))
+	defer target.Close()
+
+	collector := &RemoteAggregator{
+		url:                    target.URL,
+		aggregateWithOutLabels: []string{"l2"},
+	}
+
+	proxy := httptest.NewServer(collector.proxyHandler())
+	defer proxy.Close()
+
+	resp, err := http.Get(proxy.URL)
+	if err != nil {
+		t.Fatalf("http.Get() error = %v", err)
+	}
+	defer resp.Body.Close()
+
+	got, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("io.ReadAll() error = %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status code = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/plain; version=0.0.4" {
+		t.Errorf("content type = %q, want text/plain; version=0.0.4", contentType)
+	}
+	if diff := cmp.Diff(string(got), body); diff != "" {
+		t.Errorf("proxied body mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestTargetsProxyHandler(t *testing.T) {
+	log = slog.Default()
+
+	newTarget := func(body string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, body)
+		}))
+	}
+	target1 := newTarget("target1")
+	defer target1.Close()
+	target2 := newTarget("target2")
+	defer target2.Close()
+
+	collectors := []*RemoteAggregator{{url: target1.URL}, {url: target2.URL}}
+
+	tests := []struct {
+		name       string
+		collectors []*RemoteAggregator
+		query      string
+		wantStatus int
+		wantBody   string
+	}{
+		{"single-target", collectors[:1], "", http.StatusOK, "target1"},
+		{"selected-target", collectors, "?target=" + url.QueryEscape(target2.URL), http.StatusOK, "target2"},
+		{"missing-target", collectors, "", http.StatusBadRequest, "unknown target \"\"\n"},
+		{"unknown-target", collectors, "?target=other", http.StatusBadRequest, "unknown target \"other\"\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			targetsProxyHandler(func() []*RemoteAggregator { return tt.collectors }).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/proxy"+tt.query, nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status code = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if diff := cmp.Diff(rec.Body.String(), tt.wantBody); diff != "" {
+				t.Errorf("body mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/proto"
+)
+
+// relabel actions
+const (
+	relabelKeep    = "keep"
+	relabelDrop    = "drop"
+	relabelReplace = "replace"
+)
+
+// relabelConfig is a Prometheus relabel_config style rule applied to the
+// labels of the aggregated series. The metric name is available as the
+// __name__ source label but can't be replaced.
+type relabelConfig struct {
+	SourceLabels []string `yaml:"source_labels"`
+	// Separator joins the source label values, ';' if not set
+	Separator string `yaml:"separator"`
+	// Regex must match the whole joined value, '(.*)' if not set
+	Regex string `yaml:"regex"`
+	// Action is keep, drop or replace, replace if not set
+	Action      string `yaml:"action"`
+	TargetLabel string `yaml:"target_label"`
+	// Replacement is expanded with the regex groups, '$1' if not set
+	Replacement *string `yaml:"replacement"`
+
+	regex *regexp.Regexp
+}
+
+// validate checks the rule, sets the defaults and compiles its regular
+// expression
+func (c *relabelConfig) validate() error {
+	if c.Separator == "" {
+		c.Separator = ";"
+	}
+	if c.Regex == "" {
+		c.Regex = "(.*)"
+	}
+	if c.Action == "" {
+		c.Action = relabelReplace
+	}
+	if c.Replacement == nil {
+		c.Replacement = proto.String("$1")
+	}
+
+	switch c.Action {
+	case relabelKeep, relabelDrop:
+		if len(c.SourceLabels) == 0 {
+			return fmt.Errorf("source_labels are required by action %s", c.Action)
+		}
+	case relabelReplace:
+		if c.TargetLabel == "" {
+			return errors.New("target_label is required by action replace")
+		}
+		if c.TargetLabel == "__name__" {
+			return errors.New("the metric name can't be replaced")
+		}
+		if !model.LegacyValidation.IsValidLabelName(c.TargetLabel) {
+			return fmt.Errorf("invalid target_label %q", c.TargetLabel)
+		}
+	default:
+		return fmt.Errorf("invalid action %q", c.Action)
+	}
+
+	regex, err := regexp.Compile("^(?:" + c.Regex + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid regex %w", err)
+	}
+	c.regex = regex
+	return nil
+}
+
+// apply applies the rule to the labels of a series of the named metric, it
+// returns false if the series is dropped
+func (c *relabelConfig) apply(name string, labels map[string]string) bool {
+	values := make([]string, 0, len(c.SourceLabels))
+	for _, label := range c.SourceLabels {
+		if label == "__name__" {
+			values = append(values, name)
+			continue
+		}
+		values = append(values, labels[label])
+	}
+	value := strings.Join(values, c.Separator)
+
+	switch c.Action {
+	case relabelKeep:
+		return c.regex.MatchString(value)
+	case relabelDrop:
+		return !c.regex.MatchString(value)
+	}
+
+	match := c.regex.FindStringSubmatchIndex(value)
+	if match == nil {
+		return true
+	}
+	// an empty value removes the label like a missing label
+	if replaced := string(c.regex.ExpandString(nil, *c.Replacement, value, match)); replaced != "" {
+		labels[c.TargetLabel] = replaced
+	} else {
+		delete(labels, c.TargetLabel)
+	}
+	return true
+}
+
+// relabeledMetric is a metric exported with replaced labels
+type relabeledMetric struct {
+	prometheus.Metric
+	desc   *prometheus.Desc
+	labels []*dto.LabelPair
+}
+
+func (m relabeledMetric) Desc() *prometheus.Desc {
+	return m.desc
+}
+
+func (m relabeledMetric) Write(out *dto.Metric) error {
+	if err := m.Metric.Write(out); err != nil {
+		return err
+	}
+	out.Label = m.labels
+	return nil
+}
+
+// relabelMetric applies the relabel rules in order to an aggregated metric
+// exported under name and written to out, and reports whether it's kept. The
+// labels of out are replaced by the relabeled labels. Metrics whose relabeled
+// labels are in seen, the labels of the previous metrics, are skipped, as they
+// would fail the collection.
+func (ra *RemoteAggregator) relabelMetric(relabel []relabelConfig, name, help string, seen map[string]bool, metric prometheus.Metric, out *dto.Metric) (prometheus.Metric, bool) {
+	labels := make(map[string]string, len(out.Label))
+	for _, label := range out.Label {
+		labels[label.GetName()] = label.GetValue()
+	}
+
+	for i := range relabel {
+		if !relabel[i].apply(name, labels) {
+			return nil, false
+		}
+	}
+
+	// label names and values are separated by 0xff like aggregation keys, as
+	// it can't occur in valid UTF-8
+	var key []byte
+	var pairs []*dto.LabelPair
+	for _, label := range slices.Sorted(maps.Keys(labels)) {
+		key = append(key, label...)
+		key = append(key, 0xff)
+		key = append(key, labels[label]...)
+		key = append(key, 0xff)
+		pairs = append(pairs, &dto.LabelPair{Name: proto.String(label), Value: proto.String(labels[label])})
+	}
+	if seen[string(key)] {
+		log.Error("skipping relabeled series identical to a previous series", "remote", ra.url, "metric", name, "labels", labels)
+		return nil, false
+	}
+	seen[string(key)] = true
+
+	out.Label = pairs
+	return relabeledMetric{
+		Metric: metric,
+		desc:   prometheus.NewDesc(name, help, nil, labels),
+		labels: pairs,
+	}, true
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestRelabelConfigApply(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     relabelConfig
+		labels     map[string]string
+		wantKeep   bool
+		wantLabels map[string]string
+	}{
+		{
+			name:       "keep-match",
+			config:     relabelConfig{SourceLabels: []string{"env"}, Regex: "prod|staging", Action: relabelKeep},
+			labels:     map[string]string{"env": "prod"},
+			wantKeep:   true,
+			wantLabels: map[string]string{"env": "prod"},
+		},
+		{
+			name:       "keep-partial-match",
+			config:     relabelConfig{SourceLabels: []string{"env"}, Regex: "prod", Action: relabelKeep},
+			labels:     map[string]string{"env": "production"},
+			wantKeep:   false,
+			wantLabels: map[string]string{"env": "production"},
+		},
+		{
+			name:       "drop-missing-label",
+			config:     relabelConfig{SourceLabels: []string{"env"}, Regex: "dev", Action: relabelDrop},
+			labels:     map[string]string{"service": "a"},
+			wantKeep:   true,
+			wantLabels: map[string]string{"service": "a"},
+		},
+		{
+			name:       "drop-name",
+			config:     relabelConfig{SourceLabels: []string{"__name__", "env"}, Regex: "http_.*;dev", Action: relabelDrop},
+			labels:     map[string]string{"env": "dev"},
+			wantKeep:   false,
+			wantLabels: map[string]string{"env": "dev"},
+		},
+		{
+			name:       "replace",
+			config:     relabelConfig{SourceLabels: []string{"service"}, Regex: "(.*)-canary", TargetLabel: "service"},
+			labels:     map[string]string{"service": "api-canary"},
+			wantKeep:   true,
+			wantLabels: map[string]string{"service": "api"},
+		},
+		{
+			name:       "replace-no-match",
+			config:     relabelConfig{SourceLabels: []string{"service"}, Regex: "(.*)-canary", TargetLabel: "service"},
+			labels:     map[string]string{"service": "api"},
+			wantKeep:   true,
+			wantLabels: map[string]string{"service": "api"},
+		},
+		{
+			name:       "replace-constant",
+			config:     relabelConfig{TargetLabel: "env", Replacement: proto.String("prod")},
+			labels:     map[string]string{"service": "api"},
+			wantKeep:   true,
+			wantLabels: map[string]string{"service": "api", "env": "prod"},
+		},
+		{
+			name:       "replace-empty-removes",
+			config:     relabelConfig{TargetLabel: "service", Replacement: proto.String("")},
+			labels:     map[string]string{"service": "api", "env": "prod"},
+			wantKeep:   true,
+			wantLabels: map[string]string{"env": "prod"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.validate(); err != nil {
+				t.Fatalf("validate() error = %v", err)
+			}
+			if got := tt.config.apply("http_requests_total", tt.labels); got != tt.wantKeep {
+				t.Errorf("apply() = %v, want %v", got, tt.wantKeep)
+			}
+			if diff := cmp.Diff(tt.labels, tt.wantLabels); diff != "" {
+				t.Errorf("labels mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_CollectorRelabel(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP http_requests_total http_requests_total
+# TYPE http_requests_total counter
+http_requests_total{service="api",pod="p1"} 1 1735054883000
+http_requests_total{service="api-canary",pod="p2"} 2 1735054883000
+http_requests_total{service="web",pod="p3"} 4 1735054883000
+http_requests_total{service="web-canary",pod="p4"} 8 1735054883000
+http_requests_total{service="debug",pod="p5"} 16 1735054883000
+`)
+	}))
+	defer ts.Close()
+
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(file, []byte(`relabel:
+  - source_labels: [service]
+    regex: debug
+    action: drop
+  - source_labels: [service]
+    regex: (.*)-canary
+    target_label: deployment
+    replacement: canary
+  - source_labels: [service]
+    regex: (.*)-canary
+    target_label: service
+  - source_labels: [__name__]
+    target_label: source
+`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := readConfig(file)
+	if err != nil {
+		t.Fatalf("readConfig() error = %v", err)
+	}
+
+	collector := &RemoteAggregator{
+		url:                    ts.URL,
+		aggregateWithOutLabels: []string{"pod"},
+		fileConfig:             newSharedConfig(cfg),
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	want := `# HELP http_requests_total http_requests_total
+# TYPE http_requests_total counter
+http_requests_total{service="api",source="http_requests_total"} 1 1735054883000
+http_requests_total{service="web",source="http_requests_total"} 4 1735054883000
+http_requests_total{deployment="canary",service="api",source="http_requests_total"} 2 1735054883000
+http_requests_total{deployment="canary",service="web",source="http_requests_total"} 8 1735054883000
+`
+	if diff := cmp.Diff(metricsToText(gathering), want); diff != "" {
+		t.Errorf("collector output mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_CollectorRelabelCollision(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP http_requests_total http_requests_total
+# TYPE http_requests_total counter
+http_requests_total{service="api"} 1 1735054883000
+http_requests_total{service="api-canary"} 2 1735054883000
+`)
+	}))
+	defer ts.Close()
+
+	relabel := []relabelConfig{{SourceLabels: []string{"service"}, Regex: "(.*)-canary", TargetLabel: "service"}}
+	if err := relabel[0].validate(); err != nil {
+		t.Fatal(err)
+	}
+	collector := &RemoteAggregator{url: ts.URL, fileConfig: newSharedConfig(&config{Relabel: relabel})}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	// series are relabeled in the order of their aggregation keys, so the api
+	// series colliding with the relabeled api-canary series is skipped
+	want := `# HELP http_requests_total http_requests_total
+# TYPE http_requests_total counter
+http_requests_total{service="api"} 2 1735054883000
+`
+	if diff := cmp.Diff(metricsToText(gathering), want); diff != "" {
+		t.Errorf("collector output mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_CollectorRelabelSeparatorInValue(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP http_requests_total http_requests_total
+# TYPE http_requests_total counter
+http_requests_total{env="prod,service=api"} 1 1735054883000
+http_requests_total{env="prod",service="api"} 2 1735054883000
+`)
+	}))
+	defer ts.Close()
+
+	relabel := []relabelConfig{{SourceLabels: []string{"service"}, Regex: "debug", Action: relabelDrop}}
+	if err := relabel[0].validate(); err != nil {
+		t.Fatal(err)
+	}
+	collector := &RemoteAggregator{url: ts.URL, fileConfig: newSharedConfig(&config{Relabel: relabel})}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	// label values containing the label separators of the text format are
+	// distinct series
+	want := `# HELP http_requests_total http_requests_total
+# TYPE http_requests_total counter
+http_requests_total{env="prod,service=api"} 1 1735054883000
+http_requests_total{env="prod",service="api"} 2 1735054883000
+`
+	if diff := cmp.Diff(metricsToText(gathering), want); diff != "" {
+		t.Errorf("collector output mismatch (-want +got):\n%s", diff)
+	}
+}
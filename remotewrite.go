@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+var remoteWriteFailures = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "aggregator_remote_write_failures_total",
+	Help: "Number of remote write requests which failed after all retries",
+})
+
+// remoteWriter pushes the gathered metrics to a Prometheus remote write
+// endpoint
+type remoteWriter struct {
+	url    string
+	client *http.Client
+	// retries is the number of times a request failing with a connection
+	// error or a 5xx or 429 response is retried, waiting backoff before the
+	// first retry and twice as long before every next one
+	retries int
+	backoff time.Duration
+}
+
+// run pushes the metrics gathered from gatherer every interval until ctx is
+// done
+func (w *remoteWriter) run(ctx context.Context, gatherer prometheus.Gatherer, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.push(ctx, gatherer)
+		}
+	}
+}
+
+// push gathers the metrics and sends them in a single remote write request,
+// metrics gathered despite a gathering error are still sent
+func (w *remoteWriter) push(ctx context.Context, gatherer prometheus.Gatherer) {
+	families, err := gatherer.Gather()
+	if err != nil {
+		log.Error("error gathering metrics for remote write", "err", err)
+	}
+	if len(families) == 0 {
+		return
+	}
+
+	body := snappy.Encode(nil, encodeWriteRequest(families, time.Now()))
+	if err := w.write(ctx, body); err != nil {
+		log.Error("error sending remote write request", "url", w.url, "err", err)
+		remoteWriteFailures.Inc()
+	}
+}
+
+// write sends the snappy compressed write request, retrying connection errors
+// and 5xx and 429 responses up to retries times with exponential backoff
+func (w *remoteWriter) write(ctx context.Context, body []byte) error {
+	backoff := w.backoff
+	for attempt := 1; ; attempt++ {
+		retry, err := w.send(ctx, body)
+		if err == nil || !retry || attempt > w.retries {
+			return err
+		}
+
+		log.Debug("retrying remote write", "url", w.url, "attempt", attempt, "backoff", backoff, "err", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// send sends the write request once, it returns whether a failed request may
+// be retried
+func (w *remoteWriter) send(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("error creating request %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Set("User-Agent", "metrics-aggregator/"+version)
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("error sending request %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	return resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+// remoteWriteSample is a sample of a remote write time series
+type remoteWriteSample struct {
+	// labels are sorted by name, including the metric name as __name__
+	labels      []*dto.LabelPair
+	value       float64
+	timestampMs int64
+}
+
+// remoteWriteSamples returns the samples of the metric families, split into
+// series like by a Prometheus scrape. Histograms and summaries become their
+// bucket or quantile, sum and count series, native histograms only export
+// their classic buckets. Metrics without a timestamp are stamped with now.
+func remoteWriteSamples(families []*dto.MetricFamily, now time.Time) []remoteWriteSample {
+	var samples []remoteWriteSample
+	for _, mf := range families {
+		for _, metric := range mf.Metric {
+			timestampMs := now.UnixMilli()
+			if metric.TimestampMs != nil {
+				timestampMs = metric.GetTimestampMs()
+			}
+			add := func(name string, value float64, extra ...*dto.LabelPair) {
+				labels := append([]*dto.LabelPair{{Name: proto.String("__name__"), Value: proto.String(name)}}, metric.Label...)
+				labels = append(labels, extra...)
+				slices.SortFunc(labels, func(a, b *dto.LabelPair) int { return strings.Compare(a.GetName(), b.GetName()) })
+				samples = append(samples, remoteWriteSample{labels: labels, value: value, timestampMs: timestampMs})
+			}
+
+			name := mf.GetName()
+			switch {
+			case metric.Gauge != nil:
+				add(name, metric.GetGauge().GetValue())
+			case metric.Counter != nil:
+				add(name, metric.GetCounter().GetValue())
+			case metric.Untyped != nil:
+				add(name, metric.GetUntyped().GetValue())
+			case metric.Summary != nil:
+				for _, quantile := range metric.GetSummary().Quantile {
+					add(name, quantile.GetValue(), labelPair("quantile", formatFloat(quantile.GetQuantile())))
+				}
+				add(name+"_sum", metric.GetSummary().GetSampleSum())
+				add(name+"_count", float64(metric.GetSummary().GetSampleCount()))
+			case metric.Histogram != nil:
+				h := metric.GetHistogram()
+				var inf bool
+				for _, bucket := range h.Bucket {
+					inf = inf || math.IsInf(bucket.GetUpperBound(), +1)
+					add(name+"_bucket", float64(bucket.GetCumulativeCount()), labelPair("le", formatFloat(bucket.GetUpperBound())))
+				}
+				if !inf {
+					add(name+"_bucket", float64(h.GetSampleCount()), labelPair("le", "+Inf"))
+				}
+				add(name+"_sum", h.GetSampleSum())
+				add(name+"_count", float64(h.GetSampleCount()))
+			}
+		}
+	}
+	return samples
+}
+
+// labelPair returns the label pair of name and value
+func labelPair(name, value string) *dto.LabelPair {
+	return &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)}
+}
+
+// formatFloat formats a bucket bound or quantile like the text format
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, +1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// encodeWriteRequest returns the remote write 1.0 WriteRequest protobuf
+// message with a time series for every sample of the metric families
+func encodeWriteRequest(families []*dto.MetricFamily, now time.Time) []byte {
+	var request []byte
+	for _, sample := range remoteWriteSamples(families, now) {
+		var series []byte
+		for _, label := range sample.labels {
+			var pair []byte
+			pair = protowire.AppendTag(pair, 1, protowire.BytesType)
+			pair = protowire.AppendString(pair, label.GetName())
+			pair = protowire.AppendTag(pair, 2, protowire.BytesType)
+			pair = protowire.AppendString(pair, label.GetValue())
+
+			series = protowire.AppendTag(series, 1, protowire.BytesType)
+			series = protowire.AppendBytes(series, pair)
+		}
+
+		var value []byte
+		value = protowire.AppendTag(value, 1, protowire.Fixed64Type)
+		value = protowire.AppendFixed64(value, math.Float64bits(sample.value))
+		value = protowire.AppendTag(value, 2, protowire.VarintType)
+		value = protowire.AppendVarint(value, uint64(sample.timestampMs))
+
+		series = protowire.AppendTag(series, 2, protowire.BytesType)
+		series = protowire.AppendBytes(series, value)
+
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, series)
+	}
+	return request
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// decodeWriteRequest returns the samples of a WriteRequest message as
+// name{label="value"} value timestamp lines
+func decodeWriteRequest(t *testing.T, request []byte) []string {
+	t.Helper()
+
+	// fields returns the bytes fields of a message by field number
+	fields := func(message []byte) map[protowire.Number][][]byte {
+		result := make(map[protowire.Number][][]byte)
+		for len(message) > 0 {
+			number, typ, n := protowire.ConsumeTag(message)
+			if n < 0 {
+				t.Fatalf("invalid tag: %v", protowire.ParseError(n))
+			}
+			message = message[n:]
+			n = protowire.ConsumeFieldValue(number, typ, message)
+			if n < 0 {
+				t.Fatalf("invalid field %d: %v", number, protowire.ParseError(n))
+			}
+			if typ == protowire.BytesType {
+				value, _ := protowire.ConsumeBytes(message)
+				result[number] = append(result[number], value)
+			} else {
+				result[number] = append(result[number], message[:n])
+			}
+			message = message[n:]
+		}
+		return result
+	}
+
+	var lines []string
+	for _, series := range fields(request)[1] {
+		seriesFields := fields(series)
+		var name string
+		var labels []string
+		for _, pair := range seriesFields[1] {
+			pairFields := fields(pair)
+			labelName, labelValue := string(pairFields[1][0]), string(pairFields[2][0])
+			if labelName == "__name__" {
+				name = labelValue
+				continue
+			}
+			labels = append(labels, fmt.Sprintf("%s=%q", labelName, labelValue))
+		}
+		sample := fields(seriesFields[2][0])
+		value, _ := protowire.ConsumeFixed64(sample[1][0])
+		timestamp, _ := protowire.ConsumeVarint(sample[2][0])
+		lines = append(lines, fmt.Sprintf("%s{%s} %v %d", name, strings.Join(labels, ","), math.Float64frombits(value), int64(timestamp)))
+	}
+	return lines
+}
+
+func TestEncodeWriteRequest(t *testing.T) {
+	families := []*dto.MetricFamily{
+		{
+			Name: proto.String("component_received_events_total"),
+			Type: dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{{
+				Label:       []*dto.LabelPair{labelPair("l1", "v1")},
+				Counter:     &dto.Counter{Value: proto.Float64(10)},
+				TimestampMs: proto.Int64(1735054883000),
+			}},
+		},
+		{
+			Name: proto.String("component_request_duration_seconds"),
+			Type: dto.MetricType_HISTOGRAM.Enum(),
+			Metric: []*dto.Metric{{
+				Label: []*dto.LabelPair{labelPair("l1", "v1")},
+				Histogram: &dto.Histogram{
+					SampleCount: proto.Uint64(3),
+					SampleSum:   proto.Float64(2),
+					Bucket:      []*dto.Bucket{{UpperBound: proto.Float64(0.5), CumulativeCount: proto.Uint64(1)}},
+				},
+			}},
+		},
+	}
+
+	got := decodeWriteRequest(t, encodeWriteRequest(families, time.UnixMilli(1735054890000)))
+	// labels are sorted and metrics without a timestamp are stamped with now
+	want := []string{
+		`component_received_events_total{l1="v1"} 10 1735054883000`,
+		`component_request_duration_seconds_bucket{l1="v1",le="0.5"} 1 1735054890000`,
+		`component_request_duration_seconds_bucket{l1="v1",le="+Inf"} 3 1735054890000`,
+		`component_request_duration_seconds_sum{l1="v1"} 2 1735054890000`,
+		`component_request_duration_seconds_count{l1="v1"} 3 1735054890000`,
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("write request mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestRemoteWriterPush(t *testing.T) {
+	log = slog.Default()
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# TYPE component_received_events_total counter
+component_received_events_total{l1="v1",l2="v2"} 10 1735054883000
+component_received_events_total{l1="v1",l2="v3"} 20 1735054883000
+`)
+	}))
+	defer target.Close()
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(&RemoteAggregator{url: target.URL, aggregateWithOutLabels: []string{"l2"}})
+
+	tests := []struct {
+		name         string
+		statuses     []int
+		wantRequests int32
+		wantFailure  bool
+	}{
+		{"success", []int{http.StatusNoContent}, 1, false},
+		{"retried", []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusNoContent}, 3, false},
+		{"bad-request", []int{http.StatusBadRequest}, 1, true},
+		{"retries-exhausted", []int{http.StatusInternalServerError}, 3, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			var got []string
+			endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				i := int(requests.Add(1)) - 1
+				if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+					t.Errorf("unexpected headers %v", r.Header)
+				}
+				body, err := io.ReadAll(r.Body)
+				if err != nil {
+					t.Error(err)
+				}
+				request, err := snappy.Decode(nil, body)
+				if err != nil {
+					t.Errorf("snappy.Decode() error = %v", err)
+				}
+				got = decodeWriteRequest(t, request)
+				w.WriteHeader(tt.statuses[min(i, len(tt.statuses)-1)])
+			}))
+			defer endpoint.Close()
+
+			writer := &remoteWriter{url: endpoint.URL, client: endpoint.Client(), retries: 2, backoff: time.Millisecond}
+			before := testutil.ToFloat64(remoteWriteFailures)
+			writer.push(context.Background(), reg)
+
+			if got := requests.Load(); got != tt.wantRequests {
+				t.Errorf("requests = %d, want %d", got, tt.wantRequests)
+			}
+			if failed := testutil.ToFloat64(remoteWriteFailures) > before; failed != tt.wantFailure {
+				t.Errorf("failed = %v, want %v", failed, tt.wantFailure)
+			}
+			want := []string{`component_received_events_total{l1="v1"} 30 1735054883000`}
+			if diff := cmp.Diff(got, want); diff != "" {
+				t.Errorf("pushed samples mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
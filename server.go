@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// serverConfig configures the endpoints served by the aggregator
+type serverConfig struct {
+	metricsPath string
+	healthPath  string
+	readyPath   string
+	proxyPath   string
+	// metadataPath serves the metadata of the exported metrics if set
+	metadataPath string
+	enablePprof  bool
+	// reload is called on POST /-/reload if set
+	reload func() error
+	// separateAdmin serves all endpoints except metrics on a separate mux,
+	// the probes are served on both
+	separateAdmin bool
+	// auth wraps every handler except the probes if set
+	auth func(http.Handler) http.Handler
+}
+
+// newMetricsHandler returns the handler serving the metrics gathered from
+// gatherer, in the OpenMetrics format to scrapers asking for it if openMetrics
+// is set. Responses are compressed for scrapers accepting gzip or zstd if
+// compression is set.
+func newMetricsHandler(gatherer prometheus.Gatherer, openMetrics, compression bool) http.Handler {
+	return promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{
+		EnableOpenMetrics:                   openMetrics,
+		EnableOpenMetricsTextCreatedSamples: openMetrics,
+		DisableCompression:                  !compression,
+	})
+}
+
+// newServeMuxes returns the mux serving the metrics and the mux serving the
+// admin endpoints. Both are the same mux unless separateAdmin is set.
+func newServeMuxes(cfg serverConfig, metrics http.Handler, ready *readiness, collectors func() []*RemoteAggregator) (*http.ServeMux, *http.ServeMux) {
+	// net/http/pprof registers its handlers on the default mux, so use
+	// dedicated ones to only expose them when enabled
+	protect := func(handler http.Handler) http.Handler {
+		if cfg.auth == nil {
+			return handler
+		}
+		return cfg.auth(handler)
+	}
+
+	// the probes are served next to the metrics as the admin address may
+	// only be reachable locally, and on the admin mux for the probes of the
+	// admin server
+	registerProbes := func(mux *http.ServeMux) {
+		if cfg.healthPath != "" {
+			mux.Handle(cfg.healthPath, healthHandler())
+		}
+		if cfg.readyPath != "" {
+			mux.Handle(cfg.readyPath, ready.handler())
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(cfg.metricsPath, protect(metrics))
+	registerProbes(mux)
+
+	adminMux := mux
+	if cfg.separateAdmin {
+		adminMux = http.NewServeMux()
+		registerProbes(adminMux)
+	}
+
+	if cfg.proxyPath != "" {
+		adminMux.Handle(cfg.proxyPath, protect(targetsProxyHandler(collectors)))
+	}
+
+	if cfg.metadataPath != "" {
+		adminMux.Handle(cfg.metadataPath, protect(metadataHandler(collectors)))
+	}
+
+	if cfg.reload != nil {
+		adminMux.Handle("POST /-/reload", protect(reloadHandler(cfg.reload)))
+	}
+
+	if cfg.enablePprof {
+		pprofMux := http.NewServeMux()
+		registerPprof(pprofMux)
+		adminMux.Handle("/debug/pprof/", protect(pprofMux))
+	}
+
+	return mux, adminMux
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestNewServeMuxes(t *testing.T) {
+	log = slog.Default()
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `component_received_events_total{l1="v1"} 10`)
+	}))
+	defer target.Close()
+
+	metrics := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	collector := &RemoteAggregator{url: target.URL}
+
+	tests := []struct {
+		name          string
+		separateAdmin bool
+		path          string
+		wantMain      int
+		wantAdmin     int
+	}{
+		{"shared-metrics", false, "/metrics", http.StatusOK, http.StatusOK},
+		{"shared-pprof", false, "/debug/pprof/", http.StatusOK, http.StatusOK},
+		{"shared-proxy", false, "/proxy", http.StatusOK, http.StatusOK},
+		{"shared-health", false, "/healthz", http.StatusOK, http.StatusOK},
+		{"separate-metrics", true, "/metrics", http.StatusOK, http.StatusNotFound},
+		{"separate-pprof", true, "/debug/pprof/", http.StatusNotFound, http.StatusOK},
+		{"separate-proxy", true, "/proxy", http.StatusNotFound, http.StatusOK},
+		{"separate-health", true, "/healthz", http.StatusOK, http.StatusOK},
+		{"separate-ready", true, "/readyz", http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+		{"separate-metadata", true, "/metadata", http.StatusNotFound, http.StatusOK},
+		{"shared-reload-get", false, "/-/reload", http.StatusMethodNotAllowed, http.StatusMethodNotAllowed},
+		{"separate-reload-get", true, "/-/reload", http.StatusNotFound, http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux, adminMux := newServeMuxes(serverConfig{
+				metricsPath:   "/metrics",
+				healthPath:    "/healthz",
+				readyPath:     "/readyz",
+				proxyPath:     "/proxy",
+				metadataPath:  "/metadata",
+				enablePprof:   true,
+				separateAdmin: tt.separateAdmin,
+				reload:        func() error { return nil },
+			}, metrics, &readiness{}, func() []*RemoteAggregator { return []*RemoteAggregator{collector} })
+
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rec.Code != tt.wantMain {
+				t.Errorf("main status code = %d, want %d", rec.Code, tt.wantMain)
+			}
+
+			rec = httptest.NewRecorder()
+			adminMux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rec.Code != tt.wantAdmin {
+				t.Errorf("admin status code = %d, want %d", rec.Code, tt.wantAdmin)
+			}
+		})
+	}
+}
+
+func TestNewServeMuxesAuth(t *testing.T) {
+	log = slog.Default()
+
+	metrics := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	auth := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, _, ok := r.BasicAuth(); !ok {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	ready := &readiness{}
+	ready.scraped()
+
+	tests := []struct {
+		method string
+		path   string
+		want   int
+	}{
+		{http.MethodGet, "/metrics", http.StatusUnauthorized},
+		{http.MethodGet, "/proxy", http.StatusUnauthorized},
+		{http.MethodGet, "/metadata", http.StatusUnauthorized},
+		{http.MethodPost, "/-/reload", http.StatusUnauthorized},
+		{http.MethodGet, "/debug/pprof/", http.StatusUnauthorized},
+		{http.MethodGet, "/debug/pprof/cmdline", http.StatusUnauthorized},
+		// the probes are never protected
+		{http.MethodGet, "/healthz", http.StatusOK},
+		{http.MethodGet, "/readyz", http.StatusOK},
+	}
+	for _, separateAdmin := range []bool{false, true} {
+		mux, adminMux := newServeMuxes(serverConfig{
+			metricsPath:   "/metrics",
+			healthPath:    "/healthz",
+			readyPath:     "/readyz",
+			proxyPath:     "/proxy",
+			metadataPath:  "/metadata",
+			enablePprof:   true,
+			separateAdmin: separateAdmin,
+			reload:        func() error { return nil },
+			auth:          auth,
+		}, metrics, ready, func() []*RemoteAggregator { return nil })
+
+		for _, tt := range tests {
+			handlers := []http.Handler{adminMux}
+			if tt.path == "/metrics" {
+				handlers = []http.Handler{mux}
+			}
+			if tt.path == "/healthz" || tt.path == "/readyz" {
+				handlers = []http.Handler{mux, adminMux}
+			}
+			for _, handler := range handlers {
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+				if rec.Code != tt.want {
+					t.Errorf("separate admin %v %s %s status code = %d, want %d", separateAdmin, tt.method, tt.path, rec.Code, tt.want)
+				}
+			}
+		}
+	}
+}
+
+func TestNewMetricsHandlerCompression(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(buildInfo)
+
+	tests := []struct {
+		compression bool
+		want        string
+	}{
+		{true, "gzip"},
+		{false, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		newMetricsHandler(reg, false, tt.compression).ServeHTTP(rec, req)
+		if got := rec.Header().Get("Content-Encoding"); got != tt.want {
+			t.Errorf("compression %v content encoding = %q, want %q", tt.compression, got, tt.want)
+		}
+	}
+}
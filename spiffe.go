@@ -0,0 +1,17 @@
+package main
+
+import (
+	"crypto/tls"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// spiffeTLSConfig returns a TLS config which presents the X.509 SVID from
+// svidSource as client certificate and verifies the target's SVID against the
+// trust bundles from bundleSource. Any SPIFFE ID of a trusted domain is
+// accepted for the target.
+func spiffeTLSConfig(svidSource x509svid.Source, bundleSource x509bundle.Source) *tls.Config {
+	return tlsconfig.MTLSClientConfig(svidSource, bundleSource, tlsconfig.AuthorizeAny())
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+type stubSVIDSource struct {
+	svid *x509svid.SVID
+}
+
+func (s *stubSVIDSource) GetX509SVID() (*x509svid.SVID, error) {
+	return s.svid, nil
+}
+
+// newCertificate returns a certificate signed by parent, or a self signed CA
+// certificate when parent is nil
+func newCertificate(t *testing.T, id string, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, crypto.Signer) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{Organization: []string{"metrics-aggregator"}},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+		parent, parentKey = template, key
+	} else {
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth}
+		template.IPAddresses = []net.IP{net.IPv6loopback, net.IPv4(127, 0, 0, 1)}
+	}
+	if id != "" {
+		template.URIs = []*url.URL{spiffeid.RequireFromString(id).URL()}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func Test_CollectorSPIFFE(t *testing.T) {
+	log = slog.Default()
+
+	trustDomain := spiffeid.RequireTrustDomainFromString("example.org")
+	ca, caKey := newCertificate(t, "", nil, nil)
+	serverCert, serverKey := newCertificate(t, "spiffe://example.org/target", ca, caKey)
+	clientCert, clientKey := newCertificate(t, "spiffe://example.org/aggregator", ca, caKey)
+
+	var presentedID string
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, err := x509svid.IDFromCert(r.TLS.PeerCertificates[0]); err == nil {
+			presentedID = id.String()
+		}
+		fmt.Fprint(w, `# TYPE component_received_events_total counter
+component_received_events_total{l1="v1",l2="v2"} 10
+component_received_events_total{l1="v1",l2="v3"} 20
+`)
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca)
+	ts.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{serverCert.Raw}, PrivateKey: serverKey}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	svidSource := &stubSVIDSource{
+		svid: &x509svid.SVID{
+			ID:           spiffeid.RequireFromString("spiffe://example.org/aggregator"),
+			Certificates: []*x509.Certificate{clientCert},
+			PrivateKey:   clientKey,
+		},
+	}
+	bundleSource := x509bundle.FromX509Authorities(trustDomain, []*x509.Certificate{ca})
+
+	collector := &RemoteAggregator{
+		url:                    ts.URL,
+		client:                 newHTTPClient(clientConfig{tlsConfig: spiffeTLSConfig(svidSource, bundleSource)}),
+		aggregateWithOutLabels: []string{"l2"},
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	if presentedID != "spiffe://example.org/aggregator" {
+		t.Errorf("presented SPIFFE ID = %q, want spiffe://example.org/aggregator", presentedID)
+	}
+	if len(gathering) != 1 || gathering[0].Metric[0].GetCounter().GetValue() != 30 {
+		t.Errorf("unexpected gathering: %v", gathering)
+	}
+}
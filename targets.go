@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// targetSet is the collector of all scraped targets, which may be added and
+// removed at runtime when the targets are read from a file
+type targetSet struct {
+	// newCollector returns the collector of the target url
+	newCollector func(url string) *RemoteAggregator
+	// scrapeInterval scrapes new targets in the background if set
+	scrapeInterval time.Duration
+	// scrapeJitter is the fraction of scrapeInterval background scrapes are
+	// randomly varied by
+	scrapeJitter float64
+	// skipInitialScrape doesn't wait for the first background scrape of new
+	// targets
+	skipInitialScrape bool
+	// failInitialScrape fails the update if the first background scrape of a
+	// new target fails, which is otherwise only logged
+	failInitialScrape bool
+
+	mu      sync.Mutex
+	targets map[string]*target
+}
+
+// target is a collector and the cancel func of its background scrape
+type target struct {
+	collector *RemoteAggregator
+	cancel    context.CancelFunc
+}
+
+func (ts *targetSet) Describe(ch chan<- *prometheus.Desc) {
+	// No static descriptions, the targets are dynamic.
+}
+
+// Collect collects all targets concurrently. With several targets the series
+// already collected from another target are skipped, as are the series of
+// families collected from another target with another help or type, which
+// keep the help and type of the target collected first. The registry would
+// fail the whole collection for either. Other inconsistencies across targets,
+// e.g. a histogram foo and a counter foo_count, still fail it.
+func (ts *targetSet) Collect(ch chan<- prometheus.Metric) {
+	collectors := ts.collectors()
+	if len(collectors) == 1 {
+		collectors[0].Collect(ch)
+		return
+	}
+
+	var mu sync.Mutex
+	// seen are the urls of the targets by the series they exported, and
+	// families the help and type of the families by name
+	seen := make(map[string]string)
+	families := make(map[string]familyMetadata)
+	var wg sync.WaitGroup
+	for _, collector := range collectors {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			collected := make(chan prometheus.Metric)
+			go func() {
+				defer close(collected)
+				collector.Collect(collected)
+			}()
+
+			var duplicates int
+			var first string
+			conflicts := make(map[string]familyMetadata)
+			for metric := range collected {
+				series, err := newCollectedSeries(metric)
+				if err != nil {
+					// the registry reports the invalid metric
+					ch <- metric
+					continue
+				}
+
+				mu.Lock()
+				family, ok := families[series.name]
+				if !ok {
+					family = series.familyMetadata
+					families[series.name] = family
+				}
+				conflict := family != series.familyMetadata
+				url, duplicate := seen[series.key]
+				if !conflict && !duplicate {
+					seen[series.key] = collector.url
+				}
+				mu.Unlock()
+				switch {
+				case conflict:
+					conflicts[series.name] = family
+				case duplicate:
+					duplicates++
+					first = url
+				default:
+					ch <- metric
+				}
+			}
+
+			for name, family := range conflicts {
+				log.Error("skipping metric exported by another target with another help or type", "remote", collector.url, "metric", name, "help", family.help, "type", family.metricType)
+			}
+			if len(conflicts) > 0 {
+				nameCollisions.WithLabelValues(collector.url).Add(float64(len(conflicts)))
+			}
+			if duplicates > 0 {
+				log.Error("skipping series already exported by another target, set --target-label to tell the targets apart", "remote", collector.url, "other_remote", first, "series", duplicates)
+				duplicateSeries.WithLabelValues(collector.url).Add(float64(duplicates))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// familyMetadata is the help and type of a metric family
+type familyMetadata struct {
+	help       string
+	metricType dto.MetricType
+}
+
+// collectedSeries is the name, metadata and key of a collected metric
+type collectedSeries struct {
+	familyMetadata
+	name string
+	// key is the key of the name and labels, the identity of a series in a
+	// collection
+	key string
+}
+
+// newCollectedSeries returns the name, metadata and key of metric
+func newCollectedSeries(metric prometheus.Metric) (collectedSeries, error) {
+	// the name and help are only exposed by the description
+	desc := metric.Desc().String()
+	rest := strings.TrimPrefix(desc, "Desc{fqName: ")
+	name, rest, err := unquotePrefix(rest)
+	if err != nil {
+		return collectedSeries{}, fmt.Errorf("unexpected description %s", desc)
+	}
+	help, _, err := unquotePrefix(strings.TrimPrefix(rest, ", help: "))
+	if err != nil {
+		return collectedSeries{}, fmt.Errorf("unexpected description %s", desc)
+	}
+
+	out := &dto.Metric{}
+	if err := metric.Write(out); err != nil {
+		return collectedSeries{}, err
+	}
+	slices.SortFunc(out.Label, func(a, b *dto.LabelPair) int {
+		return strings.Compare(a.GetName(), b.GetName())
+	})
+
+	var key strings.Builder
+	key.WriteString(name)
+	for _, label := range out.Label {
+		key.WriteString("\xff" + label.GetName() + "\xff" + label.GetValue())
+	}
+	return collectedSeries{
+		familyMetadata: familyMetadata{help: help, metricType: writtenType(out)},
+		name:           name,
+		key:            key.String(),
+	}, nil
+}
+
+// unquotePrefix returns the Go quoted string s starts with unquoted and the
+// rest of s
+func unquotePrefix(s string) (string, string, error) {
+	quoted, err := strconv.QuotedPrefix(s)
+	if err != nil {
+		return "", "", err
+	}
+	unquoted, err := strconv.Unquote(quoted)
+	return unquoted, s[len(quoted):], err
+}
+
+// writtenType returns the type of a written metric like the registry infers
+// it
+func writtenType(metric *dto.Metric) dto.MetricType {
+	switch {
+	case metric.Gauge != nil:
+		return dto.MetricType_GAUGE
+	case metric.Counter != nil:
+		return dto.MetricType_COUNTER
+	case metric.Summary != nil:
+		return dto.MetricType_SUMMARY
+	case metric.Histogram != nil:
+		return dto.MetricType_HISTOGRAM
+	}
+	return dto.MetricType_UNTYPED
+}
+
+// collectors returns the collectors of all targets sorted by url
+func (ts *targetSet) collectors() []*RemoteAggregator {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	var collectors []*RemoteAggregator
+	for _, url := range slices.Sorted(maps.Keys(ts.targets)) {
+		collectors = append(collectors, ts.targets[url].collector)
+	}
+	return collectors
+}
+
+// update replaces the targets with urls, keeping the collectors of the
+// targets in both. Background scrapes of new targets run until ctx is done or
+// the target is removed. It returns the errors of the initial scrapes if
+// failInitialScrape is set, the targets are added regardless. It must not be
+// called concurrently.
+func (ts *targetSet) update(ctx context.Context, urls []string) error {
+	ts.mu.Lock()
+	var removed []*target
+	for url, t := range ts.targets {
+		if slices.Contains(urls, url) {
+			continue
+		}
+		log.Info("removing target", "remote", url)
+		delete(ts.targets, url)
+		removed = append(removed, t)
+	}
+	ts.mu.Unlock()
+
+	// the metrics of removed targets are deleted once their scrapes in
+	// progress are canceled and completed, so they don't export them again
+	for _, t := range removed {
+		t.cancel()
+		t.collector.stop()
+		deleteTargetMetrics(t.collector.url)
+	}
+
+	// new targets are added once their first background scrape completed so
+	// collections are not blocked by it, the targets are scraped concurrently
+	// like in Collect
+	added := make(map[string]*target)
+	var mu sync.Mutex
+	var errs []error
+	var wg sync.WaitGroup
+	for _, url := range urls {
+		if _, ok := ts.targets[url]; ok || added[url] != nil {
+			continue
+		}
+		log.Info("adding target", "remote", url)
+		collector := ts.newCollector(url)
+		targetCtx, cancel := context.WithCancel(ctx)
+		collector.ctx = targetCtx
+		if ts.scrapeInterval > 0 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				if err := collector.startBackgroundScrape(targetCtx, ts.scrapeInterval, ts.scrapeJitter, ts.skipInitialScrape); err != nil {
+					log.Warn("initial scrape failed, the target exports no metrics until its next scrape", "remote", url, "err", err)
+					mu.Lock()
+					errs = append(errs, fmt.Errorf("initial scrape of %s failed %w", url, err))
+					mu.Unlock()
+				}
+			}()
+		}
+		added[url] = &target{collector: collector, cancel: cancel}
+	}
+	wg.Wait()
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.targets == nil {
+		ts.targets = make(map[string]*target)
+	}
+	maps.Copy(ts.targets, added)
+
+	var collectors []*RemoteAggregator
+	for _, t := range ts.targets {
+		collectors = append(collectors, t.collector)
+	}
+	setConfigHash(collectorsConfigHash(collectors))
+
+	if !ts.failInitialScrape {
+		return nil
+	}
+	return errors.Join(errs...)
+}
+
+// deleteTargetMetrics deletes the internal metrics of the removed target url
+func deleteTargetMetrics(url string) {
+	labels := prometheus.Labels{"remote": url}
+	pcDuration.DeletePartialMatch(labels)
+	phaseDuration.DeletePartialMatch(labels)
+	selfValidationErrors.DeletePartialMatch(labels)
+	dedupSeriesTotal.DeletePartialMatch(labels)
+	breakerOpen.DeletePartialMatch(labels)
+	scrapeErrors.DeletePartialMatch(labels)
+	partialScrapes.DeletePartialMatch(labels)
+	decodeResults.DeletePartialMatch(labels)
+	decodedFamilies.DeletePartialMatch(labels)
+	nameCollisions.DeletePartialMatch(labels)
+	duplicateSeries.DeletePartialMatch(labels)
+	counterResetsTotal.DeletePartialMatch(labels)
+	truncatedLabelValues.DeletePartialMatch(labels)
+	inputSeriesGauge.DeletePartialMatch(labels)
+	outputSeriesGauge.DeletePartialMatch(labels)
+	outputSeriesLimitExceeded.DeletePartialMatch(labels)
+	targetUp.DeletePartialMatch(labels)
+	lastScrapeSuccess.DeletePartialMatch(labels)
+}
+
+// watchTargetsFile sets the targets to the static targets and the targets
+// listed in file, and then updates them every interval until ctx is done if
+// the file has been modified. Errors reading the modified file are logged and
+// the targets are kept.
+func (ts *targetSet) watchTargetsFile(ctx context.Context, file string, static []string, interval time.Duration) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return fmt.Errorf("error reading targets file %w", err)
+	}
+	urls, err := readTargets(file)
+	if err != nil {
+		return err
+	}
+	if err := ts.update(ctx, append(slices.Clip(static), urls...)); err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		modTime := info.ModTime()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			info, err := os.Stat(file)
+			if err != nil {
+				log.Error("error reading targets file", "file", file, "err", err)
+				continue
+			}
+			if info.ModTime().Equal(modTime) {
+				continue
+			}
+
+			urls, err := readTargets(file)
+			if err != nil {
+				log.Error("error reading targets file", "file", file, "err", err)
+				continue
+			}
+			modTime = info.ModTime()
+			// initial scrape failures of targets added later are only logged
+			_ = ts.update(ctx, append(slices.Clip(static), urls...))
+		}
+	}()
+	return nil
+}
+
+// targetURL returns the url scraping the target spec, either host:port
+// scraped on metricsPath or host:port/path scraped on its own path
+func targetURL(scheme, spec, metricsPath string) (string, error) {
+	host, path, ok := strings.Cut(spec, "/")
+	if ok {
+		path = "/" + path
+	} else {
+		path = metricsPath
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		return "", fmt.Errorf("%q must be host:port or host:port/path %w", spec, err)
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	u := url.URL{Scheme: scheme, Host: host, Path: path}
+	return u.String(), nil
+}
+
+// readTargets reads the target urls from the file, one per line. Empty lines
+// and lines starting with '#' are ignored.
+func readTargets(file string) ([]string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading targets file %w", err)
+	}
+
+	var urls []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		urls = append(urls, line)
+	}
+	return urls, nil
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestReadTargets(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "targets")
+	if err := os.WriteFile(file, []byte(`# targets
+http://a:9090/metrics
+
+  http://b:9090/metrics
+`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := readTargets(file)
+	if err != nil {
+		t.Fatalf("readTargets() error = %v", err)
+	}
+	want := []string{"http://a:9090/metrics", "http://b:9090/metrics"}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("readTargets() mismatch (-want +got):\n%s", diff)
+	}
+
+	if _, err := readTargets(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Errorf("readTargets() expected error for missing file")
+	}
+}
+
+func TestTargetURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		scheme  string
+		spec    string
+		want    string
+		wantErr bool
+	}{
+		{"default-path", "http", "a:9090", "http://a:9090/metrics", false},
+		{"own-path", "https", "a:9090/custom/metrics", "https://a:9090/custom/metrics", false},
+		{"ipv6", "http", "[::1]:9090", "http://[::1]:9090/metrics", false},
+		{"missing-port", "http", "a", "", true},
+		{"missing-port-with-path", "http", "a/metrics", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := targetURL(tt.scheme, tt.spec, "/metrics")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("targetURL() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("targetURL() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTargetSetWatchTargetsFile(t *testing.T) {
+	log = slog.Default()
+
+	newTarget := func(value int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "# TYPE component_received_events_total counter\ncomponent_received_events_total{l1=\"v1\"} %d\n", value)
+		}))
+	}
+	static := newTarget(1)
+	defer static.Close()
+	target1 := newTarget(2)
+	defer target1.Close()
+	target2 := newTarget(4)
+	defer target2.Close()
+
+	file := filepath.Join(t.TempDir(), "targets")
+	writeTargets := func(urls string, modTime time.Time) {
+		if err := os.WriteFile(file, []byte(urls), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		// the modification time is set explicitly as writes within the
+		// resolution of the file system don't change it
+		if err := os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	writeTargets(target1.URL+"\n", now)
+
+	targets := &targetSet{
+		newCollector: func(url string) *RemoteAggregator {
+			return &RemoteAggregator{url: url, addLabels: map[string]string{"remote": url}}
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := targets.watchTargetsFile(ctx, file, []string{static.URL}, 10*time.Millisecond); err != nil {
+		t.Fatalf("watchTargetsFile() error = %v", err)
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(targets)
+
+	sum := func() float64 {
+		gathering, err := reg.Gather()
+		if err != nil {
+			t.Fatalf("reg.Gather() error = %v", err)
+		}
+		var sum float64
+		for _, mf := range gathering {
+			for _, m := range mf.Metric {
+				sum += m.GetCounter().GetValue()
+			}
+		}
+		return sum
+	}
+
+	if got := sum(); got != 3 {
+		t.Errorf("sum of static and file targets = %v, want 3", got)
+	}
+	if got := testutil.ToFloat64(targetUp.WithLabelValues(target1.URL)); got != 1 {
+		t.Errorf("target up of file target = %v, want 1", got)
+	}
+
+	writeTargets("# replaced\n"+target2.URL+"\n", now.Add(time.Second))
+
+	urls := func() []string {
+		var urls []string
+		for _, collector := range targets.collectors() {
+			urls = append(urls, collector.url)
+		}
+		return urls
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !slices.Contains(urls(), target2.URL) {
+		if time.Now().After(deadline) {
+			t.Fatalf("targets not updated, got %v", urls())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := urls(); len(got) != 2 || slices.Contains(got, target1.URL) {
+		t.Errorf("targets = %v, want the static target and the new file target", got)
+	}
+
+	if got := sum(); got != 5 {
+		t.Errorf("sum of static and updated file targets = %v, want 5", got)
+	}
+	// the metrics of the removed target are deleted
+	if targetUp.DeleteLabelValues(target1.URL) {
+		t.Errorf("target up of removed target still exported")
+	}
+}
+
+func TestTargetSetDuplicateSeries(t *testing.T) {
+	log = slog.Default()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP http_requests_total http_requests_total
+# TYPE http_requests_total counter
+http_requests_total{pod="p1",service="api"} 1 1735054883000
+`)
+	})
+	target1 := httptest.NewServer(handler)
+	defer target1.Close()
+	target2 := httptest.NewServer(handler)
+	defer target2.Close()
+
+	tests := []struct {
+		name      string
+		addLabels func(url string) map[string]string
+		wantLen   int
+	}{
+		{
+			// the series of the second target is skipped instead of failing
+			// the collection
+			name:      "no target label",
+			addLabels: func(string) map[string]string { return nil },
+			wantLen:   1,
+		},
+		{
+			name:      "target label",
+			addLabels: func(url string) map[string]string { return map[string]string{"instance": url} },
+			wantLen:   2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			targets := &targetSet{
+				newCollector: func(url string) *RemoteAggregator {
+					return &RemoteAggregator{url: url, aggregateWithOutLabels: []string{"pod"}, addLabels: tt.addLabels(url)}
+				},
+			}
+			targets.update(context.Background(), []string{target1.URL, target2.URL})
+
+			reg := prometheus.NewPedanticRegistry()
+			reg.MustRegister(targets)
+
+			gathering, err := reg.Gather()
+			if err != nil {
+				t.Fatalf("reg.Gather() error = %v", err)
+			}
+			if len(gathering) != 1 || len(gathering[0].Metric) != tt.wantLen {
+				t.Errorf("reg.Gather() = %s, want %d series", metricsToText(gathering), tt.wantLen)
+			}
+		})
+	}
+}
+
+func TestTargetSetPassthroughTargetLabel(t *testing.T) {
+	log = slog.Default()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP up up
+# TYPE up gauge
+up{job="a"} 1
+`)
+	})
+	target1 := httptest.NewServer(handler)
+	defer target1.Close()
+	target2 := httptest.NewServer(handler)
+	defer target2.Close()
+
+	targets := &targetSet{
+		newCollector: func(url string) *RemoteAggregator {
+			return &RemoteAggregator{
+				url:                    url,
+				aggregateWithOutLabels: []string{"pod"},
+				addLabels:              map[string]string{"instance": url},
+				passthroughMetrics:     []string{"up"},
+			}
+		},
+	}
+	targets.update(context.Background(), []string{target1.URL, target2.URL})
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(targets)
+
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	// the passed through series of both targets are told apart by the
+	// target label
+	want := fmt.Sprintf(`# HELP up up
+# TYPE up gauge
+up{instance=%q,job="a"} 1
+up{instance=%q,job="a"} 1
+`, min(target1.URL, target2.URL), max(target1.URL, target2.URL))
+	if diff := cmp.Diff(metricsToText(gathering), want); diff != "" {
+		t.Errorf("collector output mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestTargetSetInitialScrapeError(t *testing.T) {
+	log = slog.Default()
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	for _, fail := range []bool{false, true} {
+		t.Run(fmt.Sprintf("fail=%t", fail), func(t *testing.T) {
+			targets := &targetSet{
+				newCollector: func(url string) *RemoteAggregator {
+					return &RemoteAggregator{url: url, aggregateWithOutLabels: []string{"pod"}}
+				},
+				scrapeInterval:    time.Hour,
+				failInitialScrape: fail,
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			err := targets.update(ctx, []string{failing.URL})
+			if (err != nil) != fail {
+				t.Errorf("update() error = %v, want error %t", err, fail)
+			}
+			// the target is added regardless
+			if got := len(targets.collectors()); got != 1 {
+				t.Errorf("got %d targets, want 1", got)
+			}
+		})
+	}
+}
+
+func TestTargetSetConcurrentInitialScrapes(t *testing.T) {
+	log = slog.Default()
+
+	// every target only responds once all targets are scraped at once, so
+	// scraping them in turn fails the initial scrapes
+	var wg sync.WaitGroup
+	wg.Add(2)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wg.Done()
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "# TYPE component_received_events_total counter\ncomponent_received_events_total{pod=\"p1\"} 1\n")
+	})
+	target1 := httptest.NewServer(handler)
+	defer target1.Close()
+	target2 := httptest.NewServer(handler)
+	defer target2.Close()
+
+	targets := &targetSet{
+		newCollector: func(url string) *RemoteAggregator {
+			return &RemoteAggregator{url: url, aggregateWithOutLabels: []string{"pod"}, addLabels: map[string]string{"instance": url}}
+		},
+		scrapeInterval:    time.Hour,
+		failInitialScrape: true,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := targets.update(ctx, []string{target1.URL, target2.URL}); err != nil {
+		t.Fatalf("update() error = %v", err)
+	}
+	if got := len(targets.collectors()); got != 2 {
+		t.Errorf("got %d targets, want 2", got)
+	}
+}
+
+func TestTargetSetConflictingFamilies(t *testing.T) {
+	log = slog.Default()
+
+	target1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "# HELP foo a\n# TYPE foo counter\nfoo{pod=\"p1\"} 1\n# HELP bar bar\n# TYPE bar gauge\nbar{pod=\"p1\"} 1\n")
+	}))
+	defer target1.Close()
+	target2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "# HELP foo b\n# TYPE foo gauge\nfoo{pod=\"p1\"} 2\n# HELP bar bar\n# TYPE bar gauge\nbar{pod=\"p1\"} 2\n")
+	}))
+	defer target2.Close()
+
+	targets := &targetSet{
+		newCollector: func(url string) *RemoteAggregator {
+			return &RemoteAggregator{url: url, aggregateWithOutLabels: []string{"pod"}, addLabels: map[string]string{"instance": url}}
+		},
+	}
+	targets.update(context.Background(), []string{target1.URL, target2.URL})
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(targets)
+
+	collisions := func() float64 {
+		return testutil.ToFloat64(nameCollisions.WithLabelValues(target1.URL)) + testutil.ToFloat64(nameCollisions.WithLabelValues(target2.URL))
+	}
+	before := collisions()
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	// foo is only exported by the target collected first, bar by both
+	if len(gathering) != 2 {
+		t.Fatalf("reg.Gather() = %s, want bar and foo", metricsToText(gathering))
+	}
+	if bar := gathering[0]; bar.GetName() != "bar" || len(bar.Metric) != 2 {
+		t.Errorf("got %s, want bar of both targets", metricsToText(gathering[:1]))
+	}
+	if foo := gathering[1]; foo.GetName() != "foo" || len(foo.Metric) != 1 {
+		t.Errorf("got %s, want foo of one target", metricsToText(gathering[1:]))
+	}
+	if got := collisions() - before; got != 1 {
+		t.Errorf("name collisions = %v, want 1", got)
+	}
+}
+
+func TestTargetSetRemoveScrapingTarget(t *testing.T) {
+	log = slog.Default()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handled := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(handled)
+		close(started)
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		fmt.Fprint(w, "# TYPE component_received_events_total counter\ncomponent_received_events_total{pod=\"p1\"} 1\n")
+	}))
+	defer ts.Close()
+
+	targets := &targetSet{
+		newCollector: func(url string) *RemoteAggregator {
+			return &RemoteAggregator{url: url, aggregateWithOutLabels: []string{"pod"}}
+		},
+		scrapeInterval:    time.Hour,
+		skipInitialScrape: true,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	targets.update(ctx, []string{ts.URL})
+	<-started
+
+	// removing the target cancels the scrape in progress and deletes its
+	// metrics once it completed
+	targets.update(ctx, nil)
+	close(release)
+	<-handled
+	time.Sleep(50 * time.Millisecond)
+
+	if targetUp.DeleteLabelValues(ts.URL) {
+		t.Errorf("target up of removed target exported again")
+	}
+	if scrapeErrors.DeletePartialMatch(prometheus.Labels{"remote": ts.URL}) > 0 {
+		t.Errorf("scrape errors of removed target exported again")
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// newDecoder returns the decoder of a response body in format. If duplicate
+// families are merged text bodies are decoded in chunks, as the text parser
+// rejects families declared more than once.
+func (ra *RemoteAggregator) newDecoder(body io.Reader, format expfmt.Format) expfmt.Decoder {
+	switch format.FormatType() {
+	case expfmt.TypeOpenMetrics:
+		return newOpenMetricsDecoder(body)
+	case expfmt.TypeTextPlain, expfmt.TypeUnknown:
+		if ra.mergeDuplicates {
+			return &chunkedTextDecoder{reader: bufio.NewReader(body), format: format}
+		}
+	}
+	// unknown formats are decoded as text
+	return expfmt.NewDecoder(body, format)
+}
+
+// chunkedTextDecoder decodes a text body in chunks, each ending before a
+// help or type line repeating a declaration of the chunk, so a family
+// declared more than once is decoded as several families
+type chunkedTextDecoder struct {
+	reader  *bufio.Reader
+	format  expfmt.Format
+	decoder expfmt.Decoder
+	// next is the line starting the next chunk, and eof is set once the
+	// body is read
+	next []byte
+	eof  bool
+}
+
+func (d *chunkedTextDecoder) Decode(metricFamily *dto.MetricFamily) error {
+	for {
+		if d.decoder != nil {
+			if err := d.decoder.Decode(metricFamily); err != io.EOF {
+				return err
+			}
+			d.decoder = nil
+		}
+		if d.eof && d.next == nil {
+			return io.EOF
+		}
+		chunk, err := d.readChunk()
+		if err != nil {
+			return err
+		}
+		d.decoder = expfmt.NewDecoder(bytes.NewReader(chunk), d.format)
+	}
+}
+
+// readChunk reads the lines up to the next line repeating a declaration
+func (d *chunkedTextDecoder) readChunk() ([]byte, error) {
+	chunk := d.next
+	d.next = nil
+	declared := make(map[string]bool)
+	if chunk != nil {
+		declared[declaration(chunk)] = true
+	}
+	for {
+		line, err := d.reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		d.eof = err == io.EOF
+		if key := declaration(line); key != "" {
+			if declared[key] {
+				d.next = line
+				return chunk, nil
+			}
+			declared[key] = true
+		}
+		chunk = append(chunk, line...)
+		if d.eof {
+			return chunk, nil
+		}
+	}
+}
+
+// declaration returns the keyword and family name of a help or type line,
+// e.g. "TYPE http_requests_total", or "" for other lines
+func declaration(line []byte) string {
+	line = bytes.TrimLeft(line, " \t")
+	if !bytes.HasPrefix(line, []byte("#")) {
+		return ""
+	}
+	fields := bytes.Fields(line[1:])
+	if len(fields) < 2 || (string(fields[0]) != "HELP" && string(fields[0]) != "TYPE") {
+		return ""
+	}
+	return string(fields[0]) + " " + string(fields[1])
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// writePEM writes the PEM encoded block to a new file in dir and returns its
+// path
+func writePEM(t *testing.T, dir, name, blockType string, der []byte) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := newCertificate(t, "", nil, nil)
+	cert, key := newCertificate(t, "", ca, caKey)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caFile := writePEM(t, dir, "ca.pem", "CERTIFICATE", ca.Raw)
+	certFile := writePEM(t, dir, "cert.pem", "CERTIFICATE", cert.Raw)
+	keyFile := writePEM(t, dir, "key.pem", "PRIVATE KEY", keyDER)
+	invalidFile := filepath.Join(dir, "invalid.pem")
+	if err := os.WriteFile(invalidFile, []byte("invalid"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		caFile   string
+		certFile string
+		keyFile  string
+		wantErr  bool
+	}{
+		{"ca", caFile, "", "", false},
+		{"client-cert", caFile, certFile, keyFile, false},
+		{"missing-ca", filepath.Join(dir, "missing.pem"), "", "", true},
+		{"invalid-ca", invalidFile, "", "", true},
+		{"cert-without-key", caFile, certFile, "", true},
+		{"invalid-key", caFile, certFile, invalidFile, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newTLSConfig(tt.caFile, tt.certFile, tt.keyFile, false)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newTLSConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_CollectorTLS(t *testing.T) {
+	log = slog.Default()
+
+	dir := t.TempDir()
+	ca, caKey := newCertificate(t, "", nil, nil)
+	serverCert, serverKey := newCertificate(t, "", ca, caKey)
+	clientCert, clientKey := newCertificate(t, "", ca, caKey)
+	clientKeyDER, err := x509.MarshalPKCS8PrivateKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# TYPE component_received_events_total counter
+component_received_events_total{l1="v1",l2="v2"} 10
+component_received_events_total{l1="v1",l2="v3"} 20
+`)
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca)
+	ts.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{serverCert.Raw}, PrivateKey: serverKey}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	tlsConfig, err := newTLSConfig(
+		writePEM(t, dir, "ca.pem", "CERTIFICATE", ca.Raw),
+		writePEM(t, dir, "cert.pem", "CERTIFICATE", clientCert.Raw),
+		writePEM(t, dir, "key.pem", "PRIVATE KEY", clientKeyDER),
+		false,
+	)
+	if err != nil {
+		t.Fatalf("newTLSConfig() error = %v", err)
+	}
+
+	collector := &RemoteAggregator{
+		url:                    ts.URL,
+		client:                 newHTTPClient(clientConfig{tlsConfig: tlsConfig}),
+		aggregateWithOutLabels: []string{"l2"},
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	if len(gathering) != 1 || gathering[0].Metric[0].GetCounter().GetValue() != 30 {
+		t.Errorf("unexpected gathering: %v", gathering)
+	}
+}
+
+func TestNewServerTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := newCertificate(t, "", nil, nil)
+	serverCert, serverKey := newCertificate(t, "", ca, caKey)
+	clientCert, clientKey := newCertificate(t, "", ca, caKey)
+	otherCA, otherCAKey := newCertificate(t, "", nil, nil)
+	otherCert, otherKey := newCertificate(t, "", otherCA, otherCAKey)
+	caFile := writePEM(t, dir, "ca.pem", "CERTIFICATE", ca.Raw)
+
+	if _, err := newServerTLSConfig(filepath.Join(dir, "missing.pem")); err == nil {
+		t.Error("newServerTLSConfig() error = nil for a missing client CA file, want error")
+	}
+
+	tests := []struct {
+		name        string
+		clientCA    string
+		certificate *tls.Certificate
+		wantErr     bool
+	}{
+		{"no-client-ca", "", nil, false},
+		{"client-cert", caFile, &tls.Certificate{Certificate: [][]byte{clientCert.Raw}, PrivateKey: clientKey}, false},
+		{"missing-client-cert", caFile, nil, true},
+		{"untrusted-client-cert", caFile, &tls.Certificate{Certificate: [][]byte{otherCert.Raw}, PrivateKey: otherKey}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := newServerTLSConfig(tt.clientCA)
+			if err != nil {
+				t.Fatalf("newServerTLSConfig() error = %v", err)
+			}
+			config.Certificates = []tls.Certificate{{Certificate: [][]byte{serverCert.Raw}, PrivateKey: serverKey}}
+
+			ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			ts.TLS = config
+			ts.StartTLS()
+			defer ts.Close()
+
+			rootCAs := x509.NewCertPool()
+			rootCAs.AddCert(ca)
+			clientConfig := &tls.Config{RootCAs: rootCAs}
+			if tt.certificate != nil {
+				clientConfig.Certificates = []tls.Certificate{*tt.certificate}
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+
+			resp, err := client.Get(ts.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("client.Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+// validateExposition renders the families in the text format and decodes the
+// rendered output again. It returns all problems which would make the
+// exposition invalid for a Prometheus scrape, like invalid names, duplicate
+// series or metrics not matching the family type.
+func validateExposition(families []*dto.MetricFamily) []error {
+	var errs []error
+
+	out := &bytes.Buffer{}
+	for _, mf := range families {
+		if _, err := expfmt.MetricFamilyToText(out, mf); err != nil {
+			errs = append(errs, fmt.Errorf("error rendering metric family %q: %w", mf.GetName(), err))
+		}
+	}
+
+	decoder := expfmt.NewDecoder(out, expfmt.NewFormat(expfmt.TypeTextPlain))
+	for {
+		var mf dto.MetricFamily
+		err := decoder.Decode(&mf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error decoding rendered output: %w", err))
+			break
+		}
+
+		name := mf.GetName()
+		if !model.LegacyValidation.IsValidMetricName(name) {
+			errs = append(errs, fmt.Errorf("invalid metric name %q", name))
+		}
+
+		seen := make(map[string]bool)
+		for _, metric := range mf.Metric {
+			var key strings.Builder
+			for _, label := range metric.Label {
+				if !model.LegacyValidation.IsValidLabelName(label.GetName()) {
+					errs = append(errs, fmt.Errorf("invalid label name %q on metric %q", label.GetName(), name))
+				}
+				key.WriteString(label.GetName() + "\xff" + label.GetValue() + "\xff")
+			}
+			if seen[key.String()] {
+				errs = append(errs, fmt.Errorf("duplicate series of metric %q with labels %v", name, metric.Label))
+			}
+			seen[key.String()] = true
+		}
+	}
+
+	return errs
+}
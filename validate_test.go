@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestValidateExposition(t *testing.T) {
+	counter := func(value float64, labels ...string) *dto.Metric {
+		m := &dto.Metric{Counter: &dto.Counter{Value: proto.Float64(value)}}
+		for i := 0; i < len(labels); i += 2 {
+			m.Label = append(m.Label, &dto.LabelPair{Name: pointer(labels[i]), Value: pointer(labels[i+1])})
+		}
+		return m
+	}
+
+	tests := []struct {
+		name     string
+		families []*dto.MetricFamily
+		wantErrs int
+	}{
+		{
+			"valid",
+			[]*dto.MetricFamily{{
+				Name:   pointer("component_received_events_total"),
+				Type:   dto.MetricType_COUNTER.Enum(),
+				Metric: []*dto.Metric{counter(10, "l1", "v1"), counter(20, "l1", "v2")},
+			}},
+			0,
+		},
+		{
+			"invalid-name",
+			[]*dto.MetricFamily{{
+				Name:   pointer("1bad-component_received_events_total"),
+				Type:   dto.MetricType_COUNTER.Enum(),
+				Metric: []*dto.Metric{counter(10, "l1", "v1")},
+			}},
+			1,
+		},
+		{
+			"invalid-label-name",
+			[]*dto.MetricFamily{{
+				Name:   pointer("component_received_events_total"),
+				Type:   dto.MetricType_COUNTER.Enum(),
+				Metric: []*dto.Metric{counter(10, "l-1", "v1")},
+			}},
+			1,
+		},
+		{
+			"duplicate-series",
+			[]*dto.MetricFamily{{
+				Name:   pointer("component_received_events_total"),
+				Type:   dto.MetricType_COUNTER.Enum(),
+				Metric: []*dto.Metric{counter(10, "l1", "v1"), counter(20, "l1", "v1")},
+			}},
+			1,
+		},
+		{
+			"inconsistent-type",
+			[]*dto.MetricFamily{{
+				Name:   pointer("component_received_events_total"),
+				Type:   dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{counter(10, "l1", "v1")},
+			}},
+			1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if errs := validateExposition(tt.families); len(errs) != tt.wantErrs {
+				t.Errorf("validateExposition() = %v, want %d errors", errs, tt.wantErrs)
+			}
+		})
+	}
+}
+
+func Test_CollectorSelfValidate(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# TYPE component_received_events_total counter
+component_received_events_total{l1="v1",l2="v2"} 10
+component_received_events_total{l1="v1",l2="v3"} 20
+`)
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{
+		url:                    ts.URL,
+		aggregateWithOutLabels: []string{"l2"},
+		addPrefix:              "1bad-",
+		selfValidate:           true,
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	if _, err := reg.Gather(); err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	if got := testutil.ToFloat64(selfValidationErrors.WithLabelValues(ts.URL)); got != 1 {
+		t.Errorf("self validation errors = %v, want 1", got)
+	}
+}
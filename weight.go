@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// parseWeightBy returns the weight metrics of the metrics by their name from
+// metric=weight pairs
+func parseWeightBy(pairs []string) (map[string]string, error) {
+	weightBy := make(map[string]string)
+	for _, pair := range pairs {
+		metric, weight, ok := strings.Cut(pair, "=")
+		if !ok || metric == "" || weight == "" {
+			return nil, fmt.Errorf("invalid metric=weight pair %q", pair)
+		}
+		if _, ok := weightBy[metric]; ok {
+			return nil, fmt.Errorf("metric %q weighted more than once", metric)
+		}
+		weightBy[metric] = weight
+	}
+	return weightBy, nil
+}
+
+// familyWeights returns the values of the series of the weight family by
+// their labels
+func familyWeights(metricFamily *dto.MetricFamily) map[string]float64 {
+	weights := make(map[string]float64, len(metricFamily.Metric))
+	for _, metric := range metricFamily.Metric {
+		if value, ok := sampleValue(metric); ok {
+			key, _ := aggregationKey(metric, nil)
+			weights[key] = value
+		}
+	}
+	return weights
+}
+
+// seriesWeights returns the weights of the metrics, the values of the weight
+// series with the same labels. Metrics without weight series have no weight.
+func seriesWeights(metrics []*dto.Metric, weights map[string]float64) map[*dto.Metric]float64 {
+	result := make(map[*dto.Metric]float64, len(metrics))
+	for _, metric := range metrics {
+		key, _ := aggregationKey(metric, nil)
+		if weight, ok := weights[key]; ok {
+			result[metric] = weight
+		}
+	}
+	return result
+}
+
+// weightedAverages returns, under the given name, one gauge per aggregation
+// key with the average of the values of its series weighted by weights.
+// Series without a weight are skipped, as are keys whose weights sum to 0.
+// The averages are rounded with roundScale.
+func weightedAverages(metricFamily *dto.MetricFamily, name string, aggregateWithOutLabels []string, weights map[*dto.Metric]float64, roundScale float64) []prometheus.Metric {
+	type weightedSum struct {
+		labels map[string]string
+		sum    float64
+		weight float64
+	}
+	sums := make(map[string]*weightedSum)
+	for _, metric := range metricFamily.Metric {
+		weight, ok := weights[metric]
+		if !ok {
+			continue
+		}
+		value, ok := sampleValue(metric)
+		if !ok {
+			continue
+		}
+
+		key, labels := aggregationKey(metric, aggregateWithOutLabels)
+		s := sums[key]
+		if s == nil {
+			s = &weightedSum{labels: labels}
+			sums[key] = s
+		}
+		s.sum += value * weight
+		s.weight += weight
+	}
+
+	var result []prometheus.Metric
+	for _, key := range slices.Sorted(maps.Keys(sums)) {
+		s := sums[key]
+		if s.weight == 0 {
+			continue
+		}
+
+		desc := prometheus.NewDesc(name, metricFamily.GetHelp(), nil, s.labels)
+		promMetric, err := prometheus.NewConstMetric(desc, prometheus.GaugeValue, roundValue(s.sum/s.weight, roundScale))
+		if err != nil {
+			log.Error("error creating Prometheus metric", "err", err)
+			continue
+		}
+		result = append(result, promMetric)
+	}
+	return result
+}
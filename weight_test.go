@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestParseWeightBy(t *testing.T) {
+	got, err := parseWeightBy([]string{"latency_seconds=requests_total", "size_bytes=requests_total"})
+	if err != nil {
+		t.Fatalf("parseWeightBy() error = %v", err)
+	}
+	want := map[string]string{"latency_seconds": "requests_total", "size_bytes": "requests_total"}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("parseWeightBy() mismatch (-want +got):\n%s", diff)
+	}
+
+	for _, pairs := range [][]string{{"latency_seconds"}, {"=requests_total"}, {"latency_seconds=a", "latency_seconds=b"}} {
+		if _, err := parseWeightBy(pairs); err == nil {
+			t.Errorf("parseWeightBy(%q) expected error", pairs)
+		}
+	}
+}
+
+func Test_CollectorWeightBy(t *testing.T) {
+	log = slog.Default()
+
+	// the weighted family is served before its weight family
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP request_latency_seconds request_latency_seconds
+# TYPE request_latency_seconds gauge
+request_latency_seconds{service="api",pod="p1"} 1 1735054883000
+request_latency_seconds{service="api",pod="p2"} 4 1735054883000
+request_latency_seconds{service="api",pod="p3"} 100 1735054883000
+request_latency_seconds{service="web",pod="p4"} 2 1735054883000
+# HELP requests_total requests_total
+# TYPE requests_total counter
+requests_total{service="api",pod="p1"} 30 1735054883000
+requests_total{service="api",pod="p2"} 10 1735054883000
+requests_total{service="web",pod="p4"} 0 1735054883000
+`)
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{
+		url:                    ts.URL,
+		aggregateWithOutLabels: []string{"pod"},
+		renameLabels:           map[string]string{"service": "svc"},
+		weightBy:               map[string]string{"request_latency_seconds": "requests_total"},
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	// (30*1 + 10*4) / 40, the series without a weight series and the service
+	// without requests are skipped
+	want := `# HELP request_latency_seconds request_latency_seconds
+# TYPE request_latency_seconds gauge
+request_latency_seconds{svc="api"} 1.75 1735054883000
+# HELP requests_total requests_total
+# TYPE requests_total counter
+requests_total{svc="api"} 40 1735054883000
+requests_total{svc="web"} 0 1735054883000
+`
+	if diff := cmp.Diff(metricsToText(gathering), want); diff != "" {
+		t.Errorf("collector output mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_CollectorWeightByRenamed(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP legacy_latency_seconds legacy_latency_seconds
+# TYPE legacy_latency_seconds gauge
+legacy_latency_seconds{service="api",pod="p1"} 1 1735054883000
+legacy_latency_seconds{service="api",pod="p2"} 4 1735054883000
+# HELP legacy_requests_total legacy_requests_total
+# TYPE legacy_requests_total counter
+legacy_requests_total{service="api",pod="p1"} 30 1735054883000
+legacy_requests_total{service="api",pod="p2"} 10 1735054883000
+`)
+	}))
+	defer ts.Close()
+
+	// both families are referred to by their new name
+	collector := &RemoteAggregator{
+		url:                    ts.URL,
+		aggregateWithOutLabels: []string{"pod"},
+		renameMetrics:          map[string]string{"legacy_latency_seconds": "request_latency_seconds", "legacy_requests_total": "requests_total"},
+		weightBy:               map[string]string{"request_latency_seconds": "requests_total"},
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	want := `# HELP request_latency_seconds legacy_latency_seconds
+# TYPE request_latency_seconds gauge
+request_latency_seconds{service="api"} 1.75 1735054883000
+# HELP requests_total legacy_requests_total
+# TYPE requests_total counter
+requests_total{service="api"} 40 1735054883000
+`
+	if diff := cmp.Diff(metricsToText(gathering), want); diff != "" {
+		t.Errorf("collector output mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_CollectorWeightByRounded(t *testing.T) {
+	log = slog.Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP request_latency_seconds request_latency_seconds
+# TYPE request_latency_seconds gauge
+request_latency_seconds{service="api",pod="p1"} 0.1 1735054883000
+request_latency_seconds{service="api",pod="p2"} 0.2 1735054883000
+# HELP requests_total requests_total
+# TYPE requests_total counter
+requests_total{service="api",pod="p1"} 1 1735054883000
+requests_total{service="api",pod="p2"} 2 1735054883000
+`)
+	}))
+	defer ts.Close()
+
+	collector := &RemoteAggregator{
+		url:                    ts.URL,
+		aggregateWithOutLabels: []string{"pod"},
+		weightBy:               map[string]string{"request_latency_seconds": "requests_total"},
+		roundScale:             100,
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	gathering, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+
+	// (1*0.1 + 2*0.2) / 3 rounded to 2 decimals
+	want := `# HELP request_latency_seconds request_latency_seconds
+# TYPE request_latency_seconds gauge
+request_latency_seconds{service="api"} 0.17 1735054883000
+# HELP requests_total requests_total
+# TYPE requests_total counter
+requests_total{service="api"} 3 1735054883000
+`
+	if diff := cmp.Diff(metricsToText(gathering), want); diff != "" {
+		t.Errorf("collector output mismatch (-want +got):\n%s", diff)
+	}
+}